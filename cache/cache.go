@@ -0,0 +1,454 @@
+// Package cache is an HTTP cache middleware with the semantics of a shared
+// cache, RFC 9111. It stores the responses to GET requests that allow it,
+// answers from them while they are fresh and revalidates them with their
+// ETag or Last-Modified once stale. Concurrent misses on a URL wait for a
+// single request to the handler.
+//
+//	c := cache.New(cache.NewMemoryStore(64 << 20))
+//	s.Mount("/wiki", server.Handler(c.Middleware(wiki.Handle)))
+//
+// The responses get an X-Cache field telling HIT, MISS or REVALIDATED.
+// Trailers, ranges and stale responses aren't served from the cache.
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+	"vivalchemy/http-server-from-scratch/server"
+)
+
+// DefaultMaxEntrySize is the largest body stored
+const DefaultMaxEntrySize = 1 << 20
+
+// maxVariants are kept per URL, the oldest are dropped
+const maxVariants = 8
+
+// Cache stores the responses of the handlers it wraps, see the package
+// documentation
+type Cache struct {
+	Storage      Storage
+	MaxEntrySize int // DefaultMaxEntrySize when zero
+
+	mu      sync.Mutex // serializes the updates of the variants of a key
+	flights sync.Map   // key -> *flight, the misses being fetched
+	now     func() time.Time
+}
+
+// New returns a cache in storage, a MemoryStore of DefaultMaxBytes when nil
+func New(storage Storage) *Cache {
+	if storage == nil {
+		storage = NewMemoryStore(DefaultMaxBytes)
+	}
+	return &Cache{Storage: storage}
+}
+
+// flight is the request to the handler for a key that concurrent misses
+// wait for. done closes once the response is stored, or once it is known
+// it won't be.
+type flight struct {
+	done   chan struct{}
+	once   sync.Once
+	stored bool
+}
+
+func (f *flight) finish(stored bool) {
+	f.once.Do(func() {
+		f.stored = stored
+		close(f.done)
+	})
+}
+
+func (c *Cache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// key is the primary cache key of a request, its host and target
+func key(req *request.Request) string {
+	return strings.ToLower(req.Host) + req.TargetPath
+}
+
+// Middleware caches the responses of next. Other methods than GET and
+// HEAD go through, and their successes invalidate what is stored for
+// their URL.
+func (c *Cache) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		switch req.Method {
+		case "GET", "HEAD":
+		default:
+			next(w, req)
+			if unsafe(req.Method) && w.Status() >= 200 && w.Status() < 400 {
+				c.Invalidate(req)
+			}
+			return
+		}
+		if _, ok := req.Headers.Get("upgrade"); ok {
+			// the connection is handed over, nothing to store
+			next(w, req)
+			return
+		}
+		c.serve(w, req, next)
+	}
+}
+
+func unsafe(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return false
+	}
+	return true
+}
+
+// Invalidate drops what is stored for the URL of req
+func (c *Cache) Invalidate(req *request.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Storage.Delete(key(req))
+}
+
+func (c *Cache) serve(w *response.Writer, req *request.Request, next server.Handler) {
+	k := key(req)
+	reqCC := parseRequestCacheControl(req.Headers)
+	coalesce := true
+	for {
+		stale := c.lookup(k, req)
+		if stale != nil {
+			if age := stale.age(c.clock()); fresh(stale, age, reqCC) {
+				c.respond(w, req, stale, "HIT")
+				return
+			}
+		}
+		if reqCC.has("only-if-cached") {
+			server.RenderError(w, req, response.StatusGatewayTimeout,
+				server.NewHTTPError(response.StatusGatewayTimeout, "not in the cache", nil))
+			return
+		}
+		if !coalesce || req.Method == "HEAD" {
+			c.fetch(w, req, next, k, stale, nil)
+			return
+		}
+
+		f := &flight{done: make(chan struct{})}
+		if other, loaded := c.flights.LoadOrStore(k, f); loaded {
+			f := other.(*flight)
+			select {
+			case <-f.done:
+			case <-req.Context().Done():
+				return
+			}
+			// look again once stored, otherwise go on alone
+			coalesce = f.stored
+			continue
+		}
+		defer c.flights.CompareAndDelete(k, f)
+		defer f.finish(false)
+		c.fetch(w, req, next, k, stale, f)
+		return
+	}
+}
+
+// lookup returns the stored variant matching req, nil when there is none
+func (c *Cache) lookup(k string, req *request.Request) *Entry {
+	for _, e := range c.Storage.Get(k) {
+		if matches(e, req.Headers) {
+			return e
+		}
+	}
+	return nil
+}
+
+// varyNames returns the lowercase field names of the Vary header of h
+func varyNames(h *headers.Headers) []string {
+	vary, _ := h.Get("vary")
+	names := []string{}
+	for _, name := range strings.Split(vary, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// varyValue normalizes the value of a field for comparing variants
+func varyValue(h *headers.Headers, name string) string {
+	value, _ := h.Get(name)
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	return strings.Join(parts, ",")
+}
+
+// matches reports whether the request fields named by the Vary header of
+// e have the values of the request it was stored for
+func matches(e *Entry, req *headers.Headers) bool {
+	for _, name := range varyNames(e.Headers) {
+		if varyValue(req, name) != e.Vary[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// fetch runs next for a miss, or to revalidate stale with its validators,
+// storing what it may of the response. f, when set, is finished as soon as
+// the response won't be stored.
+func (c *Cache) fetch(w *response.Writer, req *request.Request, next server.Handler, k string, stale *Entry, f *flight) {
+	// the conditions of the client are kept, unless replaced by the ones
+	// of the stored response
+	clientConditions := headers.NewHeaders()
+	for _, name := range []string{"if-none-match", "if-modified-since"} {
+		if value, ok := req.Headers.Get(name); ok {
+			clientConditions.Replace(name, value)
+		}
+	}
+	revalidating := false
+	if stale != nil {
+		etag, hasEtag := stale.Headers.Get("etag")
+		lastModified, hasLastModified := stale.Headers.Get("last-modified")
+		if hasEtag || hasLastModified {
+			revalidating = true
+			req.Headers.Delete("if-none-match")
+			req.Headers.Delete("if-modified-since")
+			if hasEtag {
+				req.Headers.Replace("If-None-Match", etag)
+			}
+			if hasLastModified {
+				req.Headers.Replace("If-Modified-Since", lastModified)
+			}
+		}
+	}
+	store := req.Method == "GET"
+
+	rec := &recorder{w: w, head: req.Method == "HEAD", limit: c.maxEntrySize()}
+	rec.onHeader = func(status response.StatusCode, h *headers.Headers) (forward bool, keep bool) {
+		if revalidating && status == response.StatusNotModified {
+			return false, true
+		}
+		keep = store && storable(req.Headers, h, status)
+		if !keep && f != nil {
+			f.finish(false)
+		}
+		return true, keep
+	}
+	requestTime := c.clock()
+	rw := response.NewBackendWriter(rec)
+	next(rw, req)
+	responseTime := c.clock()
+
+	if rw.Closing() {
+		// never answered or cut short
+		if rec.forward {
+			w.SetKeepAlive(false)
+		}
+		return
+	}
+	if rec.forward && rec.chunked && !rec.finished {
+		w.WriteChunkedBodyDone(nil)
+	}
+	if !rec.keep {
+		return
+	}
+
+	if !rec.forward {
+		// 304, the stored response is refreshed with its fields
+		updated := *stale
+		updated.Headers = cloneHeaders(stale.Headers)
+		for name, value := range rec.headers.GetAll() {
+			if name != "content-length" {
+				updated.Headers.Replace(name, value)
+			}
+		}
+		updated.RequestTime, updated.ResponseTime = requestTime, responseTime
+		updated.InitialAge = initialAge(updated.Headers, requestTime, responseTime)
+		c.store(k, &updated)
+		if f != nil {
+			f.finish(true)
+		}
+		req.Headers.Delete("if-none-match")
+		req.Headers.Delete("if-modified-since")
+		for name, value := range clientConditions.GetAll() {
+			req.Headers.Replace(name, value)
+		}
+		c.respond(w, req, &updated, "REVALIDATED")
+		return
+	}
+
+	if length, ok := rec.headers.Get("content-length"); ok && length != strconv.Itoa(len(rec.body)) {
+		return
+	}
+	e := &Entry{
+		Status:       rec.status,
+		Headers:      rec.headers,
+		Body:         rec.body,
+		Vary:         map[string]string{},
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+		InitialAge:   initialAge(rec.headers, requestTime, responseTime),
+	}
+	for _, name := range varyNames(rec.headers) {
+		e.Vary[name] = varyValue(req.Headers, name)
+	}
+	c.store(k, e)
+	if f != nil {
+		f.finish(true)
+	}
+}
+
+func (c *Cache) maxEntrySize() int {
+	if c.MaxEntrySize == 0 {
+		return DefaultMaxEntrySize
+	}
+	return c.MaxEntrySize
+}
+
+// store puts e first among the variants of k, replacing the one for the
+// same request fields
+func (c *Cache) store(k string, e *Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vary, _ := e.Headers.Get("vary")
+	variants := []*Entry{e}
+	for _, other := range c.Storage.Get(k) {
+		otherVary, _ := other.Headers.Get("vary")
+		if otherVary != vary || matches(other, requestOf(e)) {
+			continue
+		}
+		variants = append(variants, other)
+	}
+	c.Storage.Set(k, variants[:min(len(variants), maxVariants)])
+}
+
+// requestOf returns the request fields e was stored for
+func requestOf(e *Entry) *headers.Headers {
+	h := headers.NewHeaders()
+	for name, value := range e.Vary {
+		if value != "" {
+			h.Replace(name, value)
+		}
+	}
+	return h
+}
+
+// notModifiedFields are sent in a 304, RFC 9110 section 15.4.5
+var notModifiedFields = []string{"cache-control", "content-location", "date", "etag", "expires", "last-modified", "vary"}
+
+// respond answers req with e, or with a 304 when its conditions allow
+func (c *Cache) respond(w *response.Writer, req *request.Request, e *Entry, cacheStatus string) {
+	age := strconv.Itoa(int(e.age(c.clock()) / time.Second))
+	if notModified(req.Headers, e) {
+		h := headers.NewHeaders()
+		for _, name := range notModifiedFields {
+			if value, ok := e.Headers.Get(name); ok {
+				h.Replace(name, value)
+			}
+		}
+		h.Replace("Age", age)
+		h.Replace("X-Cache", cacheStatus)
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(*h)
+		return
+	}
+
+	h := cloneHeaders(e.Headers)
+	h.Replace("Age", age)
+	h.Replace("X-Cache", cacheStatus)
+	h.Replace("Content-Length", strconv.Itoa(len(e.Body)))
+	w.WriteStatusLine(e.Status)
+	w.WriteHeaders(*h)
+	if req.Method != "HEAD" {
+		w.WriteBody(e.Body)
+	}
+}
+
+func cloneHeaders(h *headers.Headers) *headers.Headers {
+	out := headers.NewHeaders()
+	for name, value := range h.GetAll() {
+		out.Replace(name, value)
+	}
+	return out
+}
+
+// recorder is the Backend the handler writes to. It passes the response
+// on to the client unless onHeader holds it back, and keeps it for the
+// cache while its body fits in limit.
+type recorder struct {
+	w        *response.Writer
+	head     bool // the response to a HEAD has no body
+	limit    int
+	onHeader func(status response.StatusCode, h *headers.Headers) (forward bool, keep bool)
+
+	status   response.StatusCode
+	headers  *headers.Headers
+	body     []byte
+	forward  bool
+	keep     bool
+	chunked  bool // forwarded with chunked framing
+	finished bool // the chunked body was ended with the trailers
+}
+
+func (r *recorder) WriteHeader(status response.StatusCode, h *headers.Headers) error {
+	if status == response.StatusContinue {
+		return r.w.WriteContinue()
+	}
+	if status < 200 {
+		if err := r.w.WriteStatusLine(status); err != nil {
+			return err
+		}
+		return r.w.WriteHeaders(*h)
+	}
+
+	r.status, r.headers = status, cloneHeaders(h)
+	r.forward, r.keep = r.onHeader(status, r.headers)
+	if !r.forward {
+		return nil
+	}
+	out := cloneHeaders(h)
+	out.Replace("X-Cache", "MISS")
+	_, sized := out.Get("content-length")
+	bodyless := r.head || status == response.StatusNoContent || status == response.StatusNotModified
+	if !sized && !bodyless {
+		out.Replace("Transfer-Encoding", "chunked")
+		r.chunked = true
+	}
+	if err := r.w.WriteStatusLine(status); err != nil {
+		return err
+	}
+	return r.w.WriteHeaders(*out)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	if r.keep {
+		if len(r.body)+len(p) > r.limit {
+			r.keep, r.body = false, nil
+		} else {
+			r.body = append(r.body, p...)
+		}
+	}
+	if !r.forward {
+		return len(p), nil
+	}
+	if r.chunked {
+		return r.w.WriteChunkedBody(p)
+	}
+	return r.w.WriteBody(p)
+}
+
+func (r *recorder) WriteTrailers(h *headers.Headers) error {
+	if len(h.GetAll()) > 0 {
+		// not stored, a cached response couldn't send them
+		r.keep = false
+	}
+	if !r.forward || !r.chunked {
+		return nil
+	}
+	r.finished = true
+	return r.w.WriteChunkedBodyDone(h)
+}
@@ -0,0 +1,290 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vivalchemy/http-server-from-scratch/client"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+	"vivalchemy/http-server-from-scratch/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// counter counts the requests reaching a handler
+type counter struct{ n atomic.Int64 }
+
+func (c *counter) count() int { return int(c.n.Load()) }
+
+// text answers with body and the fields given as name, value pairs
+func text(w *response.Writer, status response.StatusCode, body string, fields ...string) {
+	h := response.GetDefaultHeaders(len(body))
+	for i := 0; i+1 < len(fields); i += 2 {
+		h.Replace(fields[i], fields[i+1])
+	}
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+	w.WriteBody([]byte(body))
+}
+
+// testCache returns a cache whose clock moves with the returned function
+func testCache() (*Cache, func(d time.Duration)) {
+	offset := atomic.Int64{}
+	c := New(nil)
+	c.now = func() time.Time { return time.Now().Add(time.Duration(offset.Load())) }
+	return c, func(d time.Duration) { offset.Add(int64(d)) }
+}
+
+// serve serves the routes added by routes through c and returns the base
+// URL
+func serve(t *testing.T, c *Cache, routes func(r *server.Router)) string {
+	t.Helper()
+	s := server.NewServer()
+	routes(s.Group("/", c.Middleware))
+	require.NoError(t, s.Serve(0))
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+// send sends a request with the fields given as name, value pairs and
+// returns the response and its body
+func send(t *testing.T, method string, url string, fields ...string) (*client.Response, string) {
+	t.Helper()
+	req, err := client.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	for i := 0; i+1 < len(fields); i += 2 {
+		req.Headers.Replace(fields[i], fields[i+1])
+	}
+	res, err := (&client.Client{}).Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func field(res *client.Response, name string) string {
+	value, _ := res.Headers.Get(name)
+	return value
+}
+
+func TestCache(t *testing.T) {
+	c, advance := testCache()
+	fresh, private, vary, stream := &counter{}, &counter{}, &counter{}, &counter{}
+	base := serve(t, c, func(r *server.Router) {
+		r.Get("/fresh", func(w *response.Writer, req *request.Request) {
+			text(w, response.StatusOk, fmt.Sprint("v", fresh.n.Add(1)), "Cache-Control", "max-age=60")
+		})
+		r.Post("/fresh", func(w *response.Writer, req *request.Request) {
+			text(w, response.StatusOk, "posted")
+		})
+		r.Get("/private", func(w *response.Writer, req *request.Request) {
+			private.n.Add(1)
+			text(w, response.StatusOk, "mine", "Cache-Control", "private, max-age=60")
+		})
+		r.Get("/vary", func(w *response.Writer, req *request.Request) {
+			vary.n.Add(1)
+			lang, _ := req.Headers.Get("accept-language")
+			text(w, response.StatusOk, lang, "Cache-Control", "max-age=60", "Vary", "Accept-Language")
+		})
+		r.Get("/stream", func(w *response.Writer, req *request.Request) {
+			stream.n.Add(1)
+			h := response.GetDefaultHeaders(0)
+			h.Delete("Content-Length")
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Cache-Control", "max-age=60")
+			w.WriteStatusLine(response.StatusOk)
+			w.WriteHeaders(*h)
+			w.WriteChunkedBody([]byte("hello "))
+			w.WriteChunkedBody([]byte("world"))
+			w.WriteChunkedBodyDone(nil)
+		})
+	})
+
+	// Test: A fresh response is served from the cache with its Age
+	res, body := send(t, "GET", base+"/fresh")
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, "MISS", field(res, "x-cache"))
+	advance(10 * time.Second)
+	res, body = send(t, "GET", base+"/fresh")
+	assert.Equal(t, "v1", body)
+	assert.Equal(t, "HIT", field(res, "x-cache"))
+	assert.Equal(t, "10", field(res, "age"))
+	assert.Equal(t, 1, fresh.count())
+
+	// Test: Request directives skip the stored response
+	_, body = send(t, "GET", base+"/fresh", "Cache-Control", "max-age=5")
+	assert.Equal(t, "v2", body)
+	_, body = send(t, "GET", base+"/fresh", "Pragma", "no-cache")
+	assert.Equal(t, "v3", body)
+	_, body = send(t, "GET", base+"/fresh")
+	assert.Equal(t, "v3", body)
+
+	// Test: Once stale it is fetched again
+	advance(61 * time.Second)
+	_, body = send(t, "GET", base+"/fresh")
+	assert.Equal(t, "v4", body)
+
+	// Test: A successful unsafe request invalidates the URL
+	send(t, "POST", base+"/fresh")
+	res, body = send(t, "GET", base+"/fresh")
+	assert.Equal(t, "v5", body)
+	assert.Equal(t, "MISS", field(res, "x-cache"))
+
+	// Test: Private responses and no-store requests aren't stored
+	send(t, "GET", base+"/private")
+	send(t, "GET", base+"/private")
+	assert.Equal(t, 2, private.count())
+	send(t, "GET", base+"/vary", "Cache-Control", "no-store")
+	res, _ = send(t, "GET", base+"/vary", "Cache-Control", "only-if-cached")
+	assert.Equal(t, response.StatusGatewayTimeout, res.StatusCode)
+
+	// Test: Vary keeps a variant per value of the named fields
+	for _, lang := range []string{"en", "fr", "en", "fr"} {
+		_, body = send(t, "GET", base+"/vary", "Accept-Language", lang)
+		assert.Equal(t, lang, body)
+	}
+	assert.Equal(t, 3, vary.count())
+
+	// Test: Chunked responses are stored and served with their length
+	_, body = send(t, "GET", base+"/stream")
+	assert.Equal(t, "hello world", body)
+	res, body = send(t, "GET", base+"/stream")
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, "11", field(res, "content-length"))
+	assert.Equal(t, 1, stream.count())
+
+	// Test: Bodies over MaxEntrySize aren't stored
+	c.MaxEntrySize = 1
+	advance(61 * time.Second)
+	send(t, "GET", base+"/fresh")
+	res, _ = send(t, "GET", base+"/fresh")
+	assert.Equal(t, "MISS", field(res, "x-cache"))
+}
+
+func TestRevalidation(t *testing.T) {
+	c, advance := testCache()
+	etag := atomic.Value{}
+	etag.Store(`"v1"`)
+	full, notModified := &counter{}, &counter{}
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(TimeFormat)
+	base := serve(t, c, func(r *server.Router) {
+		r.Get("/etag", func(w *response.Writer, req *request.Request) {
+			current := etag.Load().(string)
+			if match, _ := req.Headers.Get("if-none-match"); match == current {
+				notModified.n.Add(1)
+				h := response.GetDefaultHeaders(0)
+				h.Delete("Content-Length")
+				h.Set("ETag", current)
+				h.Set("Cache-Control", "max-age=10")
+				w.WriteStatusLine(response.StatusNotModified)
+				w.WriteHeaders(*h)
+				return
+			}
+			full.n.Add(1)
+			text(w, response.StatusOk, "body "+current, "ETag", current, "Cache-Control", "no-cache")
+		})
+		r.Get("/modified", func(w *response.Writer, req *request.Request) {
+			if since, _ := req.Headers.Get("if-modified-since"); since == lastModified {
+				notModified.n.Add(1)
+				w.WriteStatusLine(response.StatusNotModified)
+				w.WriteHeaders(*response.GetDefaultHeaders(0))
+				return
+			}
+			full.n.Add(1)
+			text(w, response.StatusOk, "modified", "Last-Modified", lastModified, "Cache-Control", "max-age=10")
+		})
+	})
+
+	// Test: no-cache responses are revalidated with their ETag, the 304
+	// refreshes the stored response
+	send(t, "GET", base+"/etag")
+	res, body := send(t, "GET", base+"/etag")
+	assert.Equal(t, response.StatusOk, res.StatusCode)
+	assert.Equal(t, "body \"v1\"", body)
+	assert.Equal(t, "REVALIDATED", field(res, "x-cache"))
+	assert.Equal(t, "max-age=10", field(res, "cache-control"))
+	res, _ = send(t, "GET", base+"/etag")
+	assert.Equal(t, "HIT", field(res, "x-cache"))
+	assert.Equal(t, 1, full.count())
+	assert.Equal(t, 1, notModified.count())
+
+	// Test: The conditions of the client are answered from the cache
+	res, body = send(t, "GET", base+"/etag", "If-None-Match", `W/"v1", "v0"`)
+	assert.Equal(t, response.StatusNotModified, res.StatusCode)
+	assert.Equal(t, "", body)
+	assert.Equal(t, `"v1"`, field(res, "etag"))
+
+	// Test: A changed response replaces the stored one
+	advance(11 * time.Second)
+	etag.Store(`"v2"`)
+	res, body = send(t, "GET", base+"/etag", "If-None-Match", `"v1"`)
+	assert.Equal(t, response.StatusOk, res.StatusCode)
+	assert.Equal(t, "body \"v2\"", body)
+	assert.Equal(t, "MISS", field(res, "x-cache"))
+	assert.Equal(t, 2, full.count())
+
+	// Test: Stale responses are revalidated with their Last-Modified
+	send(t, "GET", base+"/modified")
+	advance(11 * time.Second)
+	res, body = send(t, "GET", base+"/modified")
+	assert.Equal(t, "modified", body)
+	assert.Equal(t, "REVALIDATED", field(res, "x-cache"))
+	res, _ = send(t, "GET", base+"/modified", "If-Modified-Since", time.Now().UTC().Format(TimeFormat))
+	assert.Equal(t, response.StatusNotModified, res.StatusCode)
+	assert.Equal(t, "HIT", field(res, "x-cache"))
+	assert.Equal(t, 3, full.count())
+	assert.Equal(t, 2, notModified.count())
+}
+
+func TestCoalescing(t *testing.T) {
+	c, _ := testCache()
+	release := make(chan struct{})
+	shared, private := &counter{}, &counter{}
+	base := serve(t, c, func(r *server.Router) {
+		r.Get("/shared", func(w *response.Writer, req *request.Request) {
+			shared.n.Add(1)
+			<-release
+			text(w, response.StatusOk, "shared", "Cache-Control", "max-age=60")
+		})
+		r.Get("/private", func(w *response.Writer, req *request.Request) {
+			private.n.Add(1)
+			<-release
+			text(w, response.StatusOk, "private", "Cache-Control", "private")
+		})
+	})
+
+	// Test: Concurrent misses make a single request, responses that won't
+	// be stored let the others through right away
+	wg := sync.WaitGroup{}
+	bodies := make(chan string, 10)
+	for _, path := range []string{"/shared", "/private"} {
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, body := send(t, "GET", base+path)
+				bodies <- body
+			}()
+		}
+	}
+	require.Eventually(t, func() bool { return shared.count() == 1 && private.count() >= 1 }, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, shared.count())
+	close(release)
+	wg.Wait()
+	close(bodies)
+	counts := map[string]int{}
+	for body := range bodies {
+		counts[body]++
+	}
+	assert.Equal(t, map[string]int{"shared": 5, "private": 5}, counts)
+	assert.Equal(t, 1, shared.count())
+	assert.Equal(t, 5, private.count())
+}
@@ -0,0 +1,239 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+// TimeFormat is the IMF-fixdate format of the HTTP dates, RFC 9110
+// section 5.6.7
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+const (
+	// HeuristicFraction of the time since Last-Modified is the freshness
+	// of a response without an explicit one
+	HeuristicFraction = 10
+	// HeuristicMax caps the heuristic freshness
+	HeuristicMax = 24 * time.Hour
+)
+
+// parseDate parses an HTTP date in any of the formats RFC 9110 accepts
+func parseDate(value string) (time.Time, bool) {
+	for _, layout := range []string{TimeFormat, time.RFC850, time.ANSIC} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// directives are the directives of a Cache-Control field, by lowercase
+// name with their unquoted argument
+type directives map[string]string
+
+func parseCacheControl(h *headers.Headers) directives {
+	d := directives{}
+	value, ok := h.Get("cache-control")
+	if !ok {
+		return d
+	}
+	for len(value) > 0 {
+		// the arguments may be quoted strings with commas inside
+		var part string
+		quoted := false
+		end := len(value)
+		for i, ch := range value {
+			if ch == '"' {
+				quoted = !quoted
+			} else if ch == ',' && !quoted {
+				end = i
+				break
+			}
+		}
+		part, value = value[:end], value[min(end+1, len(value)):]
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		d[strings.ToLower(name)] = strings.Trim(arg, `"`)
+	}
+	return d
+}
+
+// parseRequestCacheControl reads Pragma: no-cache as Cache-Control:
+// no-cache when there is no Cache-Control, RFC 9111 section 5.4
+func parseRequestCacheControl(h *headers.Headers) directives {
+	d := parseCacheControl(h)
+	if _, ok := h.Get("cache-control"); !ok {
+		if pragma, _ := h.Get("pragma"); strings.Contains(strings.ToLower(pragma), "no-cache") {
+			d["no-cache"] = ""
+		}
+	}
+	return d
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of name. An invalid one is
+// zero, which makes a response stale.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	arg, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// heuristic tells the statuses that can be cached without an explicit
+// freshness, RFC 9110 section 15.1. 206 is left out, ranges aren't stored.
+func heuristic(status response.StatusCode) bool {
+	switch status {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+	return false
+}
+
+// explicit reports whether a response says how long it is fresh, or that
+// any cache may store it
+func explicit(h *headers.Headers, cc directives) bool {
+	_, expires := h.Get("expires")
+	return expires || cc.has("max-age") || cc.has("s-maxage") || cc.has("public")
+}
+
+// storable decides whether the response to a GET may be stored by a
+// shared cache, RFC 9111 section 3. Responses setting cookies aren't, they
+// would hand one client's cookies to the others.
+func storable(req, res *headers.Headers, status response.StatusCode) bool {
+	if status < 200 || status == response.StatusNotModified || status == 206 {
+		return false
+	}
+	reqCC, cc := parseRequestCacheControl(req), parseCacheControl(res)
+	if reqCC.has("no-store") || cc.has("no-store") || cc.has("private") {
+		return false
+	}
+	if vary, _ := res.Get("vary"); strings.Contains(vary, "*") {
+		return false
+	}
+	if _, ok := res.Get("set-cookie"); ok {
+		return false
+	}
+	if _, ok := req.Get("authorization"); ok && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	if explicit(res, cc) {
+		return true
+	}
+	// stored to be revalidated, or fresh by heuristic for a while
+	_, etag := res.Get("etag")
+	_, lastModified := res.Get("last-modified")
+	return heuristic(status) && (etag || lastModified)
+}
+
+// lifetime returns the freshness lifetime of a stored response, RFC 9111
+// section 4.2.1
+func lifetime(e *Entry) time.Duration {
+	cc := parseCacheControl(e.Headers)
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date := e.ResponseTime
+	if value, ok := e.Headers.Get("date"); ok {
+		if t, ok := parseDate(value); ok {
+			date = t
+		}
+	}
+	if value, ok := e.Headers.Get("expires"); ok {
+		expires, ok := parseDate(value)
+		if !ok {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if value, ok := e.Headers.Get("last-modified"); ok && heuristic(e.Status) {
+		if lastModified, ok := parseDate(value); ok && lastModified.Before(date) {
+			return min(date.Sub(lastModified)/HeuristicFraction, HeuristicMax)
+		}
+	}
+	return 0
+}
+
+// initialAge is the corrected initial age of a response, RFC 9111 section
+// 4.2.3
+func initialAge(h *headers.Headers, requestTime, responseTime time.Time) time.Duration {
+	apparent := time.Duration(0)
+	if value, ok := h.Get("date"); ok {
+		if date, ok := parseDate(value); ok {
+			apparent = max(0, responseTime.Sub(date))
+		}
+	}
+	age := time.Duration(h.GetIntMust("age", 0)) * time.Second
+	return max(apparent, age+responseTime.Sub(requestTime))
+}
+
+// fresh decides whether e can answer a request without revalidation
+func fresh(e *Entry, age time.Duration, reqCC directives) bool {
+	if parseCacheControl(e.Headers).has("no-cache") || reqCC.has("no-cache") {
+		return false
+	}
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	life := lifetime(e)
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		life -= minFresh
+	}
+	return age < life
+}
+
+// etagMatch compares entity tags weakly, RFC 9110 section 8.8.3.2
+func etagMatch(list string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || etag != "" && strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates the conditional fields of a request against e,
+// If-None-Match takes precedence over If-Modified-Since. Only a 200 turns
+// into a 304.
+func notModified(req *headers.Headers, e *Entry) bool {
+	if e.Status != response.StatusOk {
+		return false
+	}
+	if list, ok := req.Get("if-none-match"); ok {
+		etag, _ := e.Headers.Get("etag")
+		return etagMatch(list, etag)
+	}
+	value, ok := req.Get("if-modified-since")
+	if !ok {
+		return false
+	}
+	since, ok := parseDate(value)
+	if !ok {
+		return false
+	}
+	modified, ok := e.Headers.Get("last-modified")
+	if !ok {
+		return false
+	}
+	lastModified, ok := parseDate(modified)
+	return ok && !lastModified.After(since)
+}
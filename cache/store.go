@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+// DefaultMaxBytes is the size of a MemoryStore made by New
+const DefaultMaxBytes = 64 << 20
+
+// Entry is a stored response
+type Entry struct {
+	Status  response.StatusCode
+	Headers *headers.Headers
+	Body    []byte
+	// Vary holds the request fields named by the Vary header of the
+	// response, with their values in the request it answered
+	Vary         map[string]string
+	RequestTime  time.Time     // when the request was handed to the handler
+	ResponseTime time.Time     // when the handler was done
+	InitialAge   time.Duration // the age when received, RFC 9111 section 4.2.3
+}
+
+// Size returns the bytes the entry takes, roughly
+func (e *Entry) Size() int64 {
+	size := int64(len(e.Body))
+	for k, v := range e.Headers.GetAll() {
+		size += int64(len(k) + len(v))
+	}
+	for k, v := range e.Vary {
+		size += int64(len(k) + len(v))
+	}
+	return size
+}
+
+// age returns the current age of the entry, RFC 9111 section 4.2.3
+func (e *Entry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.ResponseTime)
+}
+
+// Storage keeps the entries of a Cache. The variants of a URL, the
+// responses with a Vary header, are kept together under its key, the most
+// recent first. A Storage is used concurrently, the entries it is given
+// are never modified.
+type Storage interface {
+	// Get returns the variants of key, nil when there are none
+	Get(key string) []*Entry
+	Set(key string, variants []*Entry)
+	Delete(key string)
+}
+
+// MemoryStore is a Storage in memory, evicting the least recently used
+// keys once its entries take more than MaxBytes
+type MemoryStore struct {
+	MaxBytes int64
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List // of *memoryItem, the most recently used first
+	size  int64
+}
+
+type memoryItem struct {
+	key      string
+	variants []*Entry
+	size     int64
+}
+
+// NewMemoryStore returns an empty store of at most maxBytes
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{MaxBytes: maxBytes, items: map[string]*list.Element{}, order: list.New()}
+}
+
+func (s *MemoryStore) Get(key string) []*Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	s.order.MoveToFront(element)
+	return element.Value.(*memoryItem).variants
+}
+
+// Set stores the variants of key, they are dropped when they alone take
+// more than MaxBytes
+func (s *MemoryStore) Set(key string, variants []*Entry) {
+	item := &memoryItem{key: key, variants: variants}
+	for _, e := range variants {
+		item.size += e.Size()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	if item.size > s.MaxBytes {
+		return
+	}
+	s.items[key] = s.order.PushFront(item)
+	s.size += item.size
+	for s.size > s.MaxBytes {
+		s.remove(s.order.Back().Value.(*memoryItem).key)
+	}
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+}
+
+func (s *MemoryStore) remove(key string) {
+	element, ok := s.items[key]
+	if !ok {
+		return
+	}
+	s.order.Remove(element)
+	delete(s.items, key)
+	s.size -= element.Value.(*memoryItem).size
+}
+
+// Len returns the number of keys in the store
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+// Size returns the bytes taken by the entries of the store
+func (s *MemoryStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
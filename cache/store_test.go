@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/response"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func entry(size int) []*Entry {
+	return []*Entry{{Status: response.StatusOk, Headers: headers.NewHeaders(), Body: []byte(strings.Repeat("x", size))}}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(100)
+
+	// Test: Entries are kept until the store is full, then the least
+	// recently used go first
+	s.Set("a", entry(40))
+	s.Set("b", entry(40))
+	assert.NotNil(t, s.Get("a"))
+	s.Set("c", entry(40))
+	assert.Nil(t, s.Get("b"))
+	assert.NotNil(t, s.Get("a"))
+	assert.NotNil(t, s.Get("c"))
+	assert.Equal(t, 2, s.Len())
+	assert.Equal(t, int64(80), s.Size())
+
+	// Test: Replacing a key counts its new size only
+	s.Set("a", entry(10))
+	assert.Equal(t, int64(50), s.Size())
+
+	// Test: Entries larger than the store aren't kept
+	s.Set("d", entry(101))
+	assert.Nil(t, s.Get("d"))
+	assert.Equal(t, 2, s.Len())
+
+	// Test: Delete
+	s.Delete("a")
+	s.Delete("missing")
+	assert.Nil(t, s.Get("a"))
+	assert.Equal(t, int64(40), s.Size())
+}
@@ -0,0 +1,466 @@
+// Package client sends HTTP/1.1 requests built with the request package
+// and reads the responses with the response package. Connections are kept
+// alive and pooled per host, redirects are followed.
+//
+//	res, err := client.DefaultClient.Get("http://localhost:5173/")
+//	defer res.Body.Close()
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+var ErrorInvalidURL = fmt.Errorf("invalid request url")
+var ErrorTooManyRedirects = fmt.Errorf("too many redirects")
+var ErrorTimeout = fmt.Errorf("client timeout")
+
+// ErrorUseLastResponse returned by CheckRedirect stops following redirects,
+// Do then returns the redirect response itself without an error
+var ErrorUseLastResponse = fmt.Errorf("use last response")
+
+const (
+	DefaultDialTimeout    = 30 * time.Second
+	DefaultIdleTimeout    = 90 * time.Second
+	DefaultMaxIdlePerHost = 2
+	DefaultMaxRedirects   = 10
+	drainLimit            = 4 << 10 // body bytes read to reuse a connection after a redirect
+)
+
+// Response is a response whose body streams from the connection. Closing
+// Body before its end closes the connection, reading it to the end puts
+// the connection back into the pool.
+type Response struct {
+	StatusCode  response.StatusCode
+	HttpVersion string
+	Headers     *headers.Headers
+	// Trailers holds the trailer fields of a chunked body once Body is read
+	Trailers *headers.Headers
+	Body     io.ReadCloser
+	Request  *request.Request // the last request, after redirects
+}
+
+// Client sends requests, the zero value is ready to use
+type Client struct {
+	// Dial connects to host:port, a net.Dialer with DialTimeout when nil.
+	// https requests get TLS on top of it.
+	Dial        func(ctx context.Context, network string, address string) (net.Conn, error)
+	DialTimeout time.Duration
+	TLSConfig   *tls.Config
+	// Timeout bounds a whole request, redirects and reading the body
+	// included, none when 0. HeaderTimeout only bounds the wait for the
+	// response headers of each request sent.
+	Timeout       time.Duration
+	HeaderTimeout time.Duration
+	// IdleTimeout closes the pooled connections unused for that long,
+	// MaxIdlePerHost caps their number per host. DisableKeepAlives closes
+	// every connection after its response.
+	IdleTimeout       time.Duration
+	MaxIdlePerHost    int
+	DisableKeepAlives bool
+	// CheckRedirect decides on following a redirect to req, via holds the
+	// requests sent so far, oldest first. When nil DefaultMaxRedirects are
+	// followed.
+	CheckRedirect func(req *request.Request, via []*request.Request) error
+
+	mu   sync.Mutex
+	idle map[string][]*conn
+}
+
+// DefaultClient is the client used by Get and Post
+var DefaultClient = &Client{}
+
+// Get sends a GET request to rawURL with DefaultClient
+func Get(rawURL string) (*Response, error) {
+	return DefaultClient.Get(rawURL)
+}
+
+// Post sends body to rawURL with DefaultClient
+func Post(rawURL string, contentType string, body []byte) (*Response, error) {
+	return DefaultClient.Post(rawURL, contentType, body)
+}
+
+// NewRequest builds a request to an absolute http or https URL. Its Host
+// is the authority of the URL, its context can be set with SetContext.
+func NewRequest(method string, rawURL string, body []byte) (*request.Request, error) {
+	line, err := request.NewRequestLine(method, rawURL, "1.1")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %w", ErrorInvalidURL, rawURL, err)
+	}
+	if line.TargetForm != request.FormAbsolute || line.Scheme != "http" && line.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %q", ErrorInvalidURL, rawURL)
+	}
+	req := request.NewRequest()
+	req.RequestLine = *line
+	req.Host = line.Authority
+	if body != nil {
+		req.Body = body
+	}
+	return req, nil
+}
+
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *Client) Post(rawURL string, contentType string, body []byte) (*Response, error) {
+	req, err := NewRequest("POST", rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Headers.Replace("Content-Type", contentType)
+	return c.Do(req)
+}
+
+// Do sends req, built by NewRequest, and follows the redirects of its
+// responses. 301, 302 and 303 are followed with a GET without body, 307
+// and 308 with the same method and body. The credentials are dropped when
+// a redirect leaves the host.
+func (c *Client) Do(req *request.Request) (*Response, error) {
+	ctx := req.Context()
+	cancel := context.CancelFunc(func() {})
+	if c.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+	}
+
+	via := []*request.Request{}
+	for {
+		res, err := c.send(ctx, req)
+		if err != nil {
+			cancel()
+			if errors.Is(err, context.DeadlineExceeded) && c.Timeout > 0 {
+				err = fmt.Errorf("%w: %w", ErrorTimeout, err)
+			}
+			return nil, err
+		}
+		next, err := c.redirect(req, res, via)
+		if next == nil || err != nil {
+			if err != nil {
+				res.Body.Close()
+				cancel()
+				return nil, err
+			}
+			// the timeout keeps running while the body is read
+			res.Body = &cancelBody{ReadCloser: res.Body, ctx: ctx, cancel: cancel}
+			return res, nil
+		}
+		discard(res.Body)
+		via = append(via, req)
+		req = next
+	}
+}
+
+// redirect returns the request following res, nil when res is the final
+// response
+func (c *Client) redirect(req *request.Request, res *Response, via []*request.Request) (*request.Request, error) {
+	method := req.Method
+	body := req.Body
+	switch res.StatusCode {
+	case response.StatusMovedPermanently, response.StatusFound, response.StatusSeeOther:
+		if method != "HEAD" {
+			method = "GET"
+		}
+		body = nil
+	case response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+		if req.BodyStream != nil {
+			// a streamed body can't be sent again
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+	location, ok := res.Headers.Get("location")
+	if !ok {
+		return nil, nil
+	}
+
+	base, err := url.Parse(requestURL(req))
+	if err != nil {
+		return nil, err
+	}
+	target, err := base.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("%w: location %q: %w", ErrorInvalidURL, location, err)
+	}
+	next, err := NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	next.SetContext(req.Context())
+	for name, value := range req.Headers.GetAll() {
+		next.Headers.Replace(name, value)
+	}
+	next.Headers.Delete("host")
+	if body == nil {
+		next.Headers.Delete("content-length")
+		next.Headers.Delete("content-type")
+	}
+	if !strings.EqualFold(target.Host, base.Host) {
+		next.Headers.Delete("authorization")
+		next.Headers.Delete("cookie")
+	}
+
+	via = append(via, req)
+	if c.CheckRedirect != nil {
+		err = c.CheckRedirect(next, via)
+	} else if len(via) > DefaultMaxRedirects {
+		err = fmt.Errorf("%w: %d", ErrorTooManyRedirects, len(via))
+	}
+	if errors.Is(err, ErrorUseLastResponse) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// send makes one round trip. A pooled connection that turns out to be
+// closed by the server is replaced for requests that can be sent again.
+func (c *Client) send(ctx context.Context, req *request.Request) (*Response, error) {
+	for {
+		cn, reused, err := c.conn(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.roundTrip(ctx, cn, req)
+		if err == nil {
+			return res, nil
+		}
+		if reused && stale(err) && idempotent(req.Method) && req.BodyStream == nil && ctx.Err() == nil {
+			continue
+		}
+		return nil, err
+	}
+}
+
+func (c *Client) roundTrip(ctx context.Context, cn *conn, req *request.Request) (*Response, error) {
+	stop := context.AfterFunc(ctx, func() { cn.Close() })
+	fail := func(err error) (*Response, error) {
+		stop()
+		cn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	keepAlive := !c.DisableKeepAlives && req.KeepAlive()
+	if err := writeRequest(cn.writer, req, keepAlive); err != nil {
+		return fail(err)
+	}
+	if err := cn.writer.Flush(); err != nil {
+		return fail(err)
+	}
+	// set once the request is sent, a streamed body taking its time
+	if c.HeaderTimeout > 0 {
+		cn.SetDeadline(time.Now().Add(c.HeaderTimeout))
+	}
+
+	head, err := cn.readHead()
+	if err != nil {
+		return fail(err)
+	}
+	cn.SetDeadline(time.Time{})
+	body, err := cn.reader.BodyReader(head, req.Method)
+	if err != nil {
+		return fail(err)
+	}
+
+	reusable := keepAlive && head.KeepAlive() && head.Delimited(req.Method)
+	return &Response{
+		StatusCode:  head.StatusCode,
+		HttpVersion: head.HttpVersion,
+		Headers:     head.Headers,
+		Trailers:    head.Trailers,
+		Request:     req,
+		Body: &connBody{r: body, done: func(eof bool) {
+			if !stop() {
+				// the context closed the connection already
+				return
+			}
+			if eof && reusable {
+				c.put(cn)
+				return
+			}
+			cn.Close()
+		}},
+	}, nil
+}
+
+// writeRequest writes req in origin-form with a Content-Length body. A
+// BodyStream is sent with the Content-Length of the headers, chunked
+// without one.
+func writeRequest(w *bufio.Writer, req *request.Request, keepAlive bool) error {
+	if err := req.Headers.Validate(); err != nil {
+		return err
+	}
+	if !headers.ValidFieldValue(req.Host) {
+		return fmt.Errorf("%w: host %q", ErrorInvalidURL, req.Host)
+	}
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\nhost: %s\r\n", req.Method, req.TargetPath, req.Host)
+	for name, value := range req.Headers.GetAll() {
+		switch name {
+		case "host", "connection", "content-length", "transfer-encoding":
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s\r\n", name, value)
+	}
+	length := int64(-1)
+	if req.BodyStream != nil {
+		if value, ok := req.Headers.Get("content-length"); ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%w: content-length %q", request.ErrorInvalidContentLength, value)
+			}
+			length = n
+			fmt.Fprintf(w, "content-length: %d\r\n", length)
+		} else {
+			w.WriteString("transfer-encoding: chunked\r\n")
+		}
+	} else if _, ok := req.Headers.Get("content-length"); ok || len(req.Body) > 0 {
+		fmt.Fprintf(w, "content-length: %d\r\n", len(req.Body))
+	}
+	if !keepAlive {
+		w.WriteString("connection: close\r\n")
+	}
+	w.WriteString("\r\n")
+	if req.BodyStream != nil {
+		return writeBody(w, req.BodyStream, length)
+	}
+	_, err := w.Write(req.Body)
+	return err
+}
+
+// writeBody streams body, length bytes of it or chunked when length is
+// negative. Each read is flushed so the server gets it as it comes.
+func writeBody(w *bufio.Writer, body io.Reader, length int64) error {
+	if length >= 0 {
+		body = io.LimitReader(body, length)
+	}
+	buf := make([]byte, 32*1024)
+	var sent int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			sent += int64(n)
+			if length < 0 {
+				fmt.Fprintf(w, "%x\r\n", n)
+			}
+			w.Write(buf[:n])
+			if length < 0 {
+				w.WriteString("\r\n")
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if length < 0 {
+		_, err := w.WriteString("0\r\n\r\n")
+		return err
+	}
+	if sent < length {
+		return fmt.Errorf("%w: body of %d bytes, content-length %d", io.ErrUnexpectedEOF, sent, length)
+	}
+	return nil
+}
+
+// stale tells the errors of a pooled connection the server closed before
+// it got the request
+func stale(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// idempotent methods can be sent again when a pooled connection failed
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// requestURL rebuilds the absolute URL of a request made by NewRequest
+func requestURL(req *request.Request) string {
+	return req.Scheme + "://" + req.Authority + req.TargetPath
+}
+
+// discard reads a little of a redirect body so its connection can be
+// reused, then closes it
+func discard(body io.ReadCloser) {
+	io.CopyN(io.Discard, body, drainLimit)
+	body.Close()
+}
+
+// connBody calls done once, with whether the body was read to its end
+type connBody struct {
+	r    io.Reader
+	done func(eof bool)
+	once sync.Once
+}
+
+func (b *connBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil {
+		b.once.Do(func() { b.done(errors.Is(err, io.EOF)) })
+	}
+	return n, err
+}
+
+func (b *connBody) Close() error {
+	b.once.Do(func() { b.done(false) })
+	return nil
+}
+
+// cancelBody ends the context of Client.Timeout with the body
+type cancelBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && b.ctx.Err() != nil {
+		// the context closed the connection under the read
+		err = b.ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %w", ErrorTimeout, err)
+		}
+	}
+	if err != nil {
+		b.cancel()
+	}
+	return n, err
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,268 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+	"vivalchemy/http-server-from-scratch/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func text(w *response.Writer, status response.StatusCode, body string) {
+	h := response.GetDefaultHeaders(len(body))
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+	w.WriteBody([]byte(body))
+}
+
+func redirect(status response.StatusCode, location string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Set("Location", location)
+		w.WriteStatusLine(status)
+		w.WriteHeaders(*h)
+	}
+}
+
+// testServer serves the routes the client is tested against and returns
+// its base URL
+func testServer(t *testing.T) string {
+	t.Helper()
+	s := server.NewServer()
+	s.Get("/conn", func(w *response.Writer, req *request.Request) {
+		text(w, response.StatusOk, fmt.Sprint(req.ConnRequests))
+	})
+	echo := func(w *response.Writer, req *request.Request) {
+		contentType, _ := req.Headers.Get("content-type")
+		text(w, response.StatusOk, fmt.Sprintf("%s %s %s %s", req.Method, req.TargetPath, contentType, req.Body))
+	}
+	s.Get("/echo", echo)
+	s.Post("/echo", echo)
+	s.Get("/stream", func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*h)
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc")
+		w.WriteChunkedBodyDone(trailers)
+	})
+	s.Post("/found", redirect(response.StatusFound, "/echo?from=found"))
+	s.Post("/temporary", redirect(response.StatusTemporaryRedirect, "echo"))
+	s.Get("/loop", redirect(response.StatusFound, "/loop"))
+	s.Get("/slow", func(w *response.Writer, req *request.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+		text(w, response.StatusOk, "late")
+	})
+	require.NoError(t, s.Serve(0))
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+// rawServer answers every connection with raw once and closes it
+func rawServer(t *testing.T, raw string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := request.RequestFromReader(conn); err == nil {
+					io.WriteString(conn, raw)
+				}
+			}()
+		}
+	}()
+	return "http://" + listener.Addr().String()
+}
+
+func readAll(t *testing.T, res *Response) string {
+	t.Helper()
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestClient(t *testing.T) {
+	base := testServer(t)
+	c := &Client{}
+	defer c.CloseIdleConnections()
+
+	// Test: Content-Length bodies, the connection is reused once read
+	res, err := c.Get(base + "/conn")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOk, res.StatusCode)
+	assert.Equal(t, "1", readAll(t, res))
+	res, err = c.Get(base + "/conn")
+	require.NoError(t, err)
+	assert.Equal(t, "2", readAll(t, res))
+
+	// Test: A body closed before its end doesn't go back to the pool
+	res, err = c.Get(base + "/conn")
+	require.NoError(t, err)
+	res.Body.Close()
+	res, err = c.Get(base + "/conn")
+	require.NoError(t, err)
+	assert.Equal(t, "1", readAll(t, res))
+
+	// Test: Chunked bodies with their trailers
+	res, err = c.Get(base + "/stream")
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", readAll(t, res))
+	checksum, _ := res.Trailers.Get("x-checksum")
+	assert.Equal(t, "abc", checksum)
+
+	// Test: Bodies are sent with their Content-Length
+	res, err = c.Post(base+"/echo?q=1", "text/plain", []byte("ping"))
+	require.NoError(t, err)
+	assert.Equal(t, "POST /echo?q=1 text/plain ping", readAll(t, res))
+
+	// Test: A BodyStream is sent chunked, or with the Content-Length set
+	req, err := NewRequest("POST", base+"/echo", nil)
+	require.NoError(t, err)
+	req.BodyStream = io.MultiReader(strings.NewReader("hello "), strings.NewReader("world"))
+	res, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /echo  hello world", readAll(t, res))
+	req, err = NewRequest("POST", base+"/echo", nil)
+	require.NoError(t, err)
+	req.Headers.Set("Content-Length", "4")
+	req.BodyStream = strings.NewReader("ping")
+	res, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /echo  ping", readAll(t, res))
+
+	// Test: A BodyStream shorter than its Content-Length fails
+	req, err = NewRequest("POST", base+"/echo", nil)
+	require.NoError(t, err)
+	req.Headers.Set("Content-Length", "10")
+	req.BodyStream = strings.NewReader("ping")
+	_, err = c.Do(req)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Close delimited bodies end with the connection
+	res, err = c.Get(rawServer(t, "HTTP/1.1 200 OK\r\n\r\nuntil the end"))
+	require.NoError(t, err)
+	assert.Equal(t, "until the end", readAll(t, res))
+
+	// Test: Interim responses are skipped
+	res, err = c.Get(rawServer(t, "HTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusNoContent, res.StatusCode)
+	assert.Equal(t, "", readAll(t, res))
+
+	// Test: A pooled connection the server closed is replaced
+	closing := rawServer(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	for range 3 {
+		res, err = c.Get(closing)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", readAll(t, res))
+	}
+
+	// Test: Malformed responses fail
+	_, err = c.Get(rawServer(t, "HTTP/1.1 OK\r\n\r\n"))
+	assert.ErrorIs(t, err, response.ErrorMalformedStatusLine)
+	_, err = NewRequest("GET", "/relative", nil)
+	assert.ErrorIs(t, err, ErrorInvalidURL)
+	_, err = NewRequest("GET", "ftp://example.com/", nil)
+	assert.ErrorIs(t, err, ErrorInvalidURL)
+}
+
+func TestRedirects(t *testing.T) {
+	base := testServer(t)
+	c := &Client{}
+
+	// Test: 302 turns a POST into a GET without body
+	res, err := c.Post(base+"/found", "text/plain", []byte("ping"))
+	require.NoError(t, err)
+	assert.Equal(t, "GET /echo?from=found  ", readAll(t, res))
+	assert.Equal(t, "/echo?from=found", res.Request.TargetPath)
+
+	// Test: 307 keeps the method and body, relative locations resolve
+	res, err = c.Post(base+"/temporary", "text/plain", []byte("ping"))
+	require.NoError(t, err)
+	assert.Equal(t, "POST /echo text/plain ping", readAll(t, res))
+
+	// Test: 307 isn't followed with a streamed body, it can't be sent again
+	req, err := NewRequest("POST", base+"/temporary", nil)
+	require.NoError(t, err)
+	req.BodyStream = strings.NewReader("ping")
+	res, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusTemporaryRedirect, res.StatusCode)
+	res.Body.Close()
+
+	// Test: Redirect loops stop
+	_, err = c.Get(base + "/loop")
+	assert.ErrorIs(t, err, ErrorTooManyRedirects)
+
+	// Test: CheckRedirect can hand back the redirect itself
+	c.CheckRedirect = func(req *request.Request, via []*request.Request) error {
+		return ErrorUseLastResponse
+	}
+	res, err = c.Get(base + "/loop")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusFound, res.StatusCode)
+	location, _ := res.Headers.Get("location")
+	assert.Equal(t, "/loop", location)
+	res.Body.Close()
+}
+
+func TestTimeouts(t *testing.T) {
+	base := testServer(t)
+
+	// Test: HeaderTimeout bounds the wait for the response headers
+	c := &Client{HeaderTimeout: 50 * time.Millisecond}
+	_, err := c.Get(base + "/slow")
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// Test: Timeout bounds the whole request
+	c = &Client{Timeout: 50 * time.Millisecond}
+	_, err = c.Get(base + "/slow")
+	assert.ErrorIs(t, err, ErrorTimeout)
+
+	// Test: Timeout keeps running while the body is read
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request.RequestFromReader(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nslow")
+		time.Sleep(time.Second)
+	}()
+	res, err := c.Get("http://" + listener.Addr().String())
+	require.NoError(t, err)
+	_, err = io.ReadAll(res.Body)
+	assert.True(t, errors.Is(err, ErrorTimeout), err)
+	res.Body.Close()
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+// conn is a connection to a host, pooled between its requests
+type conn struct {
+	net.Conn
+	key       string // scheme and host:port, the pool it goes back to
+	writer    *bufio.Writer
+	reader    *response.Reader
+	idleSince time.Time
+}
+
+// readHead reads the head of the final response, skipping the interim
+// ones. 101 Switching Protocols is final, the client doesn't upgrade.
+func (cn *conn) readHead() (*response.Response, error) {
+	for {
+		head, err := cn.reader.ReadHeaders()
+		if err != nil {
+			return nil, err
+		}
+		if head.StatusCode >= 200 || head.StatusCode == response.StatusSwitchingProtocols {
+			return head, nil
+		}
+	}
+}
+
+// conn returns an idle connection to the host of req, or dials a new one.
+// reused tells the pooled ones, which the server may have closed since.
+func (c *Client) conn(ctx context.Context, req *request.Request) (cn *conn, reused bool, err error) {
+	address := req.Authority
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "80"
+		if req.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(req.Authority, port)
+	}
+	key := req.Scheme + "://" + address
+
+	if cn := c.get(key); cn != nil {
+		return cn, true, nil
+	}
+	netConn, err := c.dial(ctx, address)
+	if err != nil {
+		return nil, false, err
+	}
+	if req.Scheme == "https" {
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			host, _, _ := net.SplitHostPort(address)
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(netConn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			netConn.Close()
+			return nil, false, err
+		}
+		netConn = tlsConn
+	}
+	return &conn{Conn: netConn, key: key, writer: bufio.NewWriter(netConn), reader: response.NewReader(netConn)}, false, nil
+}
+
+func (c *Client) dial(ctx context.Context, address string) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial(ctx, "tcp", address)
+	}
+	timeout := c.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// get takes the most recently used idle connection of key, closing the
+// ones idle for too long
+func (c *Client) get(key string) *conn {
+	timeout := c.IdleTimeout
+	if timeout == 0 {
+		timeout = DefaultIdleTimeout
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idle := c.idle[key]
+	for len(idle) > 0 {
+		cn := idle[len(idle)-1]
+		idle = idle[:len(idle)-1]
+		if time.Since(cn.idleSince) < timeout {
+			c.idle[key] = idle
+			return cn
+		}
+		cn.Close()
+	}
+	delete(c.idle, key)
+	return nil
+}
+
+// put returns a connection whose response was read to the pool
+func (c *Client) put(cn *conn) {
+	limit := c.MaxIdlePerHost
+	if limit == 0 {
+		limit = DefaultMaxIdlePerHost
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle == nil {
+		c.idle = map[string][]*conn{}
+	}
+	if len(c.idle[cn.key]) >= limit {
+		cn.Close()
+		return
+	}
+	cn.idleSince = time.Now()
+	c.idle[cn.key] = append(c.idle[cn.key], cn)
+}
+
+// CloseIdleConnections closes the pooled connections, the ones in use
+// aren't affected
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, idle := range c.idle {
+		for _, cn := range idle {
+			cn.Close()
+		}
+	}
+	c.idle = nil
+}
@@ -1,20 +1,24 @@
 package main
 
 import (
-	"crypto/sha256"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
-	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/cache"
+	"vivalchemy/http-server-from-scratch/proxy"
 	"vivalchemy/http-server-from-scratch/request"
 	"vivalchemy/http-server-from-scratch/response"
 	"vivalchemy/http-server-from-scratch/server"
+	"vivalchemy/http-server-from-scratch/sse"
+	"vivalchemy/http-server-from-scratch/tunnel"
+	"vivalchemy/http-server-from-scratch/websocket"
 )
 
 const port = 5173
@@ -62,12 +66,50 @@ func respond500() []byte {
 	`)
 }
 
-func toStr(b []byte) string {
-	out := strings.Builder{}
-	for _, c := range b {
-		out.WriteString(fmt.Sprintf("%02x", c))
+func respondError(status response.StatusCode) []byte {
+	return fmt.Appendf(nil, `
+<html>
+  <head>
+    <title>%[1]d %[2]s</title>
+  </head>
+  <body>
+    <h1>%[2]s</h1>
+    <p>Well, that didn't work out.</p>
+  </body>
+</html>
+`, status, response.StatusText(status))
+}
+
+// errorPage renders the server's parse and routing failures with the same
+// pages the handlers use
+func errorPage(w *response.Writer, req *request.Request, status response.StatusCode, err error) {
+	var body []byte
+	switch {
+	case status == response.StatusBadRequest:
+		body = respond400()
+	case status >= 500:
+		body = respond500()
+	default:
+		body = respondError(status)
 	}
-	return out.String()
+	if status >= 500 {
+		log.Printf("error %d: %v", status, err)
+	}
+
+	h := response.GetDefaultHeaders(len(body))
+	h.Replace("Content-Type", "text/html")
+	var notAllowed *server.MethodNotAllowedError
+	if errors.As(err, &notAllowed) {
+		h.Set("Allow", strings.Join(notAllowed.Allowed, ", "))
+	}
+	var httpErr *server.HTTPError
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > 0 {
+		h.Set("Retry-After", server.RetryAfter(httpErr.RetryAfter))
+	}
+
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*h)
+	w.WriteBody(body)
 }
 
 func yourProblemHander(w *response.Writer, req *request.Request) {
@@ -90,17 +132,10 @@ func myProblemHandler(w *response.Writer, req *request.Request) {
 	w.WriteBody(body)
 }
 
-func videoHandler(w *response.Writer, req *request.Request) {
+func videoHandler(w *response.Writer, req *request.Request) error {
 	f, err := os.ReadFile("assets/vim.mp4")
 	if err != nil {
-		body := respond500()
-		h := response.GetDefaultHeaders(len(body))
-		h.Replace("Content-Type", "text/html")
-
-		w.WriteStatusLine(response.StatusInternalServerError)
-		w.WriteHeaders(*h)
-		w.WriteBody(body)
-		return
+		return server.NewHTTPError(response.StatusInternalServerError, "video unavailable", err)
 	}
 
 	h := response.GetDefaultHeaders(len(f))
@@ -110,63 +145,64 @@ func videoHandler(w *response.Writer, req *request.Request) {
 	w.WriteStatusLine(response.StatusOk)
 	w.WriteHeaders(*h)
 	w.WriteBody(f)
+	return nil
+}
 
+// proxyTo forwards the requests of a mount to fullUrl
+func proxyTo(fullUrl string) server.Handler {
+	p, err := proxy.New(fullUrl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.ErrorHandler = errorPage
+	return p.Handle
 }
 
-func proxyHandler(fullUrl string, domain string) server.Handler {
-	return func(w *response.Writer, req *request.Request) {
-		joined, _ := url.JoinPath(fullUrl, strings.TrimPrefix(req.TargetPath, domain))
-		res, err := http.Get(joined)
-		if err != nil {
-			body := respond500()
-			h := response.GetDefaultHeaders(len(body))
-			h.Replace("Content-Type", "text/html")
+var upgrader = &websocket.Upgrader{EnableCompression: true, MaxMessageSize: 1 << 20}
 
-			w.WriteStatusLine(response.StatusInternalServerError)
-			w.WriteHeaders(*h)
-			w.WriteBody(body)
+// echoHandler sends every WebSocket message back
+func echoHandler(w *response.Writer, req *request.Request) {
+	c, err := upgrader.Upgrade(w, req)
+	if err != nil {
+		log.Printf("websocket: %v", err)
+		return
+	}
+	defer c.Close()
+	for {
+		typ, data, err := c.ReadMessage()
+		if err != nil {
 			return
 		}
-		defer res.Body.Close()
-
-		h := response.GetDefaultHeaders(0)
-		h.Delete("Content-Length")
-		h.Set("Transfer-Encoding", "chunked")
-		h.Replace("Content-Type", res.Header.Get("Content-Type"))
-		h.Set("Trailers", "X-Content-SHA256, X-Content-Length")
-
-		w.WriteStatusLine(response.StatusOk)
-		w.WriteHeaders(*h)
-
-		fullBody := make([]byte, 0)
-		buf := make([]byte, 1024)
-		for {
-			n, err := res.Body.Read(buf)
-			if n > 0 {
-				fullBody = append(fullBody, buf[:n]...)
-				w.WriteBody(fmt.Appendf(nil, "%x\r\n", n))
-				w.WriteBody(buf[:n])
-				w.WriteBody([]byte("\r\n"))
-			}
-			// if err == io.EOF {
-			// 	break
-			// }
-			if err != nil {
-				break
-			}
+		if err := c.WriteMessage(typ, data); err != nil {
+			return
 		}
+	}
+}
 
-		// end of chunks
-		w.WriteBody([]byte("0\r\n"))
-
-		// trailers
-		trailers := headers.NewHeaders()
-		out := sha256.Sum256(fullBody)
-		trailers.Set("X-Content-SHA256", toStr(out[:]))
-		trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-		w.WriteHeaders(*trailers)
-		w.WriteBody([]byte("\r\n"))
+// eventsHandler streams a counter every second, picking up after the last
+// event a reconnecting client saw
+func eventsHandler(w *response.Writer, req *request.Request) {
+	stream, err := sse.NewStream(w, req)
+	if err != nil {
+		log.Printf("sse: %v", err)
+		return
+	}
+	defer stream.Close()
 
+	count, _ := strconv.Atoi(stream.LastEventID())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stream.Done():
+			return
+		case now := <-ticker.C:
+			count++
+			event := sse.Event{ID: strconv.Itoa(count), Event: "tick", Data: now.Format(time.RFC3339)}
+			if err := stream.Send(event); err != nil {
+				return
+			}
+		}
 	}
 }
 
@@ -181,8 +217,27 @@ func allHandler(w *response.Writer, req *request.Request) {
 }
 
 func main() {
+	printRoutes := flag.Bool("routes", false, "print the route table on startup")
+	debugRoutes := flag.Bool("debug-routes", false, "serve the route table as JSON on /debug/routes")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "expect a PROXY protocol header on every connection")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated CIDRs whose X-Forwarded-For and Forwarded headers are trusted")
+	backends := flag.String("backends", "", "comma separated upstream URLs balanced round-robin under /backends")
+	healthCheck := flag.String("health-check", "", "path probed on every backend, like /healthz")
+	tunnelTargets := flag.String("tunnel", "", "comma separated host:port patterns CONNECT may tunnel to, like \"*:443\"")
+	flag.Parse()
+
 	startTime := time.Now()
 	s := server.NewServer()
+	s.NotFoundHandler = errorPage
+	s.MethodNotAllowedHandler = errorPage
+	s.BadRequestHandler = errorPage
+	s.ErrorHandler = errorPage
+	s.ProxyProtocol = *proxyProtocol
+	if *trustedProxies != "" {
+		if err := s.SetTrustedProxies(strings.Split(*trustedProxies, ",")...); err != nil {
+			log.Fatal(err)
+		}
+	}
 	// -----------------
 	// Simple HTML routes
 	// -----------------
@@ -193,16 +248,55 @@ func main() {
 	// -----------------
 	// Serve a static video
 	// -----------------
-	s.Get("/video", videoHandler)
+	s.Get("/video", s.HandleErr(videoHandler))
+
+	// -----------------
+	// WebSocket echo
+	// -----------------
+	s.Get("/echo", echoHandler)
 
 	// -----------------
-	// Proxy to httpbin with chunked encoding
+	// Server-Sent Events
 	// -----------------
-	s.Get("/httpbin/*", proxyHandler("https://httpbin.org/", "/httpbin/"))
-	s.Get("/daily/*", proxyHandler("https://daily.dev/", "/daily/"))
-	s.Get("/wiki/*", proxyHandler("https://www.wikipedia.org/wiki/", "/wiki/"))
-	s.Get("/ddg/*", proxyHandler("https://duckduckgo.com/", "/ddg/"))
-	s.Get("/vivalchemy/*", proxyHandler("https://vivalchemy.github.io/", "/vivalchemy/"))
+	s.Get("/events", eventsHandler)
+
+	// -----------------
+	// Reverse proxies
+	// -----------------
+	s.Mount("/httpbin", proxyTo("https://httpbin.org/"), server.StreamBody())
+	s.Mount("/daily", proxyTo("https://daily.dev/"), server.StreamBody())
+	pages := cache.New(cache.NewMemoryStore(32 << 20))
+	s.Mount("/wiki", server.Handler(pages.Middleware(proxyTo("https://www.wikipedia.org/wiki/"))))
+	s.Mount("/ddg", proxyTo("https://duckduckgo.com/"), server.StreamBody())
+	s.Mount("/vivalchemy", proxyTo("https://vivalchemy.github.io/"), server.StreamBody())
+	if *backends != "" {
+		pool, err := proxy.NewPool(proxy.RoundRobin(), strings.Split(*backends, ",")...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *healthCheck != "" {
+			pool.StartHealthChecks(proxy.HealthCheck{Path: *healthCheck})
+		}
+		p := proxy.NewBalanced(pool)
+		p.ErrorHandler = errorPage
+		s.Mount("/backends", server.Handler(p.Handle), server.StreamBody())
+		s.Get("/debug/upstreams", pool.StatusHandler())
+	}
+
+	// -----------------
+	// Forward proxy for CONNECT
+	// -----------------
+	if *tunnelTargets != "" {
+		tun := &tunnel.Tunnel{Allow: tunnel.AllowList(strings.Split(*tunnelTargets, ",")...)}
+		s.Connect(tun.ServeConnect)
+	}
+
+	if *debugRoutes {
+		s.Get("/debug/routes", s.RoutesHandler())
+	}
+	if *printRoutes {
+		s.WriteRoutes(os.Stdout)
+	}
 
 	defer s.Close()
 	err := s.Serve(port)
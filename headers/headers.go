@@ -10,8 +10,25 @@ import (
 var rn = []byte("\r\n")
 var ErrorMalformedHeader = fmt.Errorf("malformed header")
 var ErrorMalformedFieldName = fmt.Errorf("malformed field name")
+var ErrorMalformedFieldValue = fmt.Errorf("malformed field value")
+var ErrorObsoleteLineFolding = fmt.Errorf("obsolete line folding is not allowed")
+
+// ObsFoldPolicy decides what Parse does with obs-fold continuation lines
+// (a field line starting with SP or HTAB, RFC 9112 section 5.2)
+type ObsFoldPolicy int
+
+const (
+	// ObsFoldReject fails the parse with ErrorObsoleteLineFolding
+	ObsFoldReject ObsFoldPolicy = iota
+	// ObsFoldReplace replaces the fold with a single SP and joins the
+	// continuation onto the previous field value
+	ObsFoldReplace
+)
 
 func isToken(s []byte) bool {
+	if len(s) == 0 {
+		return false
+	}
 	allowed := []byte("!#$%&'*+-.^_`|~")
 	for _, ch := range s {
 		if !(ch >= 'A' && ch <= 'Z' ||
@@ -24,6 +41,42 @@ func isToken(s []byte) bool {
 	return true
 }
 
+// isFieldValue reports whether s only holds field-vchar, SP and HTAB
+// (RFC 9110 section 5.5). CR, LF, NUL and the other controls are refused.
+func isFieldValue(s []byte) bool {
+	for _, ch := range s {
+		if ch == ' ' || ch == '\t' {
+			continue
+		}
+		if ch < 0x21 || ch == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidFieldName reports whether name is a valid field name (a token)
+func ValidFieldName(name string) bool {
+	return isToken([]byte(name))
+}
+
+// ValidFieldValue reports whether value can be sent as a field value
+// without allowing header injection or response splitting
+func ValidFieldValue(value string) bool {
+	return isFieldValue([]byte(value))
+}
+
+// HasToken reports whether the comma separated list of a field value, as
+// Connection or Upgrade hold, contains token, compared case-insensitively
+func HasToken(list string, token string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(item), token) {
+			return true
+		}
+	}
+	return false
+}
+
 func parseHeader(fieldLine []byte) (string, string, error) {
 	// since the field value can contain the colon
 	parts := bytes.SplitN(fieldLine, []byte(":"), 2)
@@ -32,16 +85,21 @@ func parseHeader(fieldLine []byte) (string, string, error) {
 	}
 
 	name := parts[0]
-	value := bytes.TrimSpace(parts[1])
+	value := bytes.Trim(parts[1], " \t")
 	if bytes.HasSuffix(name, []byte(" ")) {
 		return "", "", ErrorMalformedFieldName
 	}
+	if !isFieldValue(value) {
+		return "", "", fmt.Errorf("%w: %q", ErrorMalformedFieldValue, name)
+	}
 
 	return string(name), string(value), nil
 }
 
 type Headers struct {
 	headers map[string]string
+	obsFold ObsFoldPolicy
+	last    string // name of the last parsed field, target of obs-fold lines
 }
 
 func NewHeaders() *Headers {
@@ -50,6 +108,12 @@ func NewHeaders() *Headers {
 	}
 }
 
+// SetObsFoldPolicy sets how Parse handles obs-fold continuation lines.
+// The default is ObsFoldReject.
+func (h *Headers) SetObsFoldPolicy(p ObsFoldPolicy) {
+	h.obsFold = p
+}
+
 func (h *Headers) Replace(name string, value string) {
 	name = strings.ToLower(name)
 	h.headers[name] = value
@@ -90,7 +154,41 @@ func (h *Headers) GetIntMust(name string, defaultValue int) int {
 	return value
 }
 
-func (h Headers) Parse(data []byte) (int, bool, error) {
+// Validate checks every field name and value before they are written out,
+// so a handler echoing user input can't split the response
+func (h *Headers) Validate() error {
+	for name, value := range h.headers {
+		if !isToken([]byte(name)) {
+			return fmt.Errorf("%w: %q", ErrorMalformedFieldName, name)
+		}
+		if !isFieldValue([]byte(value)) {
+			return fmt.Errorf("%w: %q", ErrorMalformedFieldValue, name)
+		}
+	}
+	return nil
+}
+
+// unfold handles an obs-fold continuation line according to the policy
+func (h *Headers) unfold(line []byte) error {
+	if h.last == "" {
+		// whitespace before the first field line is never a fold
+		return ErrorMalformedHeader
+	}
+	if h.obsFold != ObsFoldReplace {
+		return ErrorObsoleteLineFolding
+	}
+
+	value := bytes.Trim(line, " \t")
+	if !isFieldValue(value) {
+		return fmt.Errorf("%w: %q", ErrorMalformedFieldValue, h.last)
+	}
+	if len(value) > 0 {
+		h.headers[h.last] = h.headers[h.last] + " " + string(value)
+	}
+	return nil
+}
+
+func (h *Headers) Parse(data []byte) (int, bool, error) {
 	read := 0
 	done := false
 
@@ -107,7 +205,16 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 			break
 		}
 
-		name, value, err := parseHeader(data[read : read+idx])
+		line := data[read : read+idx]
+		if line[0] == ' ' || line[0] == '\t' {
+			if err := h.unfold(line); err != nil {
+				return 0, false, err
+			}
+			read += idx + len(rn)
+			continue
+		}
+
+		name, value, err := parseHeader(line)
 		if err != nil {
 			return 0, false, err
 		}
@@ -116,6 +223,7 @@ func (h Headers) Parse(data []byte) (int, bool, error) {
 		}
 		read += idx + len(rn)
 		h.Set(name, value)
+		h.last = strings.ToLower(name)
 	}
 
 	return read, done, nil
@@ -52,3 +52,74 @@ func TestHeadersParse(t *testing.T) {
 	assert.False(t, done)
 
 }
+
+func TestHeadersFieldValue(t *testing.T) {
+	// Test: Control characters in the value
+	headers := NewHeaders()
+	data := []byte("X-Echo: a\x00b\r\n\r\n")
+	n, done, err := headers.Parse(data)
+	require.ErrorIs(t, err, ErrorMalformedFieldValue)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: Bare CR in the value
+	headers = NewHeaders()
+	data = []byte("X-Echo: a\rSet-Cookie: x=1\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrorMalformedFieldValue)
+
+	// Test: Empty field name
+	headers = NewHeaders()
+	data = []byte(": value\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.Error(t, err)
+
+	// Test: obs-text and HTAB are allowed
+	headers = NewHeaders()
+	data = []byte("X-Text: caf\xc3\xa9\tau lait\r\n\r\n")
+	_, done, err = headers.Parse(data)
+	require.NoError(t, err)
+	assert.True(t, done)
+	val, _ := headers.Get("X-Text")
+	assert.Equal(t, "caf\xc3\xa9\tau lait", val)
+
+	// Test: obs-fold is rejected by default
+	headers = NewHeaders()
+	data = []byte("X-Folded: first\r\n  second\r\n\r\n")
+	_, _, err = headers.Parse(data)
+	require.ErrorIs(t, err, ErrorObsoleteLineFolding)
+
+	// Test: obs-fold replaced with SP, split across reads
+	headers = NewHeaders()
+	headers.SetObsFoldPolicy(ObsFoldReplace)
+	n, done, err = headers.Parse([]byte("X-Folded: first\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 17, n)
+	assert.False(t, done)
+	_, done, err = headers.Parse([]byte("\t second\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, done)
+	val, _ = headers.Get("X-Folded")
+	assert.Equal(t, "first second", val)
+	val, _ = headers.Get("Host")
+	assert.Equal(t, "localhost", val)
+
+	// Test: Validate catches values set by handlers
+	headers = NewHeaders()
+	headers.Set("Location", "/next\r\nSet-Cookie: admin=1")
+	require.ErrorIs(t, headers.Validate(), ErrorMalformedFieldValue)
+	headers = NewHeaders()
+	headers.Set("Bad Name", "value")
+	require.ErrorIs(t, headers.Validate(), ErrorMalformedFieldName)
+}
+
+func TestHasToken(t *testing.T) {
+	// Test: Tokens of a list, case-insensitively and with spaces around
+	assert.True(t, HasToken("keep-alive, Upgrade", "upgrade"))
+	assert.True(t, HasToken("close", "close"))
+	assert.True(t, HasToken(" h2c ,websocket", "websocket"))
+
+	// Test: Parts of a token don't match
+	assert.False(t, HasToken("upgrade-insecure", "upgrade"))
+	assert.False(t, HasToken("", "close"))
+}
@@ -0,0 +1,191 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type FrameType uint8
+
+// Frame types of RFC 9113 section 6
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+// Frame flags, END_STREAM and ACK share their bit
+const (
+	FlagEndStream  uint8 = 0x1
+	FlagAck        uint8 = 0x1
+	FlagEndHeaders uint8 = 0x4
+	FlagPadded     uint8 = 0x8
+	FlagPriority   uint8 = 0x20
+)
+
+type ErrorCode uint32
+
+// Error codes of RFC 9113 section 7
+const (
+	ErrCodeNo                 ErrorCode = 0x0
+	ErrCodeProtocol           ErrorCode = 0x1
+	ErrCodeInternal           ErrorCode = 0x2
+	ErrCodeFlowControl        ErrorCode = 0x3
+	ErrCodeSettingsTimeout    ErrorCode = 0x4
+	ErrCodeStreamClosed       ErrorCode = 0x5
+	ErrCodeFrameSize          ErrorCode = 0x6
+	ErrCodeRefusedStream      ErrorCode = 0x7
+	ErrCodeCancel             ErrorCode = 0x8
+	ErrCodeCompression        ErrorCode = 0x9
+	ErrCodeConnect            ErrorCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrorCode = 0xb
+	ErrCodeInadequateSecurity ErrorCode = 0xc
+	ErrCodeHTTP11Required     ErrorCode = 0xd
+)
+
+// SettingID identifies a parameter of a SETTINGS frame
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+const (
+	frameHeaderLen = 9
+	// defaultMaxFrameSize is the frame size every peer accepts
+	defaultMaxFrameSize = 1 << 14
+	maxFrameSizeLimit   = 1<<24 - 1
+	// defaultWindowSize is the initial flow control window of connections
+	// and streams
+	defaultWindowSize = 1<<16 - 1
+	maxWindowSize     = 1<<31 - 1
+)
+
+// connectionError ends the connection with a GOAWAY carrying code
+type connectionError struct {
+	code   ErrorCode
+	reason string
+}
+
+func (e *connectionError) Error() string {
+	return fmt.Sprintf("http2 connection error %d: %s", e.code, e.reason)
+}
+
+// streamError resets one stream, the connection goes on
+type streamError struct {
+	stream uint32
+	code   ErrorCode
+	reason string
+}
+
+func (e *streamError) Error() string {
+	return fmt.Sprintf("http2 stream %d error %d: %s", e.stream, e.code, e.reason)
+}
+
+func streamErr(stream uint32, code ErrorCode, format string, args ...any) error {
+	return &streamError{stream: stream, code: code, reason: fmt.Sprintf(format, args...)}
+}
+
+func connError(code ErrorCode, format string, args ...any) error {
+	return &connectionError{code: code, reason: fmt.Sprintf(format, args...)}
+}
+
+type frame struct {
+	typ     FrameType
+	flags   uint8
+	stream  uint32
+	payload []byte
+}
+
+func (f frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// readFrame reads one frame, refusing payloads over maxSize
+func readFrame(r io.Reader, maxSize uint32) (frame, error) {
+	var head [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return frame{}, err
+	}
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	f := frame{
+		typ:    FrameType(head[3]),
+		flags:  head[4],
+		stream: binary.BigEndian.Uint32(head[5:]) & 0x7fffffff,
+	}
+	if length > maxSize {
+		return frame{}, connError(ErrCodeFrameSize, "frame of %d bytes, at most %d", length, maxSize)
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+	return f, nil
+}
+
+// appendFrame appends a frame with its 9 byte header to out
+func appendFrame(out []byte, typ FrameType, flags uint8, stream uint32, payload []byte) []byte {
+	length := len(payload)
+	out = append(out, byte(length>>16), byte(length>>8), byte(length), byte(typ), flags)
+	out = binary.BigEndian.AppendUint32(out, stream)
+	return append(out, payload...)
+}
+
+// unpad strips the padding of a DATA or HEADERS frame, section 6.1
+func unpad(f frame) ([]byte, error) {
+	if !f.has(FlagPadded) {
+		return f.payload, nil
+	}
+	if len(f.payload) == 0 || int(f.payload[0]) >= len(f.payload) {
+		return nil, connError(ErrCodeProtocol, "padding longer than the frame")
+	}
+	return f.payload[1 : len(f.payload)-int(f.payload[0])], nil
+}
+
+type setting struct {
+	id    SettingID
+	value uint32
+}
+
+// parseSettings reads the parameters of a SETTINGS payload, checking the
+// values section 6.5.2 bounds
+func parseSettings(payload []byte) ([]setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connError(ErrCodeFrameSize, "SETTINGS of %d bytes", len(payload))
+	}
+	settings := []setting{}
+	for i := 0; i < len(payload); i += 6 {
+		s := setting{SettingID(binary.BigEndian.Uint16(payload[i:])), binary.BigEndian.Uint32(payload[i+2:])}
+		switch {
+		case s.id == SettingEnablePush && s.value > 1:
+			return nil, connError(ErrCodeProtocol, "SETTINGS_ENABLE_PUSH of %d", s.value)
+		case s.id == SettingInitialWindowSize && s.value > maxWindowSize:
+			return nil, connError(ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE of %d", s.value)
+		case s.id == SettingMaxFrameSize && (s.value < defaultMaxFrameSize || s.value > maxFrameSizeLimit):
+			return nil, connError(ErrCodeProtocol, "SETTINGS_MAX_FRAME_SIZE of %d", s.value)
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+func appendSettings(out []byte, settings ...setting) []byte {
+	for _, s := range settings {
+		out = binary.BigEndian.AppendUint16(out, uint16(s.id))
+		out = binary.BigEndian.AppendUint32(out, s.value)
+	}
+	return out
+}
@@ -0,0 +1,281 @@
+package http2
+
+import (
+	"fmt"
+)
+
+var ErrorCompression = fmt.Errorf("hpack: invalid header block")
+
+type headerField struct {
+	name  string
+	value string
+}
+
+// size is the entry size of RFC 7541 section 4.1
+func (f headerField) size() int {
+	return len(f.name) + len(f.value) + 32
+}
+
+// decoder decodes header blocks (RFC 7541) with the dynamic table they
+// share over a connection
+type decoder struct {
+	dynamic []headerField // newest first
+	size    int
+	maxSize int // the current size, set by table size updates
+	limit   int // the SETTINGS_HEADER_TABLE_SIZE we announced, bounds maxSize
+}
+
+func newDecoder(limit int) *decoder {
+	return &decoder{maxSize: limit, limit: limit}
+}
+
+func (d *decoder) add(f headerField) {
+	d.dynamic = append([]headerField{f}, d.dynamic...)
+	d.size += f.size()
+	d.evict()
+}
+
+func (d *decoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.size -= last.size()
+	}
+}
+
+func (d *decoder) field(index uint64) (headerField, error) {
+	switch {
+	case index == 0:
+		return headerField{}, fmt.Errorf("%w: index 0", ErrorCompression)
+	case index <= uint64(len(staticTable)):
+		return staticTable[index-1], nil
+	case index-uint64(len(staticTable)) <= uint64(len(d.dynamic)):
+		return d.dynamic[index-uint64(len(staticTable))-1], nil
+	}
+	return headerField{}, fmt.Errorf("%w: index %d out of the table", ErrorCompression, index)
+}
+
+// decode returns the fields of a complete header block
+func (d *decoder) decode(block []byte) ([]headerField, error) {
+	fields := []headerField{}
+	sawField := false
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed field, section 6.1
+			index, rest, err := readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err := d.field(index)
+			if err != nil {
+				return nil, err
+			}
+			fields, block, sawField = append(fields, f), rest, true
+
+		case b&0xc0 == 0x40: // literal with incremental indexing, section 6.2.1
+			f, rest, err := d.literal(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.add(f)
+			fields, block, sawField = append(fields, f), rest, true
+
+		case b&0xe0 == 0x20: // dynamic table size update, section 6.3
+			if sawField {
+				return nil, fmt.Errorf("%w: table size update after a field", ErrorCompression)
+			}
+			size, rest, err := readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.limit) {
+				return nil, fmt.Errorf("%w: table size %d over %d", ErrorCompression, size, d.limit)
+			}
+			d.maxSize = int(size)
+			d.evict()
+			block = rest
+
+		default: // literal without indexing or never indexed, 6.2.2 and 6.2.3
+			f, rest, err := d.literal(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			fields, block, sawField = append(fields, f), rest, true
+		}
+	}
+	return fields, nil
+}
+
+// literal reads a literal field whose name index has prefix bits
+func (d *decoder) literal(block []byte, prefix int) (headerField, []byte, error) {
+	index, rest, err := readInt(block, prefix)
+	if err != nil {
+		return headerField{}, nil, err
+	}
+	var f headerField
+	if index == 0 {
+		if f.name, rest, err = readString(rest); err != nil {
+			return headerField{}, nil, err
+		}
+	} else {
+		named, err := d.field(index)
+		if err != nil {
+			return headerField{}, nil, err
+		}
+		f.name = named.name
+	}
+	if f.value, rest, err = readString(rest); err != nil {
+		return headerField{}, nil, err
+	}
+	return f, rest, nil
+}
+
+// readInt reads an integer with an n bit prefix, section 5.1
+func readInt(b []byte, n int) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", ErrorCompression)
+	}
+	mask := uint64(1)<<n - 1
+	value := uint64(b[0]) & mask
+	b = b[1:]
+	if value < mask {
+		return value, b, nil
+	}
+	for shift := 0; ; shift += 7 {
+		if len(b) == 0 || shift > 56 {
+			return 0, nil, fmt.Errorf("%w: truncated or oversized integer", ErrorCompression)
+		}
+		value += uint64(b[0]&0x7f) << shift
+		last := b[0]&0x80 == 0
+		b = b[1:]
+		if last {
+			return value, b, nil
+		}
+	}
+}
+
+// readString reads a string literal, section 5.2
+func readString(b []byte) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrorCompression)
+	}
+	huffman := b[0]&0x80 != 0
+	length, rest, err := readInt(b, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(rest)) {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrorCompression)
+	}
+	raw, rest := rest[:length], rest[length:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	s, err := huffmanDecode(raw)
+	return s, rest, err
+}
+
+// huffmanNode is a node of the decoding tree built from huffmanCodes
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      int // -1 for inner nodes
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{sym: -1}
+	for sym, code := range huffmanCodes {
+		node := root
+		for i := int(huffmanCodeLens[sym]) - 1; i >= 0; i-- {
+			bit := (code >> i) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &huffmanNode{sym: -1}
+			}
+			node = node.children[bit]
+		}
+		node.sym = sym
+	}
+	return root
+}
+
+// huffmanDecode decodes a Huffman coded string. The padding must be the
+// most significant bits of EOS, shorter than a byte, section 5.2.
+func huffmanDecode(b []byte) (string, error) {
+	out := []byte{}
+	node := huffmanRoot
+	depth, ones := 0, true
+	for _, c := range b {
+		for i := 7; i >= 0; i-- {
+			bit := (c >> i) & 1
+			node = node.children[bit]
+			if node == nil {
+				// only EOS lives down there
+				return "", fmt.Errorf("%w: EOS in a Huffman string", ErrorCompression)
+			}
+			depth++
+			ones = ones && bit == 1
+			if node.sym >= 0 {
+				out = append(out, byte(node.sym))
+				node, depth, ones = huffmanRoot, 0, true
+			}
+		}
+	}
+	if depth > 7 || !ones {
+		return "", fmt.Errorf("%w: invalid Huffman padding", ErrorCompression)
+	}
+	return string(out), nil
+}
+
+// encodeFields encodes a header block. It keeps no dynamic table: :status
+// and names of the static table are referenced, everything else is sent
+// as literals without indexing.
+func encodeFields(fields []headerField) []byte {
+	out := []byte{}
+	for _, f := range fields {
+		index := 0
+		for i, entry := range staticTable {
+			if entry.name != f.name {
+				continue
+			}
+			if entry.value == f.value {
+				// fully indexed, section 6.1
+				index = -(i + 1)
+				break
+			}
+			if index == 0 {
+				index = i + 1
+			}
+		}
+		if index < 0 {
+			out = appendInt(out, 7, 0x80, uint64(-index))
+			continue
+		}
+		out = appendInt(out, 4, 0x00, uint64(index))
+		if index == 0 {
+			out = appendString(out, f.name)
+		}
+		out = appendString(out, f.value)
+	}
+	return out
+}
+
+func appendInt(out []byte, n int, first byte, value uint64) []byte {
+	mask := uint64(1)<<n - 1
+	if value < mask {
+		return append(out, first|byte(value))
+	}
+	out = append(out, first|byte(mask))
+	value -= mask
+	for value >= 0x80 {
+		out = append(out, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(out, byte(value))
+}
+
+func appendString(out []byte, s string) []byte {
+	out = appendInt(out, 7, 0x00, uint64(len(s)))
+	return append(out, s...)
+}
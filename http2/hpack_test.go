@@ -0,0 +1,93 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestDecoder(t *testing.T) {
+	// Test: Requests of RFC 7541 appendix C.3 and, Huffman coded, C.4 share
+	// their dynamic table
+	for _, blocks := range [][]string{
+		{
+			"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			"8286 84be 5808 6e6f 2d63 6163 6865",
+			"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		},
+		{
+			"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+			"8286 84be 5886 a8eb 1064 9cbf",
+			"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+		},
+	} {
+		d := newDecoder(4096)
+		fields, err := d.decode(unhex(t, blocks[0]))
+		require.NoError(t, err)
+		assert.Equal(t, []headerField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}}, fields)
+		assert.Equal(t, 57, d.size)
+
+		fields, err = d.decode(unhex(t, blocks[1]))
+		require.NoError(t, err)
+		assert.Equal(t, headerField{"cache-control", "no-cache"}, fields[4])
+		assert.Equal(t, 110, d.size)
+
+		fields, err = d.decode(unhex(t, blocks[2]))
+		require.NoError(t, err)
+		assert.Equal(t, []headerField{{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"}, {"custom-key", "custom-value"}}, fields)
+		assert.Equal(t, []headerField{{"custom-key", "custom-value"}, {"cache-control", "no-cache"}, {":authority", "www.example.com"}}, d.dynamic)
+	}
+
+	// Test: Eviction with a 256 byte table, responses of appendix C.5
+	d := newDecoder(256)
+	_, err := d.decode(unhex(t, "4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+	require.NoError(t, err)
+	assert.Equal(t, 222, d.size)
+	fields, err := d.decode(unhex(t, "4803 3330 37c1 c0bf"))
+	require.NoError(t, err)
+	assert.Equal(t, headerField{":status", "307"}, fields[0])
+	assert.Equal(t, 222, d.size)
+	assert.Len(t, d.dynamic, 4)
+
+	// Test: Invalid blocks
+	for _, block := range []string{
+		"80",           // index 0
+		"be",           // past the tables
+		"0f",           // truncated integer
+		"4003 6162",    // truncated string
+		"8286 3fe1 1f", // table size update after a field
+		"3fe2 1f",      // table size over the limit
+		"4081 ff00",    // Huffman string with EOS
+		"4082 0fff 00", // Huffman padding not all ones
+	} {
+		_, err := newDecoder(4096).decode(unhex(t, block))
+		assert.ErrorIs(t, err, ErrorCompression, block)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	fields := []headerField{{":status", "200"}, {":status", "302"}, {"content-type", "text/plain"}, {"x-custom", "value"}}
+	block := encodeFields(fields)
+	// :status 200 is fully indexed, content-type names static entry 31
+	assert.Equal(t, byte(0x88), block[0])
+
+	decoded, err := newDecoder(4096).decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+
+	// Test: Values over a prefix length
+	long := headerField{"x-long", strings.Repeat("a", 300)}
+	decoded, err = newDecoder(4096).decode(encodeFields([]headerField{long}))
+	require.NoError(t, err)
+	assert.Equal(t, []headerField{long}, decoded)
+}
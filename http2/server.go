@@ -0,0 +1,668 @@
+// Package http2 speaks cleartext HTTP/2 (h2c, RFC 9113) on connections
+// handed over by the HTTP/1.1 server, either right from the connection
+// preface or after an "Upgrade: h2c" request. Every stream becomes a
+// request.Request answered through a response.Writer, so the same handlers
+// serve both protocols.
+package http2
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+// Preface is what a client sends first on an HTTP/2 connection, the
+// HTTP/1.1 parser sees its first line as request.ErrorHTTP2Preface
+const Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+var ErrorBadPreface = fmt.Errorf("invalid HTTP/2 connection preface")
+var ErrorBadUpgrade = fmt.Errorf("invalid h2c upgrade request")
+var ErrorStreamReset = fmt.Errorf("http2 stream reset")
+var ErrorConnClosed = fmt.Errorf("http2 connection closed")
+var ErrorHeadersNotWritten = fmt.Errorf("response headers not written")
+
+const (
+	DefaultMaxConcurrentStreams = 100
+	DefaultMaxHeaderListSize    = 1 << 16
+	// connWindowSize is the receive window of a connection, streams keep
+	// the default one
+	connWindowSize = 1 << 20
+	// headerTableSize is the HPACK table size the decoder allows
+	headerTableSize = 4096
+)
+
+// Handler answers the request of one stream, on a goroutine of its own
+type Handler func(w *response.Writer, req *request.Request)
+
+type Server struct {
+	Handler Handler
+	// MaxConcurrentStreams caps the streams a client keeps open at once,
+	// DefaultMaxConcurrentStreams when 0
+	MaxConcurrentStreams uint32
+	// MaxHeaderListSize limits the header fields of a request, counted as
+	// in SETTINGS_MAX_HEADER_LIST_SIZE, DefaultMaxHeaderListSize when 0
+	MaxHeaderListSize uint32
+	// MaxBodySize answers requests with a larger body with 413, no limit
+	// when 0
+	MaxBodySize int
+}
+
+// ServeConn speaks HTTP/2 on conn, starting with the client's connection
+// preface. reader holds whatever was read from conn already, nil reads conn
+// itself. It returns once the connection is done, after closing it. When
+// ctx is done a GOAWAY is sent and the streams in flight are cancelled.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn, reader io.Reader) error {
+	c := s.newConn(ctx, conn, reader)
+	return c.serve(nil)
+}
+
+// ServeUpgrade answers an "Upgrade: h2c" request with 101 Switching
+// Protocols and speaks HTTP/2 from there on. The request is served as
+// stream 1, with the settings of its HTTP2-Settings header in effect.
+func (s *Server) ServeUpgrade(ctx context.Context, conn net.Conn, reader io.Reader, req *request.Request) error {
+	payload, ok := upgradeSettings(req)
+	if !ok {
+		conn.Close()
+		return ErrorBadUpgrade
+	}
+	c := s.newConn(ctx, conn, reader)
+	settings, err := parseSettings(payload)
+	if err == nil {
+		err = c.applySettings(settings)
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("%w: %w", ErrorBadUpgrade, err)
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	req.HttpVersion = "2.0"
+	for _, name := range append(connectionFields, "http2-settings") {
+		req.Headers.Delete(name)
+	}
+	st := c.newStream(1, req)
+	st.remoteClosed = true
+	c.lastStream = 1
+	return c.serve(st)
+}
+
+// IsUpgrade reports whether the request asks to switch to h2c with valid
+// HTTP2-Settings, RFC 7540 section 3.2
+func IsUpgrade(req *request.Request) bool {
+	upgrade, _ := req.Headers.Get("upgrade")
+	if !req.Upgrade() || !headers.HasToken(upgrade, "h2c") {
+		return false
+	}
+	_, ok := upgradeSettings(req)
+	return ok
+}
+
+func upgradeSettings(req *request.Request) ([]byte, bool) {
+	connection, _ := req.Headers.Get("connection")
+	value, ok := req.Headers.Get("http2-settings")
+	if !ok || !headers.HasToken(connection, "http2-settings") || strings.Contains(value, ",") {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(value), "="))
+	if err != nil || len(payload)%6 != 0 {
+		return nil, false
+	}
+	return payload, true
+}
+
+// serverConn is the state of one connection. The frames are read and
+// handled by serve, the handlers write theirs from their own goroutines.
+type serverConn struct {
+	srv      *Server
+	conn     net.Conn
+	reader   io.Reader
+	ctx      context.Context // parent of the stream contexts
+	cancel   context.CancelFunc
+	decoder  *decoder
+	handlers sync.WaitGroup
+
+	maxStreams    uint32
+	maxHeaderList uint32
+	recvWindow    int64 // what the client may still send on the connection
+	lastStream    uint32
+	gotSettings   bool
+
+	// the header block being read, continued by CONTINUATION frames
+	headerStream    uint32
+	headerBlock     []byte
+	headerEndStream bool
+	headerPriority  bool // the HEADERS frame made the stream depend on itself
+
+	writeMu sync.Mutex // frames go out whole, a header block without interruption
+
+	mu                sync.Mutex
+	flow              *sync.Cond // signalled when send windows grow or streams close
+	streams           map[uint32]*stream
+	sendWindow        int64 // what the server may still send on the connection
+	initialSendWindow int64 // the client's SETTINGS_INITIAL_WINDOW_SIZE
+	peerMaxFrameSize  uint32
+	closed            bool
+}
+
+func (s *Server) newConn(ctx context.Context, conn net.Conn, reader io.Reader) *serverConn {
+	if reader == nil {
+		reader = conn
+	}
+	c := &serverConn{
+		srv:               s,
+		conn:              conn,
+		reader:            reader,
+		decoder:           newDecoder(headerTableSize),
+		maxStreams:        s.MaxConcurrentStreams,
+		maxHeaderList:     s.MaxHeaderListSize,
+		recvWindow:        defaultWindowSize,
+		streams:           map[uint32]*stream{},
+		sendWindow:        defaultWindowSize,
+		initialSendWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+	}
+	if c.maxStreams == 0 {
+		c.maxStreams = DefaultMaxConcurrentStreams
+	}
+	if c.maxHeaderList == 0 {
+		c.maxHeaderList = DefaultMaxHeaderListSize
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.flow = sync.NewCond(&c.mu)
+	return c
+}
+
+// serve runs the connection until it ends. upgraded is the stream of an
+// upgrade request, nil otherwise.
+func (c *serverConn) serve(upgraded *stream) error {
+	defer c.shutdown()
+	// a blocked read returns once the server shuts down
+	stop := context.AfterFunc(c.ctx, func() { c.conn.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	// the server's SETTINGS are the first frame it sends
+	settings := appendSettings(nil,
+		setting{SettingMaxConcurrentStreams, c.maxStreams},
+		setting{SettingMaxHeaderListSize, c.maxHeaderList},
+	)
+	out := appendFrame(nil, FrameSettings, 0, 0, settings)
+	increment := binary.BigEndian.AppendUint32(nil, connWindowSize-defaultWindowSize)
+	out = appendFrame(out, FrameWindowUpdate, 0, 0, increment)
+	if err := c.write(out); err != nil {
+		return err
+	}
+	c.recvWindow = connWindowSize
+	if upgraded != nil {
+		c.dispatch(upgraded)
+	}
+
+	preface := make([]byte, len(Preface))
+	if _, err := io.ReadFull(c.reader, preface); err != nil {
+		return err
+	}
+	if string(preface) != Preface {
+		return c.goAway(connError(ErrCodeProtocol, "%v", ErrorBadPreface))
+	}
+
+	for {
+		f, err := readFrame(c.reader, defaultMaxFrameSize)
+		if err == nil {
+			err = c.process(f)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var streamErr *streamError
+		if errors.As(err, &streamErr) {
+			if err := c.resetStream(streamErr.stream, streamErr.code); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			if c.ctx.Err() != nil {
+				// shutting down, no new streams
+				return c.goAway(connError(ErrCodeNo, "server shutting down"))
+			}
+			return c.goAway(err)
+		}
+	}
+}
+
+// goAway sends a GOAWAY for a connection error and returns err
+func (c *serverConn) goAway(err error) error {
+	var connErr *connectionError
+	if !errors.As(err, &connErr) {
+		return err
+	}
+	payload := binary.BigEndian.AppendUint32(nil, c.lastStream)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(connErr.code))
+	payload = append(payload, connErr.reason...)
+	c.write(appendFrame(nil, FrameGoAway, 0, 0, payload))
+	if connErr.code == ErrCodeNo {
+		return nil
+	}
+	return err
+}
+
+// shutdown closes the connection, cancelling the streams in flight, and
+// waits for their handlers
+func (c *serverConn) shutdown() {
+	c.cancel()
+	c.mu.Lock()
+	c.closed = true
+	c.flow.Broadcast()
+	c.mu.Unlock()
+	c.conn.Close()
+	c.handlers.Wait()
+}
+
+func (c *serverConn) write(out []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(out)
+	return err
+}
+
+// process handles one frame. A *streamError resets its stream, any other
+// error ends the connection.
+func (c *serverConn) process(f frame) error {
+	if !c.gotSettings && f.typ != FrameSettings {
+		return connError(ErrCodeProtocol, "preface without SETTINGS")
+	}
+	if c.headerStream != 0 && (f.typ != FrameContinuation || f.stream != c.headerStream) {
+		return connError(ErrCodeProtocol, "header block of stream %d interrupted", c.headerStream)
+	}
+
+	switch f.typ {
+	case FrameData:
+		return c.processData(f)
+	case FrameHeaders:
+		return c.processHeaders(f)
+	case FrameContinuation:
+		if c.headerStream == 0 {
+			return connError(ErrCodeProtocol, "CONTINUATION without HEADERS")
+		}
+		return c.continueHeaders(f.payload, f.has(FlagEndHeaders))
+	case FramePriority:
+		if f.stream == 0 {
+			return connError(ErrCodeProtocol, "PRIORITY on stream 0")
+		}
+		if len(f.payload) != 5 {
+			return streamErr(f.stream, ErrCodeFrameSize, "PRIORITY of %d bytes", len(f.payload))
+		}
+		if binary.BigEndian.Uint32(f.payload)&0x7fffffff == f.stream {
+			return streamErr(f.stream, ErrCodeProtocol, "stream depends on itself")
+		}
+		// priorities are advisory, every stream is served the same
+		return nil
+	case FrameRSTStream:
+		if f.stream == 0 {
+			return connError(ErrCodeProtocol, "RST_STREAM on stream 0")
+		}
+		if len(f.payload) != 4 {
+			return connError(ErrCodeFrameSize, "RST_STREAM of %d bytes", len(f.payload))
+		}
+		if f.stream > c.lastStream {
+			return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.stream)
+		}
+		if st := c.stream(f.stream); st != nil {
+			c.closeStream(st)
+		}
+		return nil
+	case FrameSettings:
+		return c.processSettings(f)
+	case FramePushPromise:
+		return connError(ErrCodeProtocol, "PUSH_PROMISE from a client")
+	case FramePing:
+		if f.stream != 0 {
+			return connError(ErrCodeProtocol, "PING on stream %d", f.stream)
+		}
+		if len(f.payload) != 8 {
+			return connError(ErrCodeFrameSize, "PING of %d bytes", len(f.payload))
+		}
+		if f.has(FlagAck) {
+			return nil
+		}
+		return c.write(appendFrame(nil, FramePing, FlagAck, 0, f.payload))
+	case FrameGoAway:
+		if f.stream != 0 {
+			return connError(ErrCodeProtocol, "GOAWAY on stream %d", f.stream)
+		}
+		if len(f.payload) < 8 {
+			return connError(ErrCodeFrameSize, "GOAWAY of %d bytes", len(f.payload))
+		}
+		// the client opens no more streams and closes the connection once
+		// the ones in flight are answered
+		return nil
+	case FrameWindowUpdate:
+		return c.processWindowUpdate(f)
+	}
+	// unknown frame types are ignored, section 5.5
+	return nil
+}
+
+func (c *serverConn) processSettings(f frame) error {
+	if f.stream != 0 {
+		return connError(ErrCodeProtocol, "SETTINGS on stream %d", f.stream)
+	}
+	if f.has(FlagAck) {
+		if len(f.payload) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS ACK with a payload")
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+	if err := c.applySettings(settings); err != nil {
+		return err
+	}
+	c.gotSettings = true
+	return c.write(appendFrame(nil, FrameSettings, FlagAck, 0, nil))
+}
+
+// applySettings takes the client's settings in. The server keeps no HPACK
+// table of its own and pushes nothing, only the window and frame sizes
+// matter.
+func (c *serverConn) applySettings(settings []setting) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case SettingInitialWindowSize:
+			// the change applies to the windows of open streams too,
+			// section 6.9.2
+			delta := int64(s.value) - c.initialSendWindow
+			for _, st := range c.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return connError(ErrCodeFlowControl, "window of stream %d over 2^31-1", st.id)
+				}
+			}
+			c.initialSendWindow = int64(s.value)
+		case SettingMaxFrameSize:
+			c.peerMaxFrameSize = s.value
+		}
+	}
+	c.flow.Broadcast()
+	return nil
+}
+
+func (c *serverConn) processWindowUpdate(f frame) error {
+	if len(f.payload) != 4 {
+		return connError(ErrCodeFrameSize, "WINDOW_UPDATE of %d bytes", len(f.payload))
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & 0x7fffffff)
+	if f.stream == 0 {
+		if increment == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.sendWindow += increment
+		if c.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window over 2^31-1")
+		}
+		c.flow.Broadcast()
+		return nil
+	}
+
+	if f.stream > c.lastStream {
+		return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.stream)
+	}
+	if increment == 0 {
+		return streamErr(f.stream, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.streams[f.stream]
+	if st == nil {
+		// the stream closed, updates still in flight are fine
+		return nil
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamErr(f.stream, ErrCodeFlowControl, "window over 2^31-1")
+	}
+	c.flow.Broadcast()
+	return nil
+}
+
+func (c *serverConn) processHeaders(f frame) error {
+	if f.stream == 0 || f.stream%2 == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on stream %d", f.stream)
+	}
+	payload, err := unpad(f)
+	if err != nil {
+		return err
+	}
+	c.headerPriority = false
+	if f.has(FlagPriority) {
+		if len(payload) < 5 {
+			return connError(ErrCodeFrameSize, "HEADERS too short for its priority")
+		}
+		c.headerPriority = binary.BigEndian.Uint32(payload)&0x7fffffff == f.stream
+		payload = payload[5:]
+	}
+	c.headerStream = f.stream
+	c.headerBlock = append([]byte{}, payload...)
+	c.headerEndStream = f.has(FlagEndStream)
+	return c.continueHeaders(nil, f.has(FlagEndHeaders))
+}
+
+// continueHeaders adds a fragment to the header block and handles the
+// block once it is complete
+func (c *serverConn) continueHeaders(fragment []byte, end bool) error {
+	c.headerBlock = append(c.headerBlock, fragment...)
+	if len(c.headerBlock) > int(c.maxHeaderList) {
+		// compressed fields never grow past the list they decode to
+		return connError(ErrCodeEnhanceYourCalm, "header block over %d bytes", c.maxHeaderList)
+	}
+	if !end {
+		return nil
+	}
+	id, block, endStream := c.headerStream, c.headerBlock, c.headerEndStream
+	c.headerStream, c.headerBlock = 0, nil
+
+	// the block is decoded even for streams that are refused, it changes
+	// the HPACK table shared by the connection
+	fields, err := c.decoder.decode(block)
+	if err != nil {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+	if c.headerPriority {
+		return streamErr(id, ErrCodeProtocol, "stream depends on itself")
+	}
+	size := 0
+	for _, f := range fields {
+		size += f.size()
+	}
+	if size > int(c.maxHeaderList) {
+		return streamErr(id, ErrCodeRefusedStream, "header list of %d bytes", size)
+	}
+
+	if st := c.stream(id); st != nil {
+		return c.trailers(st, fields, endStream)
+	}
+	if id <= c.lastStream {
+		return connError(ErrCodeStreamClosed, "HEADERS on closed stream %d", id)
+	}
+	c.lastStream = id
+
+	c.mu.Lock()
+	open := len(c.streams)
+	c.mu.Unlock()
+	if open >= int(c.maxStreams) {
+		return streamErr(id, ErrCodeRefusedStream, "over %d concurrent streams", c.maxStreams)
+	}
+	req, err := newRequest(fields)
+	if err != nil {
+		return streamErr(id, ErrCodeProtocol, "%v", err)
+	}
+	st := c.newStream(id, req)
+	if st.contentLength, err = contentLength(req); err != nil {
+		c.closeStream(st)
+		return streamErr(id, ErrCodeProtocol, "%v", err)
+	}
+	if endStream {
+		return c.endRequest(st)
+	}
+	return nil
+}
+
+// trailers handles a second header block, which ends the request
+func (c *serverConn) trailers(st *stream, fields []headerField, endStream bool) error {
+	if st.remoteClosed {
+		return streamErr(st.id, ErrCodeStreamClosed, "HEADERS after END_STREAM")
+	}
+	if !endStream {
+		return streamErr(st.id, ErrCodeProtocol, "trailers without END_STREAM")
+	}
+	for _, f := range fields {
+		if err := checkField(f); err != nil || strings.HasPrefix(f.name, ":") {
+			return streamErr(st.id, ErrCodeProtocol, "invalid trailer %q", f.name)
+		}
+		st.req.Headers.Set(f.name, f.value)
+	}
+	return c.endRequest(st)
+}
+
+func (c *serverConn) processData(f frame) error {
+	if f.stream == 0 {
+		return connError(ErrCodeProtocol, "DATA on stream 0")
+	}
+	// padding counts against the windows too
+	n := int64(len(f.payload))
+	if n > c.recvWindow {
+		return connError(ErrCodeFlowControl, "DATA past the connection window")
+	}
+	c.recvWindow -= n
+	data, err := unpad(f)
+	if err != nil {
+		return err
+	}
+	if err := c.windowUpdate(0, n); err != nil {
+		return err
+	}
+
+	st := c.stream(f.stream)
+	if st == nil || st.remoteClosed {
+		if f.stream > c.lastStream {
+			return connError(ErrCodeProtocol, "DATA on idle stream %d", f.stream)
+		}
+		return streamErr(f.stream, ErrCodeStreamClosed, "DATA on a closed stream")
+	}
+	if n > st.recvWindow {
+		return streamErr(st.id, ErrCodeFlowControl, "DATA past the stream window")
+	}
+	st.recvWindow -= n
+
+	st.body = append(st.body, data...)
+	if st.contentLength >= 0 && len(st.body) > st.contentLength {
+		return streamErr(st.id, ErrCodeProtocol, "body longer than its Content-Length")
+	}
+	if c.srv.MaxBodySize > 0 && len(st.body) > c.srv.MaxBodySize {
+		return c.refuseBody(st)
+	}
+
+	if f.has(FlagEndStream) {
+		return c.endRequest(st)
+	}
+	// the body is kept until the request is complete, so the client gets
+	// its window back right away
+	if err := c.windowUpdate(st.id, n); err != nil {
+		return err
+	}
+	st.recvWindow += n
+	return nil
+}
+
+func (c *serverConn) windowUpdate(stream uint32, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if stream == 0 {
+		c.recvWindow += n
+	}
+	increment := binary.BigEndian.AppendUint32(nil, uint32(n))
+	return c.write(appendFrame(nil, FrameWindowUpdate, 0, stream, increment))
+}
+
+// endRequest hands a complete request to the handler
+func (c *serverConn) endRequest(st *stream) error {
+	st.remoteClosed = true
+	if st.contentLength >= 0 && len(st.body) != st.contentLength {
+		return streamErr(st.id, ErrCodeProtocol, "body shorter than its Content-Length")
+	}
+	st.req.Body = st.body
+	c.dispatch(st)
+	return nil
+}
+
+func (c *serverConn) dispatch(st *stream) {
+	c.handlers.Add(1)
+	go func() {
+		defer c.handlers.Done()
+		w := response.NewBackendWriter(st)
+		c.srv.Handler(w, st.req)
+		st.finish(w.Closing())
+	}()
+}
+
+// refuseBody answers a request whose body is over MaxBodySize with 413
+// and resets the stream, so the client stops sending
+func (c *serverConn) refuseBody(st *stream) error {
+	h := response.GetDefaultHeaders(0)
+	if err := st.WriteHeader(response.StatusContentTooLarge, h); err != nil {
+		return err
+	}
+	if err := st.end(); err != nil {
+		return err
+	}
+	return streamErr(st.id, ErrCodeNo, "body over %d bytes", c.srv.MaxBodySize)
+}
+
+// resetStream sends RST_STREAM and forgets the stream
+func (c *serverConn) resetStream(id uint32, code ErrorCode) error {
+	if st := c.stream(id); st != nil {
+		c.closeStream(st)
+	}
+	payload := binary.BigEndian.AppendUint32(nil, uint32(code))
+	return c.write(appendFrame(nil, FrameRSTStream, 0, id, payload))
+}
+
+func (c *serverConn) stream(id uint32) *stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[id]
+}
+
+// closeStream cancels the stream's context and forgets it, its writes fail
+// from then on
+func (c *serverConn) closeStream(st *stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st.closed {
+		return
+	}
+	st.closed = true
+	delete(c.streams, st.id)
+	st.cancel()
+	c.flow.Broadcast()
+}
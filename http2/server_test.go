@@ -0,0 +1,348 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks raw frames to a Server
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *decoder
+}
+
+// dial serves one connection with srv and sends the preface with settings
+func dial(t *testing.T, srv *Server, settings ...setting) *testClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.ServeConn(ctx, conn, nil)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		cancel()
+		conn.Close()
+		listener.Close()
+		<-served
+	})
+
+	c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), decoder: newDecoder(4096)}
+	_, err = io.WriteString(conn, Preface)
+	require.NoError(t, err)
+	c.write(FrameSettings, 0, 0, appendSettings(nil, settings...))
+
+	// the server's SETTINGS, its connection window and the ACK of ours
+	f := c.read()
+	require.Equal(t, FrameSettings, f.typ)
+	require.False(t, f.has(FlagAck))
+	c.write(FrameSettings, FlagAck, 0, nil)
+	require.Equal(t, FrameWindowUpdate, c.read().typ)
+	f = c.read()
+	require.Equal(t, FrameSettings, f.typ)
+	require.True(t, f.has(FlagAck))
+	return c
+}
+
+func (c *testClient) write(typ FrameType, flags uint8, stream uint32, payload []byte) {
+	c.t.Helper()
+	_, err := c.conn.Write(appendFrame(nil, typ, flags, stream, payload))
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) read() frame {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := readFrame(c.reader, maxFrameSizeLimit)
+	require.NoError(c.t, err)
+	return f
+}
+
+// readSkipping reads the next frame that isn't a WINDOW_UPDATE
+func (c *testClient) readSkipping() frame {
+	c.t.Helper()
+	for {
+		if f := c.read(); f.typ != FrameWindowUpdate {
+			return f
+		}
+	}
+}
+
+func (c *testClient) request(stream uint32, flags uint8, method string, path string, extra ...headerField) {
+	c.t.Helper()
+	fields := append([]headerField{{":method", method}, {":scheme", "http"}, {":authority", "example.com"}, {":path", path}}, extra...)
+	c.write(FrameHeaders, flags|FlagEndHeaders, stream, encodeFields(fields))
+}
+
+// response reads a whole response, returning its status, fields and body
+func (c *testClient) response(stream uint32) (string, map[string]string, string) {
+	c.t.Helper()
+	f := c.readSkipping()
+	require.Equal(c.t, FrameHeaders, f.typ)
+	require.Equal(c.t, stream, f.stream)
+	fields, err := c.decoder.decode(f.payload)
+	require.NoError(c.t, err)
+	h := map[string]string{}
+	for _, field := range fields {
+		h[field.name] = field.value
+	}
+
+	body := ""
+	for !f.has(FlagEndStream) {
+		f = c.readSkipping()
+		require.Equal(c.t, stream, f.stream)
+		require.Equal(c.t, FrameData, f.typ)
+		body += string(f.payload)
+		if len(f.payload) > 0 {
+			// hand the windows back for the rest of the body
+			increment := binary.BigEndian.AppendUint32(nil, uint32(len(f.payload)))
+			c.write(FrameWindowUpdate, 0, 0, increment)
+			c.write(FrameWindowUpdate, 0, stream, increment)
+		}
+	}
+	return h[":status"], h, body
+}
+
+// expectError reads frames until a RST_STREAM or GOAWAY and returns its
+// type and error code
+func (c *testClient) expectError() (FrameType, ErrorCode) {
+	c.t.Helper()
+	for {
+		f := c.read()
+		switch f.typ {
+		case FrameRSTStream:
+			return f.typ, ErrorCode(binary.BigEndian.Uint32(f.payload))
+		case FrameGoAway:
+			return f.typ, ErrorCode(binary.BigEndian.Uint32(f.payload[4:]))
+		}
+	}
+}
+
+func echo(w *response.Writer, req *request.Request) {
+	h := response.GetDefaultHeaders(len(req.Body))
+	h.Set("X-Method", req.Method)
+	h.Set("X-Path", req.TargetPath)
+	h.Set("X-Host", req.Host)
+	h.Set("X-Version", req.HttpVersion)
+	h.Set("Connection", "close")
+	w.WriteStatusLine(response.StatusOk)
+	w.WriteHeaders(*h)
+	w.WriteBody(req.Body)
+}
+
+func TestServeConn(t *testing.T) {
+	c := dial(t, &Server{Handler: echo})
+
+	// Test: The pseudo-headers make the request line
+	c.request(1, FlagEndStream, "GET", "/hello?x=1")
+	status, h, body := c.response(1)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "GET", h["x-method"])
+	assert.Equal(t, "/hello?x=1", h["x-path"])
+	assert.Equal(t, "example.com", h["x-host"])
+	assert.Equal(t, "2.0", h["x-version"])
+	assert.NotContains(t, h, "connection")
+	assert.Empty(t, body)
+
+	// Test: A body over several DATA frames, padded and with trailers
+	c.request(3, 0, "POST", "/echo")
+	c.write(FrameData, 0, 3, []byte("hello "))
+	c.write(FrameData, FlagPadded, 3, append([]byte{3}, "world\x00\x00\x00"...))
+	c.write(FrameHeaders, FlagEndHeaders|FlagEndStream, 3, encodeFields([]headerField{{"x-trailer", "yes"}}))
+	status, _, body = c.response(3)
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "hello world", body)
+
+	// Test: Header blocks continued by CONTINUATION frames
+	block := encodeFields([]headerField{{":method", "GET"}, {":scheme", "http"}, {":authority", "example.com"}, {":path", "/continued"}})
+	c.write(FrameHeaders, FlagEndStream, 5, block[:3])
+	c.write(FrameContinuation, 0, 5, block[3:6])
+	c.write(FrameContinuation, FlagEndHeaders, 5, block[6:])
+	_, h, _ = c.response(5)
+	assert.Equal(t, "/continued", h["x-path"])
+
+	// Test: PING is answered
+	c.write(FramePing, 0, 0, []byte("12345678"))
+	f := c.read()
+	assert.Equal(t, FramePing, f.typ)
+	assert.True(t, f.has(FlagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+
+	// Test: A large body comes in as the server hands the windows back
+	c.request(7, 0, "POST", "/large")
+	large := strings.Repeat("x", 3*defaultWindowSize)
+	for i := 0; i < len(large); i += defaultMaxFrameSize {
+		c.write(FrameData, 0, 7, []byte(large[i:min(i+defaultMaxFrameSize, len(large))]))
+	}
+	c.write(FrameData, FlagEndStream, 7, nil)
+	_, _, body = c.response(7)
+	assert.Equal(t, len(large), len(body))
+}
+
+func TestFlowControl(t *testing.T) {
+	c := dial(t, &Server{Handler: func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*response.GetDefaultHeaders(25))
+		w.WriteBody([]byte(strings.Repeat("a", 25)))
+	}}, setting{SettingInitialWindowSize, 10})
+
+	// Test: The stream window holds the body back until it grows
+	c.request(1, FlagEndStream, "GET", "/")
+	assert.Equal(t, FrameHeaders, c.read().typ)
+	f := c.read()
+	assert.Equal(t, FrameData, f.typ)
+	assert.Len(t, f.payload, 10)
+
+	c.write(FrameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 10))
+	f = c.read()
+	assert.Len(t, f.payload, 10)
+
+	// Test: Raising the initial window size grows open streams' windows
+	c.write(FrameSettings, 0, 0, appendSettings(nil, setting{SettingInitialWindowSize, 30}))
+	f = c.read()
+	for f.typ == FrameSettings {
+		f = c.read()
+	}
+	assert.Equal(t, FrameData, f.typ)
+	assert.Len(t, f.payload, 5)
+
+	// Test: Windows past 2^31-1 are a flow control error
+	c.write(FrameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+	typ, code := c.expectError()
+	assert.Equal(t, FrameGoAway, typ)
+	assert.Equal(t, ErrCodeFlowControl, code)
+}
+
+func TestStreamErrors(t *testing.T) {
+	reset := make(chan struct{})
+	srv := &Server{MaxConcurrentStreams: 1, MaxBodySize: 4, Handler: func(w *response.Writer, req *request.Request) {
+		if req.TargetPath == "/wait" {
+			<-req.Context().Done()
+			close(reset)
+			return
+		}
+		echo(w, req)
+	}}
+	c := dial(t, srv)
+
+	// Test: Streams over MaxConcurrentStreams are refused
+	c.request(1, FlagEndStream, "GET", "/wait")
+	c.request(3, FlagEndStream, "GET", "/")
+	typ, code := c.expectError()
+	assert.Equal(t, FrameRSTStream, typ)
+	assert.Equal(t, ErrCodeRefusedStream, code)
+
+	// Test: RST_STREAM cancels the request context
+	c.write(FrameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	select {
+	case <-reset:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler not cancelled")
+	}
+
+	// Test: Malformed requests reset their stream only
+	for i, fields := range [][]headerField{
+		{{"X-Upper", "1"}},
+		{{"connection", "keep-alive"}},
+		{{"te", "gzip"}},
+		{{":status", "200"}},
+	} {
+		stream := uint32(5 + 2*i)
+		c.request(stream, FlagEndStream, "GET", "/", fields...)
+		typ, code := c.expectError()
+		assert.Equal(t, FrameRSTStream, typ, fields)
+		assert.Equal(t, ErrCodeProtocol, code, fields)
+	}
+
+	// Test: A Content-Length the body doesn't match
+	c.request(13, 0, "POST", "/", headerField{"content-length", "3"})
+	c.write(FrameData, FlagEndStream, 13, []byte("ab"))
+	typ, code = c.expectError()
+	assert.Equal(t, FrameRSTStream, typ)
+	assert.Equal(t, ErrCodeProtocol, code)
+
+	// Test: Bodies over MaxBodySize get 413
+	c.request(15, 0, "POST", "/")
+	c.write(FrameData, 0, 15, []byte("too long"))
+	status, _, _ := c.response(15)
+	assert.Equal(t, "413", status)
+	typ, code = c.expectError()
+	assert.Equal(t, FrameRSTStream, typ)
+	assert.Equal(t, ErrCodeNo, code)
+
+	// Test: The connection goes on
+	c.request(17, FlagEndStream, "GET", "/still-there")
+	status, _, _ = c.response(17)
+	assert.Equal(t, "200", status)
+}
+
+func TestConnErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		send func(c *testClient)
+		code ErrorCode
+	}{
+		{"DATA on an idle stream", func(c *testClient) { c.write(FrameData, 0, 1, []byte("hi")) }, ErrCodeProtocol},
+		{"even stream", func(c *testClient) { c.request(2, FlagEndStream, "GET", "/") }, ErrCodeProtocol},
+		{"interrupted header block", func(c *testClient) {
+			c.write(FrameHeaders, 0, 1, []byte{0x82})
+			c.write(FramePing, 0, 0, make([]byte, 8))
+		}, ErrCodeProtocol},
+		{"stream going backwards", func(c *testClient) {
+			c.request(5, FlagEndStream, "GET", "/")
+			c.request(3, FlagEndStream, "GET", "/")
+		}, ErrCodeStreamClosed},
+		{"invalid header block", func(c *testClient) { c.write(FrameHeaders, FlagEndHeaders, 1, []byte{0x80}) }, ErrCodeCompression},
+		{"oversized frame", func(c *testClient) { c.write(FrameData, 0, 1, make([]byte, defaultMaxFrameSize+1)) }, ErrCodeFrameSize},
+		{"PUSH_PROMISE", func(c *testClient) { c.write(FramePushPromise, FlagEndHeaders, 1, make([]byte, 4)) }, ErrCodeProtocol},
+		{"invalid SETTINGS", func(c *testClient) { c.write(FrameSettings, 0, 0, make([]byte, 5)) }, ErrCodeFrameSize},
+		{"invalid max frame size", func(c *testClient) {
+			c.write(FrameSettings, 0, 0, appendSettings(nil, setting{SettingMaxFrameSize, 100}))
+		}, ErrCodeProtocol},
+	}
+	for _, tc := range cases {
+		c := dial(t, &Server{Handler: echo})
+		tc.send(c)
+		typ, code := c.expectError()
+		assert.Equal(t, FrameGoAway, typ, tc.name)
+		assert.Equal(t, tc.code, code, tc.name)
+	}
+
+	// Test: A bad preface closes the connection with a GOAWAY
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			(&Server{Handler: echo}).ServeConn(context.Background(), conn, nil)
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	out, _ := io.ReadAll(conn)
+	assert.Contains(t, string(out), string(ErrorBadPreface.Error()))
+}
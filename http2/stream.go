@@ -0,0 +1,290 @@
+package http2
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+var ErrorMalformedRequest = fmt.Errorf("malformed HTTP/2 request")
+
+// connectionFields are specific to HTTP/1.1 connections and make an HTTP/2
+// request malformed, section 8.2.2
+var connectionFields = []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"}
+
+// stream is one request and its response. The reading side belongs to the
+// serve loop, the writing side to the handler, closed and sendWindow are
+// guarded by the connection's mu.
+type stream struct {
+	c      *serverConn
+	id     uint32
+	ctx    context.Context
+	cancel context.CancelFunc
+	req    *request.Request
+
+	body          []byte
+	contentLength int // -1 without a Content-Length
+	recvWindow    int64
+	remoteClosed  bool // END_STREAM received
+
+	headersSent bool
+	ended       bool // END_STREAM sent
+	sendWindow  int64
+	closed      bool
+}
+
+func (c *serverConn) newStream(id uint32, req *request.Request) *stream {
+	st := &stream{c: c, id: id, req: req, contentLength: -1, recvWindow: defaultWindowSize}
+	st.ctx, st.cancel = context.WithCancel(c.ctx)
+	req.SetContext(st.ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st.sendWindow = c.initialSendWindow
+	c.streams[id] = st
+	return st
+}
+
+// WriteHeader sends the response headers, response.Backend
+func (st *stream) WriteHeader(status response.StatusCode, h *headers.Headers) error {
+	fields := []headerField{{":status", strconv.Itoa(int(status))}}
+	for name, value := range h.GetAll() {
+		fields = append(fields, headerField{name, value})
+	}
+	if err := st.writeHeaders(encodeFields(fields), false); err != nil {
+		return err
+	}
+	if status >= 200 {
+		st.headersSent = true
+	}
+	return nil
+}
+
+// Write sends DATA frames as the flow control windows allow, response.Backend
+func (st *stream) Write(p []byte) (int, error) {
+	if !st.headersSent {
+		return 0, ErrorHeadersNotWritten
+	}
+	c := st.c
+	written := 0
+	for written < len(p) {
+		c.mu.Lock()
+		for !c.closed && !st.closed && (st.sendWindow <= 0 || c.sendWindow <= 0) {
+			c.flow.Wait()
+		}
+		if err := st.writeErr(); err != nil {
+			c.mu.Unlock()
+			return written, err
+		}
+		n := int64(len(p) - written)
+		n = min(n, st.sendWindow, c.sendWindow, int64(c.peerMaxFrameSize))
+		st.sendWindow -= n
+		c.sendWindow -= n
+		c.mu.Unlock()
+
+		chunk := p[written : written+int(n)]
+		if err := c.write(appendFrame(nil, FrameData, 0, st.id, chunk)); err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+// WriteTrailers ends the response with the trailers, response.Backend
+func (st *stream) WriteTrailers(h *headers.Headers) error {
+	if !st.headersSent {
+		return ErrorHeadersNotWritten
+	}
+	if len(h.GetAll()) == 0 {
+		return st.end()
+	}
+	fields := []headerField{}
+	for name, value := range h.GetAll() {
+		fields = append(fields, headerField{name, value})
+	}
+	if err := st.writeHeaders(encodeFields(fields), true); err != nil {
+		return err
+	}
+	st.ended = true
+	return nil
+}
+
+// writeErr is why the stream can't be written to, nil when it can. The
+// caller holds the connection's mu.
+func (st *stream) writeErr() error {
+	switch {
+	case st.c.closed:
+		return ErrorConnClosed
+	case st.closed:
+		return ErrorStreamReset
+	case st.ended:
+		return fmt.Errorf("%w: response ended", ErrorStreamReset)
+	}
+	return nil
+}
+
+// writeHeaders sends a header block as a HEADERS frame followed by as many
+// CONTINUATION frames as the client's frame size calls for
+func (st *stream) writeHeaders(block []byte, endStream bool) error {
+	c := st.c
+	c.mu.Lock()
+	err := st.writeErr()
+	maxSize := int(c.peerMaxFrameSize)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	typ, flags := FrameHeaders, uint8(0)
+	if endStream {
+		flags = FlagEndStream
+	}
+	out := []byte{}
+	for {
+		fragment := block[:min(len(block), maxSize)]
+		block = block[len(fragment):]
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+		out = appendFrame(out, typ, flags, st.id, fragment)
+		if len(block) == 0 {
+			return c.write(out)
+		}
+		typ, flags = FrameContinuation, 0
+	}
+}
+
+// end sends an empty DATA frame with END_STREAM
+func (st *stream) end() error {
+	c := st.c
+	c.mu.Lock()
+	err := st.writeErr()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := c.write(appendFrame(nil, FrameData, FlagEndStream, st.id, nil)); err != nil {
+		return err
+	}
+	st.ended = true
+	return nil
+}
+
+// finish ends the response once the handler returned. A response never
+// started or cut short resets the stream, the way HTTP/1.1 closes the
+// connection for it.
+func (st *stream) finish(cutShort bool) {
+	c := st.c
+	if cutShort && !st.ended {
+		c.mu.Lock()
+		closed := st.closed || c.closed
+		c.mu.Unlock()
+		if !closed {
+			payload := binary.BigEndian.AppendUint32(nil, uint32(ErrCodeInternal))
+			c.write(appendFrame(nil, FrameRSTStream, 0, st.id, payload))
+		}
+	} else if !st.ended {
+		st.end()
+	}
+	c.closeStream(st)
+}
+
+// newRequest builds the request from the fields of its HEADERS, checking
+// them as section 8.3.1 asks
+func newRequest(fields []headerField) (*request.Request, error) {
+	pseudo := map[string]string{}
+	h := headers.NewHeaders()
+	regular := false
+	for _, f := range fields {
+		if strings.HasPrefix(f.name, ":") {
+			switch f.name {
+			case ":method", ":scheme", ":authority", ":path":
+			default:
+				return nil, fmt.Errorf("%w: pseudo-header %q", ErrorMalformedRequest, f.name)
+			}
+			if _, ok := pseudo[f.name]; ok || regular {
+				return nil, fmt.Errorf("%w: repeated or late %s", ErrorMalformedRequest, f.name)
+			}
+			pseudo[f.name] = f.value
+			continue
+		}
+		regular = true
+		if err := checkField(f); err != nil {
+			return nil, err
+		}
+		if cookie, ok := h.Get("cookie"); ok && f.name == "cookie" {
+			// cookies may come split in several fields, section 8.2.3
+			h.Replace("cookie", cookie+"; "+f.value)
+			continue
+		}
+		h.Set(f.name, f.value)
+	}
+
+	method, authority := pseudo[":method"], pseudo[":authority"]
+	target := pseudo[":path"]
+	if method == "CONNECT" {
+		_, scheme := pseudo[":scheme"]
+		_, path := pseudo[":path"]
+		if scheme || path || authority == "" {
+			return nil, fmt.Errorf("%w: CONNECT takes :authority only", ErrorMalformedRequest)
+		}
+		target = authority
+	} else if method == "" || pseudo[":scheme"] == "" || target == "" {
+		return nil, fmt.Errorf("%w: missing pseudo-header", ErrorMalformedRequest)
+	}
+
+	rl, err := request.NewRequestLine(method, target, "2.0")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorMalformedRequest, err)
+	}
+	req := request.NewRequest()
+	req.RequestLine = *rl
+	req.Headers = h
+	req.Host = authority
+	if host, ok := h.Get("host"); ok && authority == "" {
+		req.Host = host
+	}
+	if !request.ValidHost(req.Host) {
+		return nil, fmt.Errorf("%w: %w", ErrorMalformedRequest, request.ErrorInvalidHost)
+	}
+	return req, nil
+}
+
+// checkField refuses field names with uppercase letters and the fields
+// HTTP/2 has no room for
+func checkField(f headerField) error {
+	if f.name != strings.ToLower(f.name) {
+		return fmt.Errorf("%w: uppercase field name %q", ErrorMalformedRequest, f.name)
+	}
+	if !strings.HasPrefix(f.name, ":") && !headers.ValidFieldName(f.name) || !headers.ValidFieldValue(f.value) {
+		return fmt.Errorf("%w: invalid field %q", ErrorMalformedRequest, f.name)
+	}
+	for _, name := range connectionFields {
+		if f.name == name {
+			return fmt.Errorf("%w: connection-specific field %q", ErrorMalformedRequest, f.name)
+		}
+	}
+	if f.name == "te" && f.value != "trailers" {
+		return fmt.Errorf("%w: TE other than trailers", ErrorMalformedRequest)
+	}
+	return nil
+}
+
+// contentLength returns the request's Content-Length, -1 without one
+func contentLength(req *request.Request) (int, error) {
+	value, ok := req.Headers.Get("content-length")
+	if !ok {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: Content-Length %q", ErrorMalformedRequest, value)
+	}
+	return n, nil
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"vivalchemy/http-server-from-scratch/request"
+)
+
+// Balancer picks the upstream of a request among the available ones of a
+// pool, upstreams is never empty
+type Balancer interface {
+	Pick(req *request.Request, upstreams []*Upstream) *Upstream
+}
+
+// BalancerFunc adapts a function to a Balancer
+type BalancerFunc func(req *request.Request, upstreams []*Upstream) *Upstream
+
+func (f BalancerFunc) Pick(req *request.Request, upstreams []*Upstream) *Upstream {
+	return f(req, upstreams)
+}
+
+// RoundRobin hands the requests to the upstreams in turn
+func RoundRobin() Balancer {
+	next := atomic.Uint64{}
+	return BalancerFunc(func(req *request.Request, upstreams []*Upstream) *Upstream {
+		return upstreams[(next.Add(1)-1)%uint64(len(upstreams))]
+	})
+}
+
+// LeastConnections picks the upstream with the fewest requests in flight,
+// taking turns between the ones that tie
+func LeastConnections() Balancer {
+	next := atomic.Uint64{}
+	return BalancerFunc(func(req *request.Request, upstreams []*Upstream) *Upstream {
+		start := int((next.Add(1) - 1) % uint64(len(upstreams)))
+		var best *Upstream
+		for i := range upstreams {
+			u := upstreams[(start+i)%len(upstreams)]
+			if best == nil || u.Active() < best.Active() {
+				best = u
+			}
+		}
+		return best
+	})
+}
+
+// Weighted hands each upstream a share of the requests proportional to
+// its Weight, spread evenly like nginx's smooth weighted round-robin
+func Weighted() Balancer {
+	mu := sync.Mutex{}
+	current := map[*Upstream]int{}
+	return BalancerFunc(func(req *request.Request, upstreams []*Upstream) *Upstream {
+		mu.Lock()
+		defer mu.Unlock()
+		total := 0
+		var best *Upstream
+		for _, u := range upstreams {
+			current[u] += u.Weight
+			total += u.Weight
+			if best == nil || current[u] > current[best] {
+				best = u
+			}
+		}
+		current[best] -= total
+		return best
+	})
+}
+
+// HashHeader sends the requests with the same value of the header to the
+// same upstream, see consistentHash
+func HashHeader(name string) Balancer {
+	return consistentHash(func(req *request.Request) (string, bool) {
+		return req.Headers.Get(name)
+	})
+}
+
+// HashCookie sends the requests with the same value of the cookie to the
+// same upstream, see consistentHash
+func HashCookie(name string) Balancer {
+	return consistentHash(func(req *request.Request) (string, bool) {
+		cookies, _ := req.Headers.Get("cookie")
+		for _, cookie := range strings.Split(cookies, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(cookie), "=")
+			if ok && key == name {
+				return value, true
+			}
+		}
+		return "", false
+	})
+}
+
+// replicas are the points of an upstream of weight 1 on the hash ring
+const replicas = 100
+
+// consistentHash places the upstreams on a ring of hashes and sends a
+// request to the first upstream after the hash of its key. An upstream
+// going down only moves its own keys to the others. Requests without a key
+// are balanced round-robin.
+func consistentHash(key func(req *request.Request) (string, bool)) Balancer {
+	fallback := RoundRobin()
+	mu := sync.Mutex{}
+	var ring *hashRing
+	return BalancerFunc(func(req *request.Request, upstreams []*Upstream) *Upstream {
+		value, ok := key(req)
+		if !ok {
+			return fallback.Pick(req, upstreams)
+		}
+		mu.Lock()
+		if ring == nil || !slices.Equal(ring.upstreams, upstreams) {
+			ring = newHashRing(upstreams)
+		}
+		r := ring
+		mu.Unlock()
+		return r.get(hash(value))
+	})
+}
+
+type hashRing struct {
+	upstreams []*Upstream // the ring was built for
+	points    []uint32
+	owners    map[uint32]*Upstream
+}
+
+func newHashRing(upstreams []*Upstream) *hashRing {
+	ring := &hashRing{upstreams: slices.Clone(upstreams), owners: map[uint32]*Upstream{}}
+	for _, u := range upstreams {
+		for i := range replicas * u.Weight {
+			point := hash(u.URL.String() + "#" + strconv.Itoa(i))
+			if _, taken := ring.owners[point]; taken {
+				continue
+			}
+			ring.owners[point] = u
+			ring.points = append(ring.points, point)
+		}
+	}
+	slices.Sort(ring.points)
+	return ring
+}
+
+func (r *hashRing) get(h uint32) *Upstream {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// hash is FNV-1a followed by the finalizer of murmur3, which spreads the
+// hashes of near identical strings like the replicas of an upstream
+func hash(s string) uint32 {
+	f := fnv.New32a()
+	f.Write([]byte(s))
+	h := f.Sum32()
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"vivalchemy/http-server-from-scratch/client"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+	"vivalchemy/http-server-from-scratch/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// backend serves its name on every path and returns its URL
+func backend(t *testing.T, name string) string {
+	t.Helper()
+	s := server.NewServer()
+	s.Mount("/", server.Handler(func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(name))
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(name))
+	}))
+	require.NoError(t, s.Serve(0))
+	t.Cleanup(func() { s.Close() })
+	return "http://" + local(s)
+}
+
+// deadBackend returns the URL of a port nothing listens on
+func deadBackend(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener.Close()
+	return "http://" + listener.Addr().String()
+}
+
+// balanced serves a proxy over pool and returns its URL
+func balanced(t *testing.T, pool *Pool) string {
+	t.Helper()
+	s := server.NewServer()
+	s.Mount("/", server.Handler(NewBalanced(pool).Handle))
+	require.NoError(t, s.Serve(0))
+	t.Cleanup(func() { s.Close() })
+	return "http://" + local(s)
+}
+
+// get returns the status and body of a GET through the proxy
+func get(t *testing.T, c *client.Client, url string) (response.StatusCode, string) {
+	t.Helper()
+	res, err := c.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res.StatusCode, string(body)
+}
+
+// picks returns the names of the upstreams picked for n requests
+func picks(balancer Balancer, req *request.Request, upstreams []*Upstream, n int) []string {
+	names := []string{}
+	for range n {
+		names = append(names, balancer.Pick(req, upstreams).URL.Host)
+	}
+	return names
+}
+
+func testPool(t *testing.T, weights ...int) *Pool {
+	t.Helper()
+	pool, err := NewPool(nil)
+	require.NoError(t, err)
+	for i, weight := range weights {
+		require.NoError(t, pool.Add(fmt.Sprintf("http://%c", 'a'+i), weight))
+	}
+	return pool
+}
+
+func TestBalancers(t *testing.T) {
+	req := request.NewRequest()
+	pool := testPool(t, 1, 1, 1)
+	upstreams := pool.Upstreams
+
+	// Test: Round-robin takes turns
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, picks(RoundRobin(), req, upstreams, 6))
+
+	// Test: Least connections picks the idlest, ties take turns
+	upstreams[0].active.Add(2)
+	upstreams[1].active.Add(1)
+	upstreams[2].active.Add(1)
+	picked := picks(LeastConnections(), req, upstreams, 3)
+	assert.NotContains(t, picked, "a")
+	assert.Subset(t, picked, []string{"b", "c"})
+
+	// Test: Weighted spreads the requests by weight, evenly
+	weighted := testPool(t, 3, 1).Upstreams
+	assert.Equal(t, []string{"a", "a", "b", "a", "a", "a", "b", "a"}, picks(Weighted(), req, weighted, 8))
+
+	// Test: Hashing sticks a key to an upstream, an upstream leaving only
+	// moves its own keys
+	balancer := HashHeader("X-User")
+	owners := map[string]string{}
+	for i := range 50 {
+		req := request.NewRequest()
+		req.Headers.Set("X-User", fmt.Sprint(i))
+		owners[fmt.Sprint(i)] = balancer.Pick(req, upstreams).URL.Host
+		assert.Equal(t, owners[fmt.Sprint(i)], balancer.Pick(req, upstreams).URL.Host)
+	}
+	used := map[string]bool{}
+	for _, owner := range owners {
+		used[owner] = true
+	}
+	assert.Len(t, used, 3)
+	for key, owner := range owners {
+		req := request.NewRequest()
+		req.Headers.Set("X-User", key)
+		picked := balancer.Pick(req, upstreams[1:]).URL.Host
+		if owner != "a" {
+			assert.Equal(t, owner, picked, key)
+		}
+	}
+
+	// Test: Cookies are keys too, requests without take turns
+	balancer = HashCookie("session")
+	withCookie := request.NewRequest()
+	withCookie.Headers.Set("Cookie", "theme=dark; session=42")
+	first := balancer.Pick(withCookie, upstreams).URL.Host
+	assert.Equal(t, []string{first, first, first}, picks(balancer, withCookie, upstreams, 3))
+	assert.Equal(t, []string{"a", "b", "c"}, picks(balancer, req, upstreams, 3))
+}
+
+func TestPool(t *testing.T) {
+	pool, err := NewPool(RoundRobin(), backend(t, "one"), backend(t, "two"))
+	require.NoError(t, err)
+	c := &client.Client{}
+	url := balanced(t, pool)
+
+	// Test: Requests go through every upstream of the pool
+	_, first := get(t, c, url)
+	_, second := get(t, c, url)
+	assert.ElementsMatch(t, []string{"one", "two"}, []string{first, second})
+
+	// Test: An upstream failing MaxFails times in a row is left out
+	dead := deadBackend(t)
+	pool, err = NewPool(RoundRobin(), backend(t, "live"), dead)
+	require.NoError(t, err)
+	pool.MaxFails = 2
+	pool.Cooldown = 200 * time.Millisecond
+	url = balanced(t, pool)
+	failures := 0
+	for range 4 {
+		status, body := get(t, c, url)
+		if status == response.StatusBadGateway {
+			failures++
+		} else {
+			assert.Equal(t, "live", body)
+		}
+	}
+	assert.Equal(t, 2, failures)
+	assert.False(t, pool.Upstreams[1].Available())
+	for range 4 {
+		_, body := get(t, c, url)
+		assert.Equal(t, "live", body)
+	}
+
+	// Test: After the cooldown a single failure puts it down again
+	time.Sleep(250 * time.Millisecond)
+	assert.True(t, pool.Upstreams[1].Available())
+	statuses := []response.StatusCode{}
+	for range 4 {
+		status, _ := get(t, c, url)
+		statuses = append(statuses, status)
+	}
+	assert.Contains(t, statuses, response.StatusBadGateway)
+	assert.False(t, pool.Upstreams[1].Available())
+	assert.Equal(t, 3, pool.Upstreams[1].Failures())
+
+	// Test: With every upstream down the requests get 503
+	pool, err = NewPool(nil, deadBackend(t))
+	require.NoError(t, err)
+	pool.MaxFails = 1
+	url = balanced(t, pool)
+	status, _ := get(t, c, url)
+	assert.Equal(t, response.StatusBadGateway, status)
+	status, _ = get(t, c, url)
+	assert.Equal(t, response.StatusServiceUnavailable, status)
+
+	// Test: Invalid targets and weights are refused
+	_, err = NewPool(nil, "localhost:8080")
+	assert.ErrorIs(t, err, ErrorInvalidTarget)
+	assert.ErrorIs(t, pool.Add("http://localhost", 0), ErrorInvalidTarget)
+}
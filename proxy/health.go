@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"vivalchemy/http-server-from-scratch/client"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+	"vivalchemy/http-server-from-scratch/server"
+)
+
+var ErrorHealthCheck = fmt.Errorf("health check failed")
+
+const (
+	// DefaultCheckInterval is the time between the health checks of an
+	// upstream
+	DefaultCheckInterval = 10 * time.Second
+	// DefaultCheckTimeout bounds a health check
+	DefaultCheckTimeout = 2 * time.Second
+)
+
+// HealthCheck probes the upstreams of a pool with a GET of Path every
+// Interval. An upstream failing a probe gets no requests until it passes
+// one, its circuit breaker is left as it is.
+type HealthCheck struct {
+	Path     string              // "/" when empty, appended to the path of the upstream
+	Interval time.Duration       // DefaultCheckInterval when zero
+	Timeout  time.Duration       // DefaultCheckTimeout when zero
+	Status   response.StatusCode // the expected status, any 2xx when zero
+}
+
+// StartHealthChecks probes every upstream right away and then every
+// Interval until stop is called. Add the upstreams before.
+func (p *Pool) StartHealthChecks(check HealthCheck) (stop func()) {
+	if check.Interval == 0 {
+		check.Interval = DefaultCheckInterval
+	}
+	if check.Timeout == 0 {
+		check.Timeout = DefaultCheckTimeout
+	}
+	c := &client.Client{
+		Timeout:           check.Timeout,
+		DisableKeepAlives: true,
+		CheckRedirect: func(req *request.Request, via []*request.Request) error {
+			return client.ErrorUseLastResponse
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	for _, u := range p.Upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(check.Interval)
+			defer ticker.Stop()
+			for {
+				err := check.probe(ctx, c, u)
+				if ctx.Err() != nil {
+					return
+				}
+				u.mu.Lock()
+				u.unhealthy = err != nil
+				u.checkErr = err
+				u.checked = time.Now()
+				u.nextCheck = u.checked.Add(check.Interval)
+				u.mu.Unlock()
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// probe sends a health check to u, it fails on errors and unexpected
+// statuses
+func (check HealthCheck) probe(ctx context.Context, c *client.Client, u *Upstream) error {
+	path := check.Path
+	if path == "" {
+		path = "/"
+	}
+	target := *u.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + path
+	target.RawPath = ""
+	req, err := client.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.SetContext(ctx)
+	res, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrorHealthCheck, err)
+	}
+	res.Body.Close()
+
+	if check.Status == 0 && (res.StatusCode < 200 || res.StatusCode > 299) ||
+		check.Status != 0 && res.StatusCode != check.Status {
+		return fmt.Errorf("%w: status %d", ErrorHealthCheck, res.StatusCode)
+	}
+	return nil
+}
+
+// UpstreamStatus describes the state of an upstream
+type UpstreamStatus struct {
+	URL       string       `json:"url"`
+	Weight    int          `json:"weight"`
+	Active    int          `json:"active"`   // requests in flight
+	Failures  int          `json:"failures"` // consecutive failures
+	Breaker   BreakerState `json:"breaker"`
+	Healthy   bool         `json:"healthy"`
+	CheckedAt time.Time    `json:"checked_at,omitzero"` // zero without health checks
+	CheckErr  string       `json:"check_error,omitempty"`
+	Available bool         `json:"available"`
+}
+
+// Status returns the state of every upstream of the pool
+func (p *Pool) Status() []UpstreamStatus {
+	statuses := make([]UpstreamStatus, 0, len(p.Upstreams))
+	for _, u := range p.Upstreams {
+		u.mu.Lock()
+		status := UpstreamStatus{
+			URL:       u.URL.String(),
+			Weight:    u.Weight,
+			Active:    u.Active(),
+			Failures:  u.failures,
+			Breaker:   u.state(),
+			Healthy:   !u.unhealthy,
+			CheckedAt: u.checked,
+			Available: u.available(),
+		}
+		if u.checkErr != nil {
+			status.CheckErr = u.checkErr.Error()
+		}
+		u.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// StatusHandler serves Status as JSON, for an admin route
+func (p *Pool) StatusHandler() server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body, err := json.MarshalIndent(p.Status(), "", "  ")
+		if err != nil {
+			h := response.GetDefaultHeaders(0)
+			w.WriteStatusLine(response.StatusInternalServerError)
+			w.WriteHeaders(*h)
+			return
+		}
+
+		h := response.GetDefaultHeaders(len(body))
+		h.Replace("Content-Type", "application/json")
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*h)
+		w.WriteBody(body)
+	}
+}
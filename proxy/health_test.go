@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vivalchemy/http-server-from-scratch/client"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+	"vivalchemy/http-server-from-scratch/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkedBackend serves its name, and 200 or 500 on /healthz as healthy
+// says, it returns its URL
+func checkedBackend(t *testing.T, name string, healthy *atomic.Bool) string {
+	t.Helper()
+	s := server.NewServer()
+	s.Get("/healthz", func(w *response.Writer, req *request.Request) {
+		status := response.StatusOk
+		if !healthy.Load() {
+			status = response.StatusInternalServerError
+		}
+		h := response.GetDefaultHeaders(0)
+		w.WriteStatusLine(status)
+		w.WriteHeaders(*h)
+	})
+	s.Get("/*", func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(name))
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(name))
+	})
+	require.NoError(t, s.Serve(0))
+	t.Cleanup(func() { s.Close() })
+	return "http://" + local(s)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	req := request.NewRequest()
+	pool := testPool(t, 1)
+	pool.MaxFails = 2
+	pool.Cooldown = 100 * time.Millisecond
+	u := pool.Upstreams[0]
+
+	// Test: The breaker opens after MaxFails failures in a row
+	pool.Report(pool.Pick(req), false)
+	assert.Equal(t, BreakerClosed, u.State())
+	pool.Report(pool.Pick(req), false)
+	assert.Equal(t, BreakerOpen, u.State())
+	assert.Nil(t, pool.Pick(req))
+	assert.Equal(t, time.Second, pool.RetryAfter())
+
+	// Test: Half-open lets a single trial through, its failure opens again
+	time.Sleep(120 * time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, u.State())
+	assert.Same(t, u, pool.Pick(req))
+	assert.Nil(t, pool.Pick(req))
+	pool.Report(u, false)
+	assert.Equal(t, BreakerOpen, u.State())
+
+	// Test: A released trial can be taken again, a success closes
+	time.Sleep(120 * time.Millisecond)
+	assert.Same(t, u, pool.Pick(req))
+	u.release()
+	assert.Same(t, u, pool.Pick(req))
+	pool.Report(u, true)
+	assert.Equal(t, BreakerClosed, u.State())
+	assert.Equal(t, 0, u.Failures())
+
+	// Test: With the breakers open the proxy fails fast with Retry-After
+	pool, err := NewPool(nil, deadBackend(t))
+	require.NoError(t, err)
+	pool.MaxFails = 1
+	pool.Cooldown = 5 * time.Second
+	url := balanced(t, pool)
+	c := &client.Client{}
+	status, _ := get(t, c, url)
+	assert.Equal(t, response.StatusBadGateway, status)
+	res, err := c.Get(url)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, response.StatusServiceUnavailable, res.StatusCode)
+	retryAfter, _ := res.Headers.Get("retry-after")
+	assert.Equal(t, "5", retryAfter)
+}
+
+func TestHealthChecks(t *testing.T) {
+	healthy := [2]atomic.Bool{}
+	healthy[0].Store(true)
+	healthy[1].Store(true)
+	pool, err := NewPool(nil, checkedBackend(t, "one", &healthy[0]), checkedBackend(t, "two", &healthy[1]))
+	require.NoError(t, err)
+	stop := pool.StartHealthChecks(HealthCheck{Path: "/healthz", Interval: 20 * time.Millisecond})
+	defer stop()
+	c := &client.Client{}
+	url := balanced(t, pool)
+
+	// Test: An upstream failing its check gets no requests
+	healthy[1].Store(false)
+	require.Eventually(t, func() bool { return !pool.Upstreams[1].Healthy() }, time.Second, 10*time.Millisecond)
+	for range 4 {
+		_, body := get(t, c, url)
+		assert.Equal(t, "one", body)
+	}
+
+	// Test: The admin endpoint shows the state of the upstreams
+	s := server.NewServer()
+	s.Get("/upstreams", pool.StatusHandler())
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+	_, body := get(t, c, "http://"+local(s)+"/upstreams")
+	statuses := []map[string]any{}
+	require.NoError(t, json.Unmarshal([]byte(body), &statuses))
+	require.Len(t, statuses, 2)
+	assert.Equal(t, true, statuses[0]["healthy"])
+	assert.Equal(t, "closed", statuses[0]["breaker"])
+	assert.Equal(t, false, statuses[1]["healthy"])
+	assert.Equal(t, false, statuses[1]["available"])
+	assert.Contains(t, statuses[1]["check_error"], "status 500")
+
+	// Test: Passing a check brings it back
+	healthy[1].Store(true)
+	require.Eventually(t, func() bool { return pool.Upstreams[1].Healthy() }, time.Second, 10*time.Millisecond)
+	bodies := []string{}
+	for range 2 {
+		_, body := get(t, c, url)
+		bodies = append(bodies, body)
+	}
+	assert.ElementsMatch(t, []string{"one", "two"}, bodies)
+
+	// Test: An unexpected status or no answer fail the check
+	pool, err = NewPool(nil, checkedBackend(t, "three", &healthy[0]), deadBackend(t))
+	require.NoError(t, err)
+	stop = pool.StartHealthChecks(HealthCheck{Path: "/healthz", Status: response.StatusNoContent, Timeout: 100 * time.Millisecond})
+	defer stop()
+	require.Eventually(t, func() bool {
+		return !pool.Upstreams[0].Healthy() && !pool.Upstreams[1].Healthy()
+	}, time.Second, 10*time.Millisecond)
+	status, _ := get(t, c, balanced(t, pool))
+	assert.Equal(t, response.StatusServiceUnavailable, status)
+	assert.ErrorIs(t, pool.Upstreams[0].checkErr, ErrorHealthCheck)
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+var ErrorNoUpstream = fmt.Errorf("no upstream available")
+
+const (
+	// DefaultMaxFails consecutive failures mark an upstream down
+	DefaultMaxFails = 3
+	// DefaultCooldown is how long an upstream stays down before it is
+	// tried again
+	DefaultCooldown = 10 * time.Second
+)
+
+// BreakerState is the state of the circuit breaker of an upstream
+type BreakerState int
+
+const (
+	// BreakerClosed lets the requests through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails the requests fast until the cooldown is over
+	BreakerOpen
+	// BreakerHalfOpen lets a single trial request through, its outcome
+	// closes the breaker or opens it again
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Upstream is one of the targets of a Pool, with its circuit breaker and
+// the outcome of its last health check
+type Upstream struct {
+	URL    *url.URL
+	Weight int // share of the requests for Weighted and the hash balancers
+
+	active    atomic.Int64 // requests in flight
+	mu        sync.Mutex
+	failures  int       // consecutive failures
+	open      bool      // the breaker is open, or half-open past openUntil
+	openUntil time.Time // when the open breaker goes half-open
+	trial     bool      // the trial request of the half-open breaker is in flight
+	unhealthy bool      // the last health check failed
+	checked   time.Time // when the last health check ended
+	checkErr  error     // why the last health check failed
+	nextCheck time.Time
+}
+
+// Active returns the number of requests in flight to the upstream
+func (u *Upstream) Active() int {
+	return int(u.active.Load())
+}
+
+// Failures returns the number of consecutive failures of the upstream
+func (u *Upstream) Failures() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.failures
+}
+
+// State returns the state of the circuit breaker of the upstream
+func (u *Upstream) State() BreakerState {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.state()
+}
+
+func (u *Upstream) state() BreakerState {
+	switch {
+	case !u.open:
+		return BreakerClosed
+	case time.Now().Before(u.openUntil):
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// Healthy reports whether the last health check of the upstream passed, it
+// is true until the first one
+func (u *Upstream) Healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.unhealthy
+}
+
+// Available reports whether the upstream gets requests. It doesn't while
+// its last health check failed, while its breaker is open, or while the
+// trial request of its half-open breaker is in flight.
+func (u *Upstream) Available() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.available()
+}
+
+func (u *Upstream) available() bool {
+	if u.unhealthy {
+		return false
+	}
+	switch u.state() {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		return !u.trial
+	}
+	return false
+}
+
+// acquire claims the upstream for a request, it fails when another request
+// took the trial of its half-open breaker since it was picked
+func (u *Upstream) acquire() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.available() {
+		return false
+	}
+	if u.state() == BreakerHalfOpen {
+		u.trial = true
+	}
+	return true
+}
+
+// release gives back the trial of a request whose outcome says nothing
+// about the upstream
+func (u *Upstream) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.trial = false
+}
+
+// retryIn returns how long until the upstream may be tried again
+func (u *Upstream) retryIn() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var until time.Time
+	if u.unhealthy {
+		until = u.nextCheck
+	}
+	if u.open && u.openUntil.After(until) {
+		until = u.openUntil
+	}
+	return time.Until(until)
+}
+
+// Pool spreads the requests of a proxy over upstreams with its Balancer.
+// The circuit breaker of an upstream failing MaxFails times in a row opens
+// for Cooldown, then a single trial request closes it when it succeeds or
+// opens it again when it fails.
+type Pool struct {
+	Upstreams []*Upstream
+	Balancer  Balancer
+	MaxFails  int
+	Cooldown  time.Duration
+}
+
+// NewPool returns a pool of the targets, http or https URLs with weight 1,
+// balanced by balancer or RoundRobin when nil
+func NewPool(balancer Balancer, targets ...string) (*Pool, error) {
+	if balancer == nil {
+		balancer = RoundRobin()
+	}
+	pool := &Pool{Balancer: balancer}
+	for _, target := range targets {
+		if err := pool.Add(target, 1); err != nil {
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+// Add adds an upstream to the pool. Add before the pool serves requests.
+func (p *Pool) Add(target string, weight int) error {
+	u, err := parseTarget(target)
+	if err != nil {
+		return err
+	}
+	if weight < 1 {
+		return fmt.Errorf("%w: weight %d of %q", ErrorInvalidTarget, weight, target)
+	}
+	p.Upstreams = append(p.Upstreams, &Upstream{URL: u, Weight: weight})
+	return nil
+}
+
+// Pick returns the upstream for req among the available ones, nil when
+// they are all down. Report the outcome of the request to the upstream.
+func (p *Pool) Pick(req *request.Request) *Upstream {
+	for {
+		available := make([]*Upstream, 0, len(p.Upstreams))
+		for _, u := range p.Upstreams {
+			if u.Available() {
+				available = append(available, u)
+			}
+		}
+		if len(available) == 0 {
+			return nil
+		}
+		// a half-open upstream drops out once its trial is taken
+		if u := p.Balancer.Pick(req, available); u.acquire() {
+			return u
+		}
+	}
+}
+
+// Report records the outcome of a request to u, ok is false for requests
+// that failed or got a 502, 503 or 504
+func (p *Pool) Report(u *Upstream, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.trial = false
+	if ok {
+		u.failures = 0
+		u.open = false
+		return
+	}
+	u.failures++
+	if u.open || u.failures >= p.maxFails() {
+		u.open = true
+		u.openUntil = time.Now().Add(p.cooldown())
+	}
+}
+
+// RetryAfter returns how long until an upstream of the pool may be tried
+// again, at least a second
+func (p *Pool) RetryAfter() time.Duration {
+	retry := time.Duration(-1)
+	for _, u := range p.Upstreams {
+		if in := u.retryIn(); retry < 0 || in < retry {
+			retry = in
+		}
+	}
+	return max(retry, time.Second)
+}
+
+func (p *Pool) maxFails() int {
+	if p.MaxFails == 0 {
+		return DefaultMaxFails
+	}
+	return p.MaxFails
+}
+
+func (p *Pool) cooldown() time.Duration {
+	if p.Cooldown == 0 {
+		return DefaultCooldown
+	}
+	return p.Cooldown
+}
+
+// upstreamFailed tells the responses that mean the upstream itself is in
+// trouble, rather than the request
+func upstreamFailed(status response.StatusCode) bool {
+	return status == response.StatusBadGateway || status == response.StatusServiceUnavailable ||
+		status == response.StatusGatewayTimeout
+}
+
+func parseTarget(target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorInvalidTarget, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("%w: %q", ErrorInvalidTarget, target)
+	}
+	return u, nil
+}
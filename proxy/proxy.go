@@ -0,0 +1,365 @@
+// Package proxy forwards requests to an upstream server and streams its
+// response back, a reverse proxy built on the server's own handlers:
+//
+//	p, _ := proxy.New("http://localhost:8080/api/")
+//	s.Mount("/api", server.Handler(p.Handle), server.StreamBody())
+//
+// Mounted with StreamBody request bodies are streamed upstream as they
+// come, still bounded by the MaxBodySize of the server. Without it they are
+// read whole before the handler runs and forwarded from memory.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"vivalchemy/http-server-from-scratch/client"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+	"vivalchemy/http-server-from-scratch/server"
+)
+
+var ErrorInvalidTarget = fmt.Errorf("invalid proxy target")
+var ErrorUpstream = fmt.Errorf("upstream request failed")
+
+// DefaultTimeout bounds dialing the upstream and waiting for its response
+// headers when Proxy.Timeout is 0
+const DefaultTimeout = 30 * time.Second
+
+// DefaultVia is the pseudonym the proxy adds to the Via headers
+const DefaultVia = "http-server-from-scratch"
+
+// hopByHop are the fields that only concern one connection, RFC 9110
+// section 7.6.1. The fields listed in Connection are dropped too.
+var hopByHop = []string{"connection", "keep-alive", "proxy-connection", "proxy-authenticate",
+	"proxy-authorization", "te", "transfer-encoding", "upgrade"}
+
+// Request is the request sent upstream, Rewrite can change any of it. A
+// hook replacing Body has to fix or delete the Content-Length.
+type Request struct {
+	Method  string
+	URL     *url.URL // the upstream, dialed at its host
+	Host    string   // sent as the Host header, the host of URL by default
+	Headers *headers.Headers
+	// Body is streamed upstream with the Content-Length of Headers, chunked
+	// without one. Nil for the requests without a body.
+	Body io.Reader
+	In   *request.Request // the request received
+}
+
+// Response is the upstream response, ModifyResponse can change any of it.
+// A hook replacing Body has to fix or delete the Content-Length.
+type Response struct {
+	Status      response.StatusCode
+	HttpVersion string
+	Headers     *headers.Headers
+	// Trailers holds the trailer fields of a chunked body once Body is read
+	Trailers *headers.Headers
+	Body     io.ReadCloser
+	Request  *Request
+}
+
+// Proxy is a handler forwarding every request to Target, or to one of the
+// upstreams of Pool when it is set. Register its Handle as a route or mount.
+type Proxy struct {
+	Target *url.URL
+	Pool   *Pool
+	// Rewrite changes the request before it is sent, after the forwarding
+	// headers were added
+	Rewrite func(out *Request)
+	// ModifyResponse changes the response before it is sent back, an error
+	// answers with 502 instead
+	ModifyResponse func(res *Response) error
+	// ErrorHandler answers the requests the upstream couldn't, with 504 for
+	// timeouts and 502 otherwise. RenderError when nil.
+	ErrorHandler server.ErrorHandler
+	// Dial connects to the upstream, a net.Dialer with Timeout when nil. It
+	// gets a plain TCP connection for https targets too. Timeout also bounds
+	// the wait for the response headers.
+	Dial    func(ctx context.Context, network string, address string) (net.Conn, error)
+	Timeout time.Duration
+	// PreserveHost sends the Host of the request received instead of the
+	// host of Target
+	PreserveHost bool
+	// Via is the pseudonym added to the Via headers, DefaultVia when empty
+	Via string
+
+	clientOnce sync.Once
+	client     *client.Client // keeps the upstream connections alive
+}
+
+// New returns a proxy to target, an http or https URL. The paths of the
+// requests are appended to its path, their queries to its query.
+func New(target string) (*Proxy, error) {
+	u, err := parseTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{Target: u}, nil
+}
+
+// NewBalanced returns a proxy spreading the requests over the upstreams of
+// pool. When none is available the requests get 503.
+func NewBalanced(pool *Pool) *Proxy {
+	return &Proxy{Pool: pool}
+}
+
+// Handle forwards req upstream and streams the response back. Within a
+// mount only the StrippedPath is forwarded.
+func (p *Proxy) Handle(w *response.Writer, req *request.Request) {
+	target := p.Target
+	var upstream *Upstream
+	if p.Pool != nil {
+		upstream = p.Pool.Pick(req)
+		if upstream == nil {
+			httpErr := server.NewHTTPError(response.StatusServiceUnavailable, "no upstream available", ErrorNoUpstream)
+			httpErr.RetryAfter = p.Pool.RetryAfter()
+			p.fail(w, req, httpErr)
+			return
+		}
+		target = upstream.URL
+		upstream.active.Add(1)
+		defer upstream.active.Add(-1)
+	}
+
+	out := p.outgoing(req, target)
+	if p.Rewrite != nil {
+		p.Rewrite(out)
+	}
+
+	res, err := p.roundTrip(req.Context(), out)
+	if upstream != nil {
+		if errors.Is(req.Context().Err(), context.Canceled) {
+			// a client leaving says nothing about the upstream
+			upstream.release()
+		} else {
+			p.Pool.Report(upstream, err == nil && !upstreamFailed(res.Status))
+		}
+	}
+	if err != nil {
+		p.fail(w, req, err)
+		return
+	}
+	defer res.Body.Close()
+
+	if p.ModifyResponse != nil {
+		if err := p.ModifyResponse(res); err != nil {
+			p.fail(w, req, server.NewHTTPError(response.StatusBadGateway, "upstream response refused", err))
+			return
+		}
+	}
+	if err := p.copyResponse(w, req, res); err != nil && req.Context().Err() == nil {
+		// too late for an error response, the client sees it cut short
+		log.Printf("%s %s: proxy: %v", req.Method, req.TargetPath, err)
+		w.SetKeepAlive(false)
+	}
+}
+
+// outgoing builds the request to target from the one received
+func (p *Proxy) outgoing(req *request.Request, target *url.URL) *Request {
+	path := req.TargetPath
+	if req.StrippedPath != "" {
+		path = req.StrippedPath
+	}
+	path, query, _ := strings.Cut(path, "?")
+	u := *target
+	// the path received is still escaped, RawPath keeps it as it came
+	u.RawPath = strings.TrimSuffix(target.EscapedPath(), "/") + path
+	if unescaped, err := url.PathUnescape(u.RawPath); err == nil {
+		u.Path = unescaped
+	} else {
+		u.Path, u.RawPath = u.RawPath, ""
+	}
+	if u.RawQuery == "" || query == "" {
+		u.RawQuery += query
+	} else {
+		u.RawQuery += "&" + query
+	}
+
+	h := headers.NewHeaders()
+	for name, value := range req.Headers.GetAll() {
+		h.Replace(name, value)
+	}
+	removeHopByHop(h)
+	// the client got its 100 Continue already, the upstream needn't send one
+	h.Delete("expect")
+
+	var body io.Reader
+	if req.BodyStream != nil {
+		body = req.BodyStream
+	} else if len(req.Body) > 0 {
+		// a chunked body read whole is sent with its length
+		body = bytes.NewReader(req.Body)
+		h.Replace("Content-Length", fmt.Sprint(len(req.Body)))
+	}
+
+	if ip := clientIP(req.RemoteAddr); ip != "" {
+		h.Set("X-Forwarded-For", ip)
+	}
+	h.Replace("X-Forwarded-Host", req.Host)
+	h.Replace("X-Forwarded-Proto", "http")
+	h.Set("Via", p.via(req.HttpVersion))
+
+	host := u.Host
+	if p.PreserveHost {
+		host = req.Host
+	}
+	return &Request{Method: req.Method, URL: &u, Host: host, Headers: h, Body: body, In: req}
+}
+
+// roundTrip sends out upstream with the client of the proxy, which doesn't
+// follow redirects
+func (p *Proxy) roundTrip(ctx context.Context, out *Request) (*Response, error) {
+	p.clientOnce.Do(func() {
+		timeout := p.Timeout
+		if timeout == 0 {
+			timeout = DefaultTimeout
+		}
+		p.client = &client.Client{
+			Dial:          p.Dial,
+			DialTimeout:   timeout,
+			HeaderTimeout: timeout,
+			CheckRedirect: func(req *request.Request, via []*request.Request) error {
+				return client.ErrorUseLastResponse
+			},
+		}
+	})
+
+	req, err := client.NewRequest(out.Method, out.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = out.Host
+	req.Headers = out.Headers
+	req.BodyStream = out.Body
+	req.SetContext(ctx)
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
+		Status:      res.StatusCode,
+		HttpVersion: res.HttpVersion,
+		Headers:     res.Headers,
+		Trailers:    res.Trailers,
+		Body:        res.Body,
+		Request:     out,
+	}, nil
+}
+
+// copyResponse sends res back, with its Content-Length when it has one and
+// chunked otherwise, passing the trailers on
+func (p *Proxy) copyResponse(w *response.Writer, req *request.Request, res *Response) error {
+	h := headers.NewHeaders()
+	for name, value := range res.Headers.GetAll() {
+		h.Replace(name, value)
+	}
+	removeHopByHop(h)
+	h.Set("Via", p.via(res.HttpVersion))
+
+	_, sized := h.Get("content-length")
+	bodyless := req.Method == "HEAD" || res.Status == response.StatusNoContent || res.Status == response.StatusNotModified
+	if !sized && !bodyless {
+		h.Replace("Transfer-Encoding", "chunked")
+	}
+	if err := w.WriteStatusLine(res.Status); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return err
+	}
+	if bodyless {
+		return nil
+	}
+	if sized {
+		_, err := io.Copy(writerFunc(w.WriteBody), res.Body)
+		return err
+	}
+
+	if _, err := io.Copy(writerFunc(w.WriteChunkedBody), res.Body); err != nil {
+		return err
+	}
+	trailers := headers.NewHeaders()
+	for name, value := range res.Trailers.GetAll() {
+		trailers.Replace(name, value)
+	}
+	removeHopByHop(trailers)
+	return w.WriteChunkedBodyDone(trailers)
+}
+
+// fail answers a request the upstream didn't, unless the client left. A
+// body the server refused while it was streamed keeps its status.
+func (p *Proxy) fail(w *response.Writer, req *request.Request, err error) {
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		return
+	}
+	var httpErr *server.HTTPError
+	if !errors.As(err, &httpErr) {
+		status, message := response.StatusBadGateway, "upstream unavailable"
+		if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+			status, message = response.StatusGatewayTimeout, "upstream timed out"
+		}
+		httpErr = server.NewHTTPError(status, message, fmt.Errorf("%w: %w", ErrorUpstream, err))
+	}
+	handler := p.ErrorHandler
+	if handler == nil {
+		handler = server.RenderError
+	}
+	handler(w, req, httpErr.Status, httpErr)
+}
+
+// via returns the Via entry of the proxy for a message of version
+func (p *Proxy) via(version string) string {
+	pseudonym := p.Via
+	if pseudonym == "" {
+		pseudonym = DefaultVia
+	}
+	// HTTP/2 is just "2", the earlier versions keep their minor version
+	if version == "2.0" {
+		version = "2"
+	}
+	return version + " " + pseudonym
+}
+
+// removeHopByHop deletes the fields that don't travel past a connection
+func removeHopByHop(h *headers.Headers) {
+	if connection, ok := h.Get("connection"); ok {
+		for _, name := range strings.Split(connection, ",") {
+			h.Delete(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHop {
+		h.Delete(name)
+	}
+}
+
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case nil:
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// writerFunc adapts the body writing methods of response.Writer to io.Copy
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
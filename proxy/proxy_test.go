@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+	"vivalchemy/http-server-from-scratch/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upstream serves the routes the proxy is tested against
+func upstream(t *testing.T) string {
+	t.Helper()
+	s := server.NewServer()
+	echo := func(w *response.Writer, req *request.Request) {
+		body := fmt.Sprintf("%s %s\n", req.Method, req.TargetPath)
+		for _, name := range []string{"host", "x-forwarded-for", "x-forwarded-host", "x-forwarded-proto", "via", "x-secret", "expect"} {
+			value, _ := req.Headers.Get(name)
+			body += fmt.Sprintf("%s=%s\n", name, value)
+		}
+		body += string(req.Body)
+		h := response.GetDefaultHeaders(len(body))
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(body))
+	}
+	s.Get("/echo", echo)
+	s.Post("/echo", echo)
+	s.Get("/echo/*", echo)
+	s.AddHandler("PURGE", "/echo", echo)
+	s.Get("/teapot", func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(3)
+		h.Set("Keep-Alive", "timeout=5")
+		h.Set("X-Upstream", "yes")
+		w.WriteStatusLine(418)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte("tea"))
+	})
+	s.Get("/stream", func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*h)
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc")
+		w.WriteChunkedBodyDone(trailers)
+	})
+	s.Get("/slow", func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+	})
+	require.NoError(t, s.Serve(0))
+	t.Cleanup(func() { s.Close() })
+	return local(s)
+}
+
+// local returns the IPv4 loopback address of a server
+func local(s *server.Server) string {
+	return fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+// do sends raw to addr and returns the head and body of the response,
+// read until the server closes the connection
+func do(t *testing.T, addr string, raw string) (string, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, raw)
+	require.NoError(t, err)
+	res, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	head, body, _ := strings.Cut(string(res), "\r\n\r\n")
+	return head + "\r\n", body
+}
+
+func TestProxy(t *testing.T) {
+	target := upstream(t)
+	p, err := New("http://" + target + "/")
+	require.NoError(t, err)
+	s := server.NewServer()
+	s.MaxBodySize = 16
+	s.Mount("/api", server.Handler(p.Handle), server.StreamBody())
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+	addr := local(s)
+
+	// Test: Method, path, query and body reach the upstream with the
+	// forwarding headers and without the hop-by-hop ones
+	head, body := do(t, addr, "POST /api/echo?q=1 HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n"+
+		"Connection: close, x-secret\r\nX-Secret: 1\r\nVia: 1.0 edge\r\n\r\nping")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+	assert.Contains(t, head, "via: 1.1 "+DefaultVia+"\r\n")
+	assert.Equal(t, "POST /echo?q=1\nhost="+target+"\nx-forwarded-for=127.0.0.1\nx-forwarded-host=example.com\n"+
+		"x-forwarded-proto=http\nvia=1.0 edge,1.1 "+DefaultVia+"\nx-secret=\nexpect=\nping", body)
+
+	// Test: Chunked request bodies are streamed, the MaxBodySize of the
+	// server bounds them
+	_, body = do(t, addr, "POST /api/echo HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n"+
+		"Connection: close\r\n\r\n4\r\nping\r\n0\r\n\r\n")
+	assert.True(t, strings.HasSuffix(body, "\nping"), body)
+	head, _ = do(t, addr, "POST /api/echo HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n"+
+		"Connection: close\r\n\r\n10\r\n0123456789abcdef\r\n1\r\n!\r\n0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 413 "), head)
+
+	// Test: The connection is kept once a streamed body was read
+	head, body = do(t, addr, "POST /api/echo HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\nping"+
+		"GET /api/teapot HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	assert.NotContains(t, head, "connection: close")
+	assert.Contains(t, body, "\nping")
+	assert.True(t, strings.HasSuffix(body, "\r\n\r\ntea"), body)
+
+	// Test: Escaped paths are forwarded as they came
+	_, body = do(t, addr, "GET /api/echo/a%20b/c%2Fd?q=%20 HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(body, "GET /echo/a%20b/c%2Fd?q=%20\n"), body)
+
+	// Test: Any method is forwarded
+	_, body = do(t, addr, "PURGE /api/echo HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(body, "PURGE /echo\n"), body)
+
+	// Test: The upstream status and headers come back as they were, minus
+	// the hop-by-hop ones
+	head, body = do(t, addr, "GET /api/teapot HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 418 \r\n"), head)
+	assert.Contains(t, head, "x-upstream: yes\r\n")
+	assert.NotContains(t, head, "keep-alive")
+	assert.Equal(t, "tea", body)
+
+	// Test: Chunked bodies stream through with their trailers
+	head, body = do(t, addr, "GET /api/stream HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, head, "transfer-encoding: chunked\r\n")
+	assert.Equal(t, "6\r\nhello \r\n5\r\nworld\r\n0\r\nx-checksum: abc\r\n\r\n", body)
+
+	// Test: HTTP/1.0 clients get the chunked body close delimited
+	head, body = do(t, addr, "GET /api/stream HTTP/1.0\r\n\r\n")
+	assert.NotContains(t, head, "transfer-encoding")
+	assert.Equal(t, "hello world", body)
+}
+
+func TestProxyStreamsBody(t *testing.T) {
+	firstChunk := make(chan string, 1)
+	up := server.NewServer()
+	up.AddHandler(server.MethodPost, "/upload", func(w *response.Writer, req *request.Request) {
+		buf := make([]byte, 5)
+		io.ReadFull(req.BodyStream, buf)
+		firstChunk <- string(buf)
+		rest, _ := io.ReadAll(req.BodyStream)
+		body := string(buf) + string(rest)
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}, server.StreamBody())
+	require.NoError(t, up.Serve(0))
+	defer up.Close()
+	p, err := New("http://" + local(up))
+	require.NoError(t, err)
+	s := server.NewServer()
+	s.Mount("/", server.Handler(p.Handle), server.StreamBody())
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", local(s))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: The upstream gets the body while the client is still sending it
+	io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n"+
+		"Connection: close\r\n\r\n5\r\nhello\r\n")
+	select {
+	case chunk := <-firstChunk:
+		assert.Equal(t, "hello", chunk)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream didn't get the first chunk")
+	}
+	io.WriteString(conn, "6\r\n world\r\n0\r\n\r\n")
+	res, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(res), "\r\n\r\nhello world"), string(res))
+}
+
+func TestProxyHooks(t *testing.T) {
+	target := upstream(t)
+	p, err := New("http://" + target)
+	require.NoError(t, err)
+	p.PreserveHost = true
+	p.Rewrite = func(out *Request) {
+		out.Method = "POST"
+		out.Body = strings.NewReader("rewritten")
+		out.Headers.Set("X-Secret", "from rewrite")
+	}
+	p.ModifyResponse = func(res *Response) error {
+		if res.Status != response.StatusOk {
+			return errors.New("upstream refused")
+		}
+		res.Headers.Set("X-Modified", "1")
+		return nil
+	}
+	s := server.NewServer()
+	s.Mount("/", server.Handler(p.Handle))
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+	addr := local(s)
+
+	// Test: Rewrite changes the request sent, PreserveHost keeps its Host
+	head, body := do(t, addr, "GET /echo HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, head, "x-modified: 1\r\n")
+	assert.True(t, strings.HasPrefix(body, "POST /echo\nhost=example.com\n"), body)
+	assert.Contains(t, body, "x-secret=from rewrite\n")
+	assert.True(t, strings.HasSuffix(body, "\nrewritten"), body)
+
+	// Test: An error of ModifyResponse answers 502
+	head, _ = do(t, addr, "GET /missing HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 502 Bad Gateway\r\n"), head)
+}
+
+func TestProxyErrors(t *testing.T) {
+	target := upstream(t)
+	errs := make(chan error, 1)
+	p, err := New("http://" + target)
+	require.NoError(t, err)
+	p.Timeout = 100 * time.Millisecond
+	p.ErrorHandler = func(w *response.Writer, req *request.Request, status response.StatusCode, err error) {
+		errs <- err
+		server.RenderError(w, req, status, err)
+	}
+	s := server.NewServer()
+	s.Mount("/", server.Handler(p.Handle))
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+	addr := local(s)
+
+	// Test: An upstream not answering in time gets 504
+	head, _ := do(t, addr, "GET /slow HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 504 Gateway Timeout\r\n"), head)
+	assert.ErrorIs(t, <-errs, ErrorUpstream)
+
+	// Test: An upstream that can't be reached gets 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p.Target.Host = listener.Addr().String()
+	listener.Close()
+	head, _ = do(t, addr, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 502 Bad Gateway\r\n"), head)
+	assert.ErrorIs(t, <-errs, ErrorUpstream)
+
+	// Test: Targets other than http and https URLs are refused
+	_, err = New("ftp://example.com")
+	assert.ErrorIs(t, err, ErrorInvalidTarget)
+	_, err = New("/relative")
+	assert.ErrorIs(t, err, ErrorInvalidTarget)
+}
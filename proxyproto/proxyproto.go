@@ -0,0 +1,238 @@
+// Package proxyproto reads the HAProxy PROXY protocol header (text v1 and
+// binary v2) that load balancers put in front of a connection, so
+// RemoteAddr and LocalAddr report the original client and destination.
+//
+// Only put it in front of listeners that are reachable through the load
+// balancer alone, anyone else can send a header with any address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorMissingHeader = fmt.Errorf("missing PROXY protocol header")
+var ErrorMalformedHeader = fmt.Errorf("malformed PROXY protocol header")
+var ErrorUnsupportedHeader = fmt.Errorf("unsupported PROXY protocol header")
+
+var v1Prefix = []byte("PROXY ")
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLen is the longest v1 header, CRLF included
+const v1MaxLen = 107
+
+// Listener accepts connections starting with a PROXY protocol header
+type Listener struct {
+	net.Listener
+	// Optional lets connections without a header through unchanged,
+	// otherwise they fail with ErrorMissingHeader on the first Read
+	Optional bool
+	// ReadHeaderTimeout bounds the wait for the header, none when 0
+	ReadHeaderTimeout time.Duration
+}
+
+func NewListener(l net.Listener) *Listener {
+	return &Listener{Listener: l, ReadHeaderTimeout: 5 * time.Second}
+}
+
+// Accept returns a *Conn. The header is read on the first Read, RemoteAddr
+// or LocalAddr call, so a slow client doesn't hold up the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c, l.Optional, l.ReadHeaderTimeout), nil
+}
+
+// Conn is a connection whose addresses come from its PROXY protocol header
+type Conn struct {
+	net.Conn
+	reader   *bufio.Reader
+	optional bool
+	timeout  time.Duration
+
+	once   sync.Once
+	err    error
+	source net.Addr // nil when the header had no addresses
+	dest   net.Addr
+}
+
+func NewConn(c net.Conn, optional bool, timeout time.Duration) *Conn {
+	return &Conn{Conn: c, reader: bufio.NewReader(c), optional: optional, timeout: timeout}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr is the source address of the header, or the peer address for
+// LOCAL and UNKNOWN headers and connections without one
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr is the destination address of the header, see RemoteAddr
+func (c *Conn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.dest != nil {
+		return c.dest
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Header reads the header if needed and returns its error
+func (c *Conn) Header() error {
+	return c.readHeader()
+}
+
+func (c *Conn) readHeader() error {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.source, c.dest, c.err = ReadHeader(c.reader, c.optional)
+	})
+	return c.err
+}
+
+// ReadHeader reads a v1 or v2 header from r. The addresses are nil for
+// LOCAL and UNKNOWN headers, and when optional is set and r doesn't start
+// with a header.
+func ReadHeader(r *bufio.Reader, optional bool) (net.Addr, net.Addr, error) {
+	// both signatures are told apart by their first byte
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		if prefix, err := r.Peek(len(v1Prefix)); err == nil && bytes.Equal(prefix, v1Prefix) {
+			return readV1(r)
+		}
+	case v2Signature[0]:
+		if prefix, err := r.Peek(len(v2Signature)); err == nil && bytes.Equal(prefix, v2Signature) {
+			return readV2(r)
+		}
+	}
+
+	if optional {
+		return nil, nil, nil
+	}
+	return nil, nil, ErrorMissingHeader
+}
+
+// readV1 parses "PROXY TCP4 src dst sport dport\r\n"
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, v1MaxLen)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == v1MaxLen {
+			return nil, nil, ErrorMalformedHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrorMalformedHeader
+	}
+
+	fields := strings.Split(string(line[len(v1Prefix):len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		// the rest of the line is to be ignored
+		return nil, nil, nil
+	}
+	if len(fields) != 5 || fields[0] != "TCP4" && fields[0] != "TCP6" {
+		return nil, nil, ErrorMalformedHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[1]), net.ParseIP(fields[2])
+	srcPort, srcErr := parsePort(fields[3])
+	dstPort, dstErr := parsePort(fields[4])
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, ErrorMalformedHeader
+	}
+	if (srcIP.To4() != nil) != (fields[0] == "TCP4") || (dstIP.To4() != nil) != (fields[0] == "TCP4") {
+		return nil, nil, ErrorMalformedHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+func parsePort(s string) (int, error) {
+	if s == "" || len(s) > 1 && s[0] == '0' {
+		return 0, ErrorMalformedHeader
+	}
+	port, err := strconv.ParseUint(s, 10, 16)
+	return int(port), err
+}
+
+// readV2 parses the binary header: signature, version and command,
+// family and protocol, address length and the addresses
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	version, command := header[12]>>4, header[12]&0x0f
+	family, protocol := header[13]>>4, header[13]&0x0f
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if version != 2 {
+		return nil, nil, ErrorUnsupportedHeader
+	}
+	switch command {
+	case 0x0:
+		// LOCAL: health checks from the proxy itself, keep the real addresses
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, ErrorUnsupportedHeader
+	}
+
+	var size int
+	switch family {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX carry nothing RemoteAddr can report
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, ErrorMalformedHeader
+	}
+
+	srcIP := net.IP(append([]byte{}, payload[:size]...))
+	dstIP := net.IP(append([]byte{}, payload[size:2*size]...))
+	srcPort := int(binary.BigEndian.Uint16(payload[2*size:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*size+2:]))
+	// the TLVs after the addresses are ignored
+
+	if protocol == 0x2 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
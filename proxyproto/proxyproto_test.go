@@ -0,0 +1,142 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func v2Header(command, family byte, addrs []byte) string {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+func read(t *testing.T, raw string, optional bool) (net.Addr, net.Addr, string, error) {
+	t.Helper()
+	r := bufio.NewReader(strings.NewReader(raw))
+	source, dest, err := ReadHeader(r, optional)
+	rest, _ := io.ReadAll(r)
+	return source, dest, string(rest), err
+}
+
+func TestReadHeaderV1(t *testing.T) {
+	// Test: TCP4 header
+	source, dest, rest, err := read(t, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nGET / HTTP/1.1\r\n", false)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324", source.String())
+	assert.Equal(t, "198.51.100.2:443", dest.String())
+	assert.Equal(t, "GET / HTTP/1.1\r\n", rest)
+
+	// Test: TCP6 header
+	source, _, _, err = read(t, "PROXY TCP6 2001:db8::1 2001:db8::2 4711 80\r\n", false)
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:4711", source.String())
+
+	// Test: UNKNOWN keeps the connection addresses
+	source, dest, rest, err = read(t, "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nbody", false)
+	require.NoError(t, err)
+	assert.Nil(t, source)
+	assert.Nil(t, dest)
+	assert.Equal(t, "body", rest)
+
+	// Test: Malformed headers
+	for _, raw := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.2 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.2 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 65536 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 01 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 1 2\n",
+		"PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n",
+	} {
+		_, _, _, err = read(t, raw, false)
+		assert.ErrorIs(t, err, ErrorMalformedHeader, raw)
+	}
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	// Test: IPv4 over TCP, TLVs are skipped
+	addrs := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0xdc, 0x04, 0x01, 0xbb}
+	addrs = append(addrs, 0x04, 0x00, 0x01, 0x00) // a NOOP TLV
+	source, dest, rest, err := read(t, v2Header(0x1, 0x11, addrs)+"GET", false)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324", source.String())
+	assert.Equal(t, "198.51.100.2:443", dest.String())
+	assert.Equal(t, "GET", rest)
+
+	// Test: IPv6 over UDP
+	addrs = make([]byte, 36)
+	copy(addrs, net.ParseIP("2001:db8::1"))
+	copy(addrs[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(addrs[32:], 4711)
+	binary.BigEndian.PutUint16(addrs[34:], 53)
+	source, _, _, err = read(t, v2Header(0x1, 0x22, addrs), false)
+	require.NoError(t, err)
+	assert.IsType(t, &net.UDPAddr{}, source)
+	assert.Equal(t, "[2001:db8::1]:4711", source.String())
+
+	// Test: LOCAL keeps the connection addresses
+	source, _, rest, err = read(t, v2Header(0x0, 0x00, nil)+"GET", false)
+	require.NoError(t, err)
+	assert.Nil(t, source)
+	assert.Equal(t, "GET", rest)
+
+	// Test: Addresses shorter than the family needs
+	_, _, _, err = read(t, v2Header(0x1, 0x11, []byte{192, 0, 2, 1}), false)
+	assert.ErrorIs(t, err, ErrorMalformedHeader)
+
+	// Test: Unknown commands
+	_, _, _, err = read(t, v2Header(0x2, 0x11, make([]byte, 12)), false)
+	assert.ErrorIs(t, err, ErrorUnsupportedHeader)
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewListener(inner)
+	defer l.Close()
+
+	send := func(raw string) {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		require.NoError(t, err)
+		client.Write([]byte(raw))
+		client.Close()
+	}
+
+	// Test: The header sets the addresses and is not part of the stream
+	go send("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nhello")
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	body, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+	assert.Equal(t, "198.51.100.2:443", conn.LocalAddr().String())
+	conn.Close()
+
+	// Test: A connection without a header fails
+	go send("hello")
+	conn, err = l.Accept()
+	require.NoError(t, err)
+	_, err = io.ReadAll(conn)
+	assert.ErrorIs(t, err, ErrorMissingHeader)
+	assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+	conn.Close()
+
+	// Test: Optional lets it through
+	l.Optional = true
+	go send("hello")
+	conn, err = l.Accept()
+	require.NoError(t, err)
+	body, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	conn.Close()
+}
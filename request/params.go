@@ -0,0 +1,61 @@
+package request
+
+// Params holds the values captured by the route pattern of a request.
+// Parameters with a type constraint, like {id:int}, also keep the parsed
+// value.
+type Params struct {
+	values map[string]string
+	typed  map[string]any
+}
+
+// Set stores a parameter, typed is nil when the parameter has no type
+func (p *Params) Set(name string, value string, typed any) {
+	if p.values == nil {
+		p.values = map[string]string{}
+		p.typed = map[string]any{}
+	}
+	p.values[name] = value
+	if typed != nil {
+		p.typed[name] = typed
+	}
+}
+
+// Get returns the decoded value of the parameter, or "" when it's missing
+func (p Params) Get(name string) string {
+	return p.values[name]
+}
+
+// Lookup is like Get but also reports whether the parameter exists
+func (p Params) Lookup(name string) (string, bool) {
+	value, ok := p.values[name]
+	return value, ok
+}
+
+// Value returns the typed value of a constrained parameter
+func (p Params) Value(name string) (any, bool) {
+	value, ok := p.typed[name]
+	return value, ok
+}
+
+// Int returns the value of an {name:int} parameter
+func (p Params) Int(name string) (int64, bool) {
+	value, ok := p.typed[name].(int64)
+	return value, ok
+}
+
+// Uint returns the value of an {name:uint} parameter
+func (p Params) Uint(name string) (uint64, bool) {
+	value, ok := p.typed[name].(uint64)
+	return value, ok
+}
+
+// Float returns the value of an {name:float} parameter
+func (p Params) Float(name string) (float64, bool) {
+	value, ok := p.typed[name].(float64)
+	return value, ok
+}
+
+// All returns every parameter by name
+func (p Params) All() map[string]string {
+	return p.values
+}
@@ -0,0 +1,156 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"vivalchemy/http-server-from-scratch/headers"
+)
+
+// MaxHeaderBytes bounds the request line and headers, or the trailers, of a
+// request read by a Reader
+const MaxHeaderBytes = 1 << 20
+
+// Reader reads requests from a connection in two steps, so the headers can
+// be looked at before the body is read, as Expect: 100-continue needs.
+// Bytes read past the end of a request are kept for the next one.
+type Reader struct {
+	// MaxBodySize fails the bodies growing past it with ErrorBodyTooLarge,
+	// no limit when 0
+	MaxBodySize int
+	// ObsFoldPolicy decides on the obs-fold lines of the headers and
+	// trailers, rejected by default
+	ObsFoldPolicy headers.ObsFoldPolicy
+
+	reader io.Reader
+	buf    []byte
+	bufLen int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{reader: reader, buf: make([]byte, 1024)}
+}
+
+// ReadHeaders reads the request line and the headers of the next request.
+// When the request has a body it is left for ReadBody.
+func (rd *Reader) ReadHeaders() (*Request, error) {
+	request := NewRequest()
+	request.obsFold = rd.ObsFoldPolicy
+	request.Headers.SetObsFoldPolicy(rd.ObsFoldPolicy)
+	err := rd.readUntil(request, func() bool {
+		return request.state == StateHeadersDone || request.isDone()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// ReadBody reads the body of a request returned by ReadHeaders
+func (rd *Reader) ReadBody(request *Request) error {
+	rd.startBody(request)
+	return rd.readUntil(request, request.isDone)
+}
+
+// BodyReader returns the body of a request returned by ReadHeaders as a
+// stream, which isn't kept in Body. The next request can only be read once
+// it returned io.EOF.
+func (rd *Reader) BodyReader(request *Request) io.Reader {
+	rd.startBody(request)
+	return &bodyReader{rd: rd, request: request}
+}
+
+func (rd *Reader) startBody(request *Request) {
+	if request.state == StateHeadersDone {
+		request.maxBody = rd.MaxBodySize
+		request.headLen = 0
+		request.state = StateBody
+	}
+}
+
+// bodyReader hands out the body bytes as the parser gets them
+type bodyReader struct {
+	rd      *Reader
+	request *Request
+	buf     []byte // parsed and not read yet
+	err     error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	r := b.request
+	for len(b.buf) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if r.isDone() {
+			return 0, io.EOF
+		}
+		err := b.rd.readUntil(r, func() bool { return len(r.Body) > 0 || r.isDone() })
+		b.buf, r.Body = r.Body, nil
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		b.err = err
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	if len(b.buf) == 0 && r.state == StateDone {
+		// the end comes with the last bytes, a reader stopping at a known
+		// length sees it too
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Buffered returns the bytes read past the last request parsed, for
+// whoever takes the connection over after an upgrade
+func (rd *Reader) Buffered() []byte {
+	buffered := append([]byte{}, rd.buf[:rd.bufLen]...)
+	rd.bufLen = 0
+	return buffered
+}
+
+// Wait returns once bytes of the next request are buffered, reading them
+// when there are none yet. It tells an idle connection apart from one
+// sending its request slowly.
+func (rd *Reader) Wait() error {
+	for rd.bufLen == 0 {
+		n, err := rd.reader.Read(rd.buf)
+		rd.bufLen = n
+		if err != nil && n == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rd *Reader) readUntil(request *Request, done func() bool) error {
+	for {
+		readN, err := request.parse(rd.buf[:rd.bufLen])
+		if err != nil {
+			request.state = StateError
+			return err
+		}
+		copy(rd.buf, rd.buf[readN:rd.bufLen])
+		rd.bufLen -= readN
+
+		if done() {
+			return nil
+		}
+
+		// what is left in the buffer is the rest of the head or of a line
+		if request.headLen+rd.bufLen >= MaxHeaderBytes {
+			request.state = StateError
+			return fmt.Errorf("%w: more than %d bytes", ErrorHeadersTooLarge, MaxHeaderBytes)
+		}
+		if rd.bufLen == len(rd.buf) {
+			// a line longer than the buffer, make room for the rest of it
+			rd.buf = append(rd.buf, make([]byte, min(len(rd.buf), MaxHeaderBytes-len(rd.buf)))...)
+		}
+		n, err := rd.reader.Read(rd.buf[rd.bufLen:])
+		if err != nil {
+			return err
+		}
+		rd.bufLen += n
+	}
+}
@@ -2,8 +2,13 @@ package request
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 	"vivalchemy/http-server-from-scratch/headers"
 )
 
@@ -13,21 +18,75 @@ const (
 	StateInit    parserState = "init"
 	StateError   parserState = "error"
 	StateHeaders parserState = "headers"
-	StateBody    parserState = "body"
-	StateDone    parserState = "done"
+	// StateHeadersDone waits for ReadBody between the headers and the body
+	StateHeadersDone parserState = "headers done"
+	StateBody        parserState = "body"
+	// the states of a chunked body, RFC 9112 section 7.1
+	StateChunkSize     parserState = "chunk size"
+	StateChunkData     parserState = "chunk data"
+	StateChunkDataDone parserState = "chunk data done"
+	StateTrailers      parserState = "trailers"
+	StateDone          parserState = "done"
+)
+
+// RequestTargetForm is one of the four request-target forms of RFC 9112 section 3.2
+type RequestTargetForm string
+
+const (
+	FormOrigin    RequestTargetForm = "origin"    // /path?query
+	FormAbsolute  RequestTargetForm = "absolute"  // http://host/path?query
+	FormAuthority RequestTargetForm = "authority" // host:port, CONNECT only
+	FormAsterisk  RequestTargetForm = "asterisk"  // *, OPTIONS only
 )
 
 type RequestLine struct {
 	Method      string
-	TargetPath  string
+	TargetPath  string // path and query, "*" for asterisk-form, empty for authority-form
 	HttpVersion string
+	TargetForm  RequestTargetForm
+	RawTarget   string // the request-target exactly as received
+	Scheme      string // absolute-form only
+	Authority   string // absolute-form and authority-form
+}
+
+// ConnInfo describes the connection a request came in on
+type ConnInfo struct {
+	// RemoteAddr is the client, taken from the forwarding headers when
+	// PeerAddr is a trusted proxy. PeerAddr is the connection's own.
+	RemoteAddr   net.Addr
+	PeerAddr     net.Addr
+	LocalAddr    net.Addr
+	ConnID       uint64    // unique per server
+	ConnStart    time.Time // when the connection was accepted
+	ConnRequests int       // requests read on the connection, this one included
 }
 
 type Request struct {
 	RequestLine
-	Headers *headers.Headers
-	Body    []byte
-	state   parserState
+	ConnInfo
+	Host string // authority of an absolute-form target, otherwise the Host header
+	// MountPrefix is the prefix a mounted router or handler was found under
+	// and StrippedPath the TargetPath below it. Outside of mounts they are
+	// empty and the full TargetPath.
+	MountPrefix  string
+	StrippedPath string
+	Params       Params // values captured by the matched route pattern
+	ctx          context.Context
+	Headers      *headers.Headers
+	Body         []byte
+	// BodyStream is the body as a stream, Body staying empty. The server
+	// sets it for the routes that stream their body, the client sends it
+	// with the Content-Length of Headers, or chunked without one.
+	BodyStream io.Reader
+	Trailers   *headers.Headers // sent after a chunked body, nil otherwise
+	state      parserState
+
+	contentLength int                   // of the body, -1 when chunked
+	chunkLeft     int                   // bytes of the current chunk still to read
+	bodyLen       int                   // bytes of the body parsed so far
+	obsFold       headers.ObsFoldPolicy // of the trailers, as of the headers
+	maxBody       int                   // ErrorBodyTooLarge past it, no limit when 0
+	headLen       int                   // bytes of the head, or of the trailers, parsed so far
 }
 
 func NewRequest() *Request {
@@ -39,8 +98,21 @@ func NewRequest() *Request {
 }
 
 var ErrorMalformedRequestLine = fmt.Errorf("malformed request line")
-var ErrorUnsupportedHttpVersion = fmt.Errorf("unsupported http verison. only HTTP/1.1 support is available")
+var ErrorUnsupportedHttpVersion = fmt.Errorf("unsupported http verison. only HTTP/1.0 and HTTP/1.1 are supported")
 var ErrorRequestInErrorState = fmt.Errorf("request is in error state")
+var ErrorMissingHost = fmt.Errorf("missing host header")
+var ErrorMultipleHost = fmt.Errorf("more than one host header")
+var ErrorInvalidHost = fmt.Errorf("invalid host header")
+var ErrorInvalidContentLength = fmt.Errorf("invalid content-length")
+var ErrorInvalidFraming = fmt.Errorf("invalid message framing")
+var ErrorUnsupportedTransferEncoding = fmt.Errorf("unsupported transfer-encoding")
+var ErrorMalformedChunk = fmt.Errorf("malformed chunk")
+var ErrorBodyTooLarge = fmt.Errorf("body too large")
+var ErrorHeadersTooLarge = fmt.Errorf("request headers too large")
+
+// ErrorHTTP2Preface is returned for the request line starting the HTTP/2
+// connection preface, for servers that hand such connections over
+var ErrorHTTP2Preface = fmt.Errorf("%w: HTTP/2 connection preface", ErrorUnsupportedHttpVersion)
 var SEPERATOR = []byte("\r\n")
 
 func parseRequestLine(b []byte) (*RequestLine, int, error) {
@@ -51,6 +123,9 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 
 	startLine := b[:idx]
 	read := idx + len(SEPERATOR)
+	if string(startLine) == "PRI * HTTP/2.0" {
+		return nil, 0, ErrorHTTP2Preface
+	}
 
 	parts := bytes.Split(startLine, []byte(" "))
 	if len(parts) != 3 {
@@ -58,21 +133,338 @@ func parseRequestLine(b []byte) (*RequestLine, int, error) {
 	}
 
 	httpParts := bytes.Split(parts[2], []byte("/"))
-	if len(httpParts) != 2 || string(httpParts[0]) != "HTTP" || string(httpParts[1]) != "1.1" {
+	if len(httpParts) != 2 || string(httpParts[0]) != "HTTP" || !isVersion(httpParts[1]) {
 		return nil, 0, ErrorMalformedRequestLine
 	}
+	if string(httpParts[1]) != "1.1" && string(httpParts[1]) != "1.0" {
+		return nil, 0, ErrorUnsupportedHttpVersion
+	}
 
 	rl := &RequestLine{
 		Method:      string(parts[0]),
-		TargetPath:  string(parts[1]),
 		HttpVersion: string(httpParts[1]),
 	}
+	if err := rl.parseTarget(string(parts[1])); err != nil {
+		return nil, 0, err
+	}
 
 	return rl, read, nil
 }
 
+// NewRequestLine builds the request line of a request that didn't come as
+// HTTP/1 text, like an HTTP/2 request from its pseudo-header fields
+func NewRequestLine(method string, target string, version string) (*RequestLine, error) {
+	if !headers.ValidFieldName(method) {
+		return nil, ErrorMalformedRequestLine
+	}
+	rl := &RequestLine{Method: method, HttpVersion: version}
+	if err := rl.parseTarget(target); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// isVersion matches the DIGIT "." DIGIT part of HTTP-version
+func isVersion(b []byte) bool {
+	return len(b) == 3 && b[0] >= '0' && b[0] <= '9' && b[1] == '.' && b[2] >= '0' && b[2] <= '9'
+}
+
+// parseTarget works out the form of the request-target and splits it into
+// the scheme, authority and path fields
+func (rl *RequestLine) parseTarget(target string) error {
+	if target == "" {
+		return ErrorMalformedRequestLine
+	}
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] == 0x7f {
+			return ErrorMalformedRequestLine
+		}
+	}
+	rl.RawTarget = target
+
+	switch {
+	case target == "*":
+		if rl.Method != "OPTIONS" {
+			return ErrorMalformedRequestLine
+		}
+		rl.TargetForm = FormAsterisk
+		rl.TargetPath = target
+
+	case rl.Method == "CONNECT":
+		// authority-form is uri-host ":" port, nothing else
+		host, port, ok := splitHostPort(target)
+		if !ok || host == "" || port == "" {
+			return ErrorMalformedRequestLine
+		}
+		rl.TargetForm = FormAuthority
+		rl.Authority = target
+
+	case target[0] == '/':
+		rl.TargetForm = FormOrigin
+		rl.TargetPath = target
+
+	default:
+		scheme, rest, ok := strings.Cut(target, "://")
+		if !ok || !isScheme(scheme) {
+			return ErrorMalformedRequestLine
+		}
+		authority, path := rest, "/"
+		if i := strings.IndexAny(rest, "/?"); i != -1 {
+			authority, path = rest[:i], rest[i:]
+			if path[0] == '?' {
+				path = "/" + path
+			}
+		}
+		if authority == "" || strings.Contains(authority, "@") {
+			return ErrorMalformedRequestLine
+		}
+		rl.TargetForm = FormAbsolute
+		rl.Scheme = strings.ToLower(scheme)
+		rl.Authority = authority
+		rl.TargetPath = path
+	}
+	return nil
+}
+
+func isScheme(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, ch := range s {
+		isAlpha := ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+		if i == 0 && !isAlpha {
+			return false
+		}
+		if !isAlpha && !(ch >= '0' && ch <= '9') && ch != '+' && ch != '-' && ch != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// splitHostPort splits host:port, keeping the brackets of an IP-literal
+func splitHostPort(s string) (string, string, bool) {
+	i := strings.LastIndexByte(s, ':')
+	if i == -1 || strings.Contains(s, "/") {
+		return "", "", false
+	}
+	host, port := s[:i], s[i+1:]
+	if strings.Contains(host, ":") && !(strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]")) {
+		return "", "", false
+	}
+	for _, ch := range port {
+		if ch < '0' || ch > '9' {
+			return "", "", false
+		}
+	}
+	return host, port, true
+}
+
+// Context returns the context of the request. The server cancels it when
+// the client hangs up, the server shuts down or the request times out.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the context of the request, middleware can use it to
+// add deadlines. It panics on a nil context.
+func (r *Request) SetContext(ctx context.Context) {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r.ctx = ctx
+}
+
+// SetValue attaches a request scoped value, read back with Value. Use a
+// key of your own unexported type, like with context.WithValue.
+func (r *Request) SetValue(key any, value any) {
+	r.ctx = context.WithValue(r.Context(), key, value)
+}
+
+// Value returns the value attached to key by SetValue, nil when unset
+func (r *Request) Value(key any) any {
+	return r.Context().Value(key)
+}
+
+// KeepAlive reports whether the client wants the connection kept open.
+// HTTP/1.1 is persistent unless it sends "Connection: close", HTTP/1.0
+// closes unless it asks for "Connection: keep-alive".
+func (r *Request) KeepAlive() bool {
+	connection, _ := r.Headers.Get("connection")
+	if r.HttpVersion == "1.0" {
+		return headers.HasToken(connection, "keep-alive")
+	}
+	return !headers.HasToken(connection, "close")
+}
+
+// Upgrade reports whether the client asks to switch protocols with
+// "Connection: upgrade", the protocols are in the Upgrade header
+func (r *Request) Upgrade() bool {
+	connection, _ := r.Headers.Get("connection")
+	_, ok := r.Headers.Get("upgrade")
+	return ok && headers.HasToken(connection, "upgrade")
+}
+
+// validateHost enforces RFC 9112 section 3.2: an HTTP/1.1 request carries
+// exactly one valid Host header
+func (r *Request) validateHost() error {
+	host, ok := r.Headers.Get("host")
+	if !ok {
+		if r.HttpVersion == "1.0" {
+			r.Host = r.Authority
+			return nil
+		}
+		return ErrorMissingHost
+	}
+	// repeated field lines are joined with commas, which a host can't contain
+	if strings.Contains(host, ",") {
+		return ErrorMultipleHost
+	}
+	if !ValidHost(host) {
+		return ErrorInvalidHost
+	}
+
+	r.Host = host
+	if r.TargetForm == FormAbsolute || r.TargetForm == FormAuthority {
+		// the target wins over the Host header
+		r.Host = r.Authority
+	}
+	return nil
+}
+
+// ValidHost reports whether s matches uri-host [ ":" port ]. The empty
+// string is valid, it is what clients send for targets without authority.
+func ValidHost(s string) bool {
+	host := s
+	if i := strings.LastIndexByte(s, ':'); i != -1 && !strings.HasSuffix(s, "]") {
+		host = s[:i]
+		for _, ch := range s[i+1:] {
+			if ch < '0' || ch > '9' {
+				return false
+			}
+		}
+	}
+
+	if strings.HasPrefix(host, "[") {
+		// IP-literal, checked loosely
+		if !strings.HasSuffix(host, "]") || len(host) < 3 {
+			return false
+		}
+		for _, ch := range host[1 : len(host)-1] {
+			if !(ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'f' || ch >= 'A' && ch <= 'F' || ch == ':' || ch == '.') {
+				return false
+			}
+		}
+		return true
+	}
+
+	// reg-name and IPv4address: unreserved / pct-encoded / sub-delims
+	for i := 0; i < len(host); i++ {
+		ch := host[i]
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case strings.IndexByte("-._~!$&'()*+;=", ch) >= 0:
+		case ch == '%' && i+2 < len(host) && isHex(host[i+1]) && isHex(host[i+2]):
+			i += 2
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(ch byte) bool {
+	return ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'f' || ch >= 'A' && ch <= 'F'
+}
+
+// framing reads how the body is delimited, RFC 9112 section 6.3. Any
+// doubt about it fails the request: a body read with other bounds than the
+// client meant would leave the rest to be parsed as the next request.
+func (r *Request) framing() error {
+	encoding, chunked := r.Headers.Get("transfer-encoding")
+	length, sized := r.Headers.Get("content-length")
+	switch {
+	case chunked && sized:
+		return fmt.Errorf("%w: both transfer-encoding and content-length", ErrorInvalidFraming)
+	case chunked:
+		if r.HttpVersion == "1.0" {
+			return fmt.Errorf("%w: transfer-encoding in an HTTP/1.0 request", ErrorInvalidFraming)
+		}
+		codings := strings.Split(encoding, ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return fmt.Errorf("%w: the last transfer coding isn't chunked", ErrorInvalidFraming)
+		}
+		if len(codings) > 1 {
+			return fmt.Errorf("%w: %q", ErrorUnsupportedTransferEncoding, encoding)
+		}
+		r.contentLength = -1
+	case sized:
+		// repeated fields are joined with commas, they must all agree
+		r.contentLength = -1
+		for _, value := range strings.Split(length, ",") {
+			n, err := parseContentLength(strings.TrimSpace(value))
+			if err != nil || r.contentLength != -1 && n != r.contentLength {
+				return fmt.Errorf("%w: %q", ErrorInvalidContentLength, length)
+			}
+			r.contentLength = n
+		}
+	}
+	return nil
+}
+
+// parseContentLength accepts digits only, no sign
+func parseContentLength(s string) (int, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, ErrorInvalidContentLength
+	}
+	return strconv.Atoi(s)
+}
+
+// ContentLength returns the length of the body, -1 for a chunked one
+func (r *Request) ContentLength() int {
+	return r.contentLength
+}
+
 func (r *Request) hasBody() bool {
-	return r.Headers.GetIntMust("content-length", 0) > 0
+	return r.contentLength != 0
+}
+
+// parseChunkSize parses a chunk-size line, its extensions are ignored
+func parseChunkSize(line []byte) (int, error) {
+	size, _, _ := bytes.Cut(line, []byte(";"))
+	size = bytes.TrimRight(size, " \t")
+	if len(size) == 0 || len(size) > 8 {
+		return 0, ErrorMalformedChunk
+	}
+	// ParseInt would take a sign
+	for _, ch := range size {
+		if !isHex(ch) {
+			return 0, ErrorMalformedChunk
+		}
+	}
+	n, err := strconv.ParseInt(string(size), 16, 64)
+	if err != nil {
+		return 0, ErrorMalformedChunk
+	}
+	return int(n), nil
+}
+
+// appendBody adds p to the body, within maxBody
+func (r *Request) appendBody(p []byte) error {
+	if r.maxBody > 0 && r.bodyLen+len(p) > r.maxBody {
+		return fmt.Errorf("%w: more than %d bytes", ErrorBodyTooLarge, r.maxBody)
+	}
+	r.Body = append(r.Body, p...)
+	r.bodyLen += len(p)
+	return nil
+}
+
+// BodyPending reports whether the body of a request is still to be read
+func (r *Request) BodyPending() bool {
+	return r.state == StateHeadersDone
 }
 
 func (r *Request) parse(data []byte) (int, error) {
@@ -97,6 +489,7 @@ outer:
 			}
 			r.RequestLine = *rl
 			read += n
+			r.headLen += n
 			r.state = StateHeaders
 
 		case StateHeaders:
@@ -108,26 +501,95 @@ outer:
 				break outer
 			}
 			read += n
+			r.headLen += n
 			if doneParsingHeaders {
+				if err := r.validateHost(); err != nil {
+					return 0, err
+				}
+				if err := r.framing(); err != nil {
+					return 0, err
+				}
 				if r.hasBody() {
-					r.state = StateBody
+					r.state = StateHeadersDone
 				} else {
 					r.state = StateDone
 				}
 			}
 
+		case StateHeadersDone:
+			break outer
+
 		case StateBody:
-			contentLength := r.Headers.GetIntMust("content-length", 0)
-			if contentLength == 0 {
+			if r.contentLength == -1 {
+				r.state = StateChunkSize
+				continue
+			}
+			if r.contentLength == 0 {
 				r.state = StateDone
 				continue
 			}
 
-			remainingToRead := min(contentLength-len(r.Body), len(currentData))
-			r.Body = append(r.Body, currentData[:remainingToRead]...)
+			remainingToRead := min(r.contentLength-r.bodyLen, len(currentData))
+			if err := r.appendBody(currentData[:remainingToRead]); err != nil {
+				return 0, err
+			}
 			read += remainingToRead
 
-			if len(r.Body) == contentLength {
+			if r.bodyLen == r.contentLength {
+				r.state = StateDone
+			}
+
+		case StateChunkSize:
+			idx := bytes.Index(currentData, SEPERATOR)
+			if idx == -1 {
+				break outer
+			}
+			size, err := parseChunkSize(currentData[:idx])
+			if err != nil {
+				return 0, err
+			}
+			read += idx + len(SEPERATOR)
+			r.chunkLeft = size
+			r.state = StateChunkData
+			if size == 0 {
+				r.Trailers = headers.NewHeaders()
+				r.Trailers.SetObsFoldPolicy(r.obsFold)
+				r.headLen = 0
+				r.state = StateTrailers
+			}
+
+		case StateChunkData:
+			n := min(r.chunkLeft, len(currentData))
+			if err := r.appendBody(currentData[:n]); err != nil {
+				return 0, err
+			}
+			read += n
+			r.chunkLeft -= n
+			if r.chunkLeft == 0 {
+				r.state = StateChunkDataDone
+			}
+
+		case StateChunkDataDone:
+			if len(currentData) < len(SEPERATOR) {
+				break outer
+			}
+			if !bytes.HasPrefix(currentData, SEPERATOR) {
+				return 0, ErrorMalformedChunk
+			}
+			read += len(SEPERATOR)
+			r.state = StateChunkSize
+
+		case StateTrailers:
+			n, done, err := r.Trailers.Parse(currentData)
+			if err != nil {
+				return 0, err
+			}
+			if n == 0 {
+				break outer
+			}
+			read += n
+			r.headLen += n
+			if done {
 				r.state = StateDone
 			}
 
@@ -144,32 +606,15 @@ func (r *Request) isDone() bool {
 	return r.state == StateDone || r.state == StateError
 }
 
+// RequestFromReader reads a whole request, body included
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	request := NewRequest()
-
-	// NOTE: the buffer could overrun a header that exceeds 1k could do that
-	// or the body
-	buf := make([]byte, 1000)
-	bufLen := 0
-	for !request.isDone() {
-		n, err := reader.Read(buf[bufLen:])
-		// TODO: what to do here?
-		if err != nil {
-			return nil, err
-		}
-
-		bufLen += n
-
-		readN, err := request.parse(buf[:bufLen])
-		if err != nil {
-			return nil, err
-		}
-
-		copy(buf, buf[readN:bufLen])
-
-		bufLen -= readN
+	requests := NewReader(reader)
+	request, err := requests.ReadHeaders()
+	if err != nil {
+		return nil, err
+	}
+	if err := requests.ReadBody(request); err != nil {
+		return nil, err
 	}
-
 	return request, nil
-
 }
@@ -1,8 +1,11 @@
 package request
 
 import (
+	"fmt"
 	"io"
+	"strings"
 	"testing"
+	"vivalchemy/http-server-from-scratch/headers"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -110,4 +113,298 @@ func TestRequestBody(t *testing.T) {
 	}
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
+
+	// Test: Chunked body with extensions and trailers
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6;name=value\r\nhello \r\n" +
+			"6\r\nworld!\r\n" +
+			"0\r\nX-Checksum: abc\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, -1, r.ContentLength())
+	checksum, _ := r.Trailers.Get("x-checksum")
+	assert.Equal(t, "abc", checksum)
+
+	// Test: Malformed chunks
+	for _, body := range []string{"x\r\nhello\r\n0\r\n\r\n", "5\r\nhello!\r\n0\r\n\r\n", "-5\r\nhello\r\n0\r\n\r\n"} {
+		reader = &chunkReader{
+			data:            "POST /submit HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" + body,
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		assert.ErrorIs(t, err, ErrorMalformedChunk, body)
+	}
+
+	// Test: Ambiguous framing is refused
+	for fields, want := range map[string]error{
+		"Content-Length: 5\r\nContent-Length: 40\r\n":         ErrorInvalidContentLength,
+		"Content-Length: -1\r\n":                              ErrorInvalidContentLength,
+		"Content-Length: +5\r\n":                              ErrorInvalidContentLength,
+		"Content-Length: five\r\n":                            ErrorInvalidContentLength,
+		"Content-Length: \r\n":                                ErrorInvalidContentLength,
+		"Content-Length: 5\r\nTransfer-Encoding: chunked\r\n": ErrorInvalidFraming,
+		"Transfer-Encoding: gzip\r\n":                         ErrorInvalidFraming,
+		"Transfer-Encoding: gzip, chunked\r\n":                ErrorUnsupportedTransferEncoding,
+	} {
+		reader = &chunkReader{
+			data:            "POST /submit HTTP/1.1\r\nHost: localhost\r\n" + fields + "\r\nhello",
+			numBytesPerRead: 3,
+		}
+		_, err = RequestFromReader(reader)
+		assert.ErrorIs(t, err, want, fields)
+	}
+
+	// Test: Repeated Content-Length fields that agree are fine
+	reader = &chunkReader{
+		data:            "POST /submit HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+}
+
+func TestRequestHttpVersion(t *testing.T) {
+	// Test: HTTP/1.0 is accepted and closes by default
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.0\r\nUser-Agent: ApacheBench/2.3\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 keep-alive opt in
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: HTTP/1.1 persistent unless closed
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: Unsupported version
+	reader = &chunkReader{
+		data:            "GET / HTTP/2.0\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrorUnsupportedHttpVersion)
+
+	// Test: Garbage version
+	reader = &chunkReader{
+		data:            "GET / HTTP/one\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrorMalformedRequestLine)
+}
+
+func TestRequestTargetForms(t *testing.T) {
+	// Test: origin-form
+	reader := &chunkReader{
+		data:            "GET /coffee?size=large HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, FormOrigin, r.TargetForm)
+	assert.Equal(t, "/coffee?size=large", r.TargetPath)
+
+	// Test: absolute-form
+	reader = &chunkReader{
+		data:            "GET http://example.com:8080/coffee?size=large HTTP/1.1\r\nHost: example.com:8080\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, FormAbsolute, r.TargetForm)
+	assert.Equal(t, "http", r.Scheme)
+	assert.Equal(t, "example.com:8080", r.Authority)
+	assert.Equal(t, "/coffee?size=large", r.TargetPath)
+	assert.Equal(t, "http://example.com:8080/coffee?size=large", r.RawTarget)
+
+	// Test: absolute-form without a path
+	reader = &chunkReader{
+		data:            "GET HTTP://example.com?q=1 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "http", r.Scheme)
+	assert.Equal(t, "/?q=1", r.TargetPath)
+
+	// Test: asterisk-form
+	reader = &chunkReader{
+		data:            "OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, FormAsterisk, r.TargetForm)
+	assert.Equal(t, "*", r.TargetPath)
+
+	// Test: asterisk-form outside of OPTIONS
+	reader = &chunkReader{
+		data:            "GET * HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrorMalformedRequestLine)
+
+	// Test: authority-form
+	reader = &chunkReader{
+		data:            "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, FormAuthority, r.TargetForm)
+	assert.Equal(t, "example.com:443", r.Authority)
+	assert.Equal(t, "", r.TargetPath)
+
+	// Test: authority-form needs a port
+	reader = &chunkReader{
+		data:            "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrorMalformedRequestLine)
+
+	// Test: not a valid target at all
+	reader = &chunkReader{
+		data:            "GET coffee HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrorMalformedRequestLine)
+}
+
+func TestReader(t *testing.T) {
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 7,
+	}
+	requests := NewReader(reader)
+
+	// Test: ReadHeaders stops before the body
+	r, err := requests.ReadHeaders()
+	require.NoError(t, err)
+	assert.Equal(t, "/upload", r.TargetPath)
+	assert.True(t, r.BodyPending())
+	assert.Empty(t, r.Body)
+
+	// Test: ReadBody reads it
+	require.NoError(t, requests.ReadBody(r))
+	assert.False(t, r.BodyPending())
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: Bytes past the body belong to the next request
+	r, err = requests.ReadHeaders()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.TargetPath)
+	assert.False(t, r.BodyPending())
+	require.NoError(t, requests.ReadBody(r))
+
+	// Test: BodyReader streams the body, chunked or not, and leaves the
+	// next request
+	reader = &chunkReader{
+		data: "POST /a HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n" +
+			"POST /b HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc" +
+			"POST /c HTTP/1.1\r\nHost: localhost\r\nContent-Length: 9\r\n\r\ncut",
+		numBytesPerRead: 4,
+	}
+	requests = NewReader(reader)
+	for _, want := range []string{"hello world", "abc"} {
+		r, err = requests.ReadHeaders()
+		require.NoError(t, err)
+		body, err := io.ReadAll(requests.BodyReader(r))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(body))
+		assert.Empty(t, r.Body)
+	}
+
+	// Test: A body cut short is an unexpected EOF
+	r, err = requests.ReadHeaders()
+	require.NoError(t, err)
+	_, err = io.ReadAll(requests.BodyReader(r))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: ObsFoldPolicy applies to the headers and trailers read
+	requests = NewReader(&chunkReader{
+		data: "POST / HTTP/1.1\r\nHost: localhost\r\nX-Folded: a\r\n b\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"0\r\nX-Sum: c\r\n d\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	requests.ObsFoldPolicy = headers.ObsFoldReplace
+	r, err = requests.ReadHeaders()
+	require.NoError(t, err)
+	folded, _ := r.Headers.Get("x-folded")
+	assert.Equal(t, "a b", folded)
+	require.NoError(t, requests.ReadBody(r))
+	folded, _ = r.Trailers.Get("x-sum")
+	assert.Equal(t, "c d", folded)
+	requests = NewReader(&chunkReader{data: "GET / HTTP/1.1\r\nX-Folded: a\r\n b\r\n\r\n", numBytesPerRead: 3})
+	_, err = requests.ReadHeaders()
+	assert.ErrorIs(t, err, headers.ErrorObsoleteLineFolding)
+
+	// Test: Wait returns once the next request started, EOF without one
+	requests = NewReader(&chunkReader{data: "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", numBytesPerRead: 2})
+	require.NoError(t, requests.Wait())
+	require.NoError(t, requests.Wait())
+	r, err = requests.ReadHeaders()
+	require.NoError(t, err)
+	assert.Equal(t, "/", r.TargetPath)
+	assert.ErrorIs(t, requests.Wait(), io.EOF)
+
+	// Test: Lines longer than the buffer
+	long := "/" + strings.Repeat("a", 3000)
+	reader = &chunkReader{data: "GET " + long + " HTTP/1.1\r\nHost: localhost\r\n\r\n", numBytesPerRead: 512}
+	r, err = NewReader(reader).ReadHeaders()
+	require.NoError(t, err)
+	assert.Equal(t, long, r.TargetPath)
+
+	// Test: Heads past MaxHeaderBytes, in one line or many
+	filler := ""
+	for i := range MaxHeaderBytes / 1000 {
+		filler += fmt.Sprintf("X-Filler-%d: %s\r\n", i, strings.Repeat("a", 1000))
+	}
+	for _, head := range []string{
+		"GET /" + strings.Repeat("a", MaxHeaderBytes) + " HTTP/1.1\r\n",
+		"GET / HTTP/1.1\r\n" + filler,
+	} {
+		reader = &chunkReader{data: head + "Host: localhost\r\n\r\n", numBytesPerRead: 1 << 16}
+		_, err = NewReader(reader).ReadHeaders()
+		assert.ErrorIs(t, err, ErrorHeadersTooLarge)
+	}
+
+	// Test: Trailers past MaxHeaderBytes
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n" +
+			filler + "\r\n",
+		numBytesPerRead: 1 << 16,
+	}
+	requests = NewReader(reader)
+	r, err = requests.ReadHeaders()
+	require.NoError(t, err)
+	assert.ErrorIs(t, requests.ReadBody(r), ErrorHeadersTooLarge)
 }
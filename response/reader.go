@@ -0,0 +1,290 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"vivalchemy/http-server-from-scratch/headers"
+)
+
+var rn = []byte("\r\n")
+var ErrorMalformedStatusLine = fmt.Errorf("malformed status line")
+var ErrorMalformedResponse = fmt.Errorf("malformed response")
+
+// MaxHeaderBytes bounds the status line and headers, or the trailers, of a
+// response read by a Reader
+const MaxHeaderBytes = 1 << 20
+
+// Response is a response read from a connection, the client side
+// counterpart of request.Request
+type Response struct {
+	HttpVersion string
+	StatusCode  StatusCode
+	Reason      string
+	Headers     *headers.Headers
+	// Trailers holds the trailer fields of a chunked body once it was read
+	Trailers *headers.Headers
+	Body     []byte
+}
+
+// Reader reads responses from a connection in two steps, the head and then
+// the body, which can be streamed. Bytes read past a response are kept for
+// the next one.
+type Reader struct {
+	reader *bufio.Reader
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReader(reader)}
+}
+
+// ReadHeaders reads the status line and the headers of the next response,
+// interim 1xx responses included. Obsolete line folding is replaced by a
+// space, as a client can't refuse it.
+func (rd *Reader) ReadHeaders() (*Response, error) {
+	head, err := rd.readLines()
+	if err != nil {
+		return nil, err
+	}
+
+	statusLine, fields, _ := bytes.Cut(head, rn)
+	res, err := parseStatusLine(string(statusLine))
+	if err != nil {
+		return nil, err
+	}
+	res.Headers.SetObsFoldPolicy(headers.ObsFoldReplace)
+	if _, done, err := res.Headers.Parse(fields); err != nil || !done {
+		return nil, fmt.Errorf("%w: %v", ErrorMalformedResponse, err)
+	}
+	return res, nil
+}
+
+// parseStatusLine reads HTTP-version SP status-code SP [ reason-phrase ]
+func parseStatusLine(line string) (*Response, error) {
+	version, rest, ok := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(rest, " ")
+	status, err := strconv.Atoi(code)
+	if !ok || version != "HTTP/1.1" && version != "HTTP/1.0" || len(code) != 3 || err != nil || status < 100 {
+		return nil, fmt.Errorf("%w: %q", ErrorMalformedStatusLine, line)
+	}
+	return &Response{
+		HttpVersion: strings.TrimPrefix(version, "HTTP/"),
+		StatusCode:  StatusCode(status),
+		Reason:      reason,
+		Headers:     headers.NewHeaders(),
+		Trailers:    headers.NewHeaders(),
+	}, nil
+}
+
+// readLines reads up to and including the empty line ending a head or the
+// trailers
+func (rd *Reader) readLines() ([]byte, error) {
+	lines := []byte{}
+	for {
+		line, err := rd.reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			err = fmt.Errorf("%w: line too long", ErrorMalformedResponse)
+		}
+		if err != nil {
+			if len(lines) > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		lines = append(lines, line...)
+		if len(lines) > MaxHeaderBytes {
+			return nil, fmt.Errorf("%w: headers too large", ErrorMalformedResponse)
+		}
+		if bytes.Equal(line, rn) {
+			return lines, nil
+		}
+	}
+}
+
+// BodyReader returns the body of res to read it as a stream, framed as RFC
+// 9112 section 6.3 says for a response to method. A close delimited body
+// ends with the connection, see Delimited.
+func (rd *Reader) BodyReader(res *Response, method string) (io.Reader, error) {
+	if !res.HasBody(method) {
+		return bytes.NewReader(nil), nil
+	}
+	if encoding, ok := res.Headers.Get("transfer-encoding"); ok {
+		codings := strings.Split(encoding, ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return rd.reader, nil
+		}
+		return &chunkedReader{rd: rd, trailers: res.Trailers}, nil
+	}
+	if value, ok := res.Headers.Get("content-length"); ok {
+		length, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("%w: content-length %q", ErrorMalformedResponse, value)
+		}
+		return &lengthReader{r: rd.reader, remaining: length}, nil
+	}
+	return rd.reader, nil
+}
+
+// ReadBody reads the whole body of res into res.Body
+func (rd *Reader) ReadBody(res *Response, method string) error {
+	body, err := rd.BodyReader(res, method)
+	if err != nil {
+		return err
+	}
+	res.Body, err = io.ReadAll(body)
+	return err
+}
+
+// HasBody reports whether a response to method has a body: HEAD requests,
+// 1xx, 204 and 304 responses don't
+func (res *Response) HasBody(method string) bool {
+	status := res.StatusCode
+	return method != "HEAD" && status >= 200 && status != StatusNoContent && status != StatusNotModified
+}
+
+// Delimited reports whether the end of the body of res is known without
+// the connection closing, so the connection can carry another response
+func (res *Response) Delimited(method string) bool {
+	if !res.HasBody(method) {
+		return true
+	}
+	if encoding, ok := res.Headers.Get("transfer-encoding"); ok {
+		codings := strings.Split(encoding, ",")
+		return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+	}
+	_, ok := res.Headers.Get("content-length")
+	return ok
+}
+
+// KeepAlive reports whether the server keeps the connection open after the
+// response, like request.Request.KeepAlive does for the client
+func (res *Response) KeepAlive() bool {
+	connection, _ := res.Headers.Get("connection")
+	if res.HttpVersion == "1.0" {
+		return headers.HasToken(connection, "keep-alive")
+	}
+	return !headers.HasToken(connection, "close")
+}
+
+// ResponseFromReader reads a whole response, body included, as the answer
+// to a GET request. Interim 1xx responses are returned as they come.
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	responses := NewReader(reader)
+	res, err := responses.ReadHeaders()
+	if err != nil {
+		return nil, err
+	}
+	if err := responses.ReadBody(res, "GET"); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// lengthReader reads a Content-Length body, failing when the connection
+// ends before it does
+type lengthReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (lr *lengthReader) Read(p []byte) (int, error) {
+	if lr.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > lr.remaining {
+		p = p[:lr.remaining]
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && lr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// chunkedReader decodes a chunked body, its trailer fields end up in
+// trailers once it returned io.EOF. Chunk extensions are ignored.
+type chunkedReader struct {
+	rd        *Reader
+	trailers  *headers.Headers
+	remaining int64 // left in the current chunk
+	done      bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+	if cr.remaining == 0 {
+		size, err := cr.chunkSize()
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			if err := cr.readTrailers(); err != nil {
+				return 0, err
+			}
+			cr.done = true
+			return 0, io.EOF
+		}
+		cr.remaining = size
+	}
+
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.rd.reader.Read(p)
+	cr.remaining -= int64(n)
+	if cr.remaining == 0 && err == nil {
+		err = cr.crlf()
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (cr *chunkedReader) chunkSize() (int64, error) {
+	line, err := cr.rd.reader.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	size, _, _ := strings.Cut(strings.TrimSuffix(string(line), "\r\n"), ";")
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: chunk size %q", ErrorMalformedResponse, line)
+	}
+	return n, nil
+}
+
+func (cr *chunkedReader) crlf() error {
+	line, err := cr.rd.reader.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(line, rn) {
+		return fmt.Errorf("%w: chunk not followed by CRLF", ErrorMalformedResponse)
+	}
+	return nil
+}
+
+func (cr *chunkedReader) readTrailers() error {
+	fields, err := cr.rd.readLines()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if _, _, err := cr.trailers.Parse(fields); err != nil {
+		return fmt.Errorf("%w: trailers: %v", ErrorMalformedResponse, err)
+	}
+	return nil
+}
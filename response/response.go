@@ -1,70 +1,342 @@
 package response
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"net"
 	"vivalchemy/http-server-from-scratch/headers"
 )
 
-type Response struct {
-}
-
 type StatusCode int
 
 const (
-	StatusOk                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
-	StatusNotFound            StatusCode = 404
+	StatusContinue                StatusCode = 100
+	StatusSwitchingProtocols      StatusCode = 101
+	StatusOk                      StatusCode = 200
+	StatusCreated                 StatusCode = 201
+	StatusNoContent               StatusCode = 204
+	StatusMovedPermanently        StatusCode = 301
+	StatusFound                   StatusCode = 302
+	StatusSeeOther                StatusCode = 303
+	StatusNotModified             StatusCode = 304
+	StatusTemporaryRedirect       StatusCode = 307
+	StatusPermanentRedirect       StatusCode = 308
+	StatusBadRequest              StatusCode = 400
+	StatusInternalServerError     StatusCode = 500
+	StatusNotImplemented          StatusCode = 501
+	StatusUnauthorized            StatusCode = 401
+	StatusForbidden               StatusCode = 403
+	StatusNotFound                StatusCode = 404
+	StatusMethodNotAllowed        StatusCode = 405
+	StatusRequestTimeout          StatusCode = 408
+	StatusPreconditionFailed      StatusCode = 412
+	StatusContentTooLarge         StatusCode = 413
+	StatusExpectationFailed       StatusCode = 417
+	StatusUpgradeRequired         StatusCode = 426
+	StatusTooManyRequests         StatusCode = 429
+	StatusHeaderFieldsTooLarge    StatusCode = 431
+	StatusBadGateway              StatusCode = 502
+	StatusServiceUnavailable      StatusCode = 503
+	StatusGatewayTimeout          StatusCode = 504
+	StatusHTTPVersionNotSupported StatusCode = 505
 )
 
+var statusText = map[StatusCode]string{
+	StatusContinue:                "Continue",
+	StatusSwitchingProtocols:      "Switching Protocols",
+	StatusOk:                      "OK",
+	StatusCreated:                 "Created",
+	StatusNoContent:               "No Content",
+	StatusMovedPermanently:        "Moved Permanently",
+	StatusFound:                   "Found",
+	StatusSeeOther:                "See Other",
+	StatusNotModified:             "Not Modified",
+	StatusTemporaryRedirect:       "Temporary Redirect",
+	StatusPermanentRedirect:       "Permanent Redirect",
+	StatusBadRequest:              "Bad Request",
+	StatusUnauthorized:            "Unauthorized",
+	StatusForbidden:               "Forbidden",
+	StatusNotFound:                "Not Found",
+	StatusMethodNotAllowed:        "Method Not Allowed",
+	StatusRequestTimeout:          "Request Timeout",
+	StatusPreconditionFailed:      "Precondition Failed",
+	StatusContentTooLarge:         "Content Too Large",
+	StatusExpectationFailed:       "Expectation Failed",
+	StatusUpgradeRequired:         "Upgrade Required",
+	StatusTooManyRequests:         "Too Many Requests",
+	StatusHeaderFieldsTooLarge:    "Request Header Fields Too Large",
+	StatusInternalServerError:     "Internal Server Error",
+	StatusNotImplemented:          "Not Implemented",
+	StatusBadGateway:              "Bad Gateway",
+	StatusServiceUnavailable:      "Service Unavailable",
+	StatusGatewayTimeout:          "Gateway Timeout",
+	StatusHTTPVersionNotSupported: "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase of a status code, "" when unknown
+func StatusText(statusCode StatusCode) string {
+	return statusText[statusCode]
+}
+
 func GetDefaultHeaders(contentLen int) *headers.Headers {
 	h := headers.NewHeaders()
 	h.Set("Content-Length", fmt.Sprintf("%d", contentLen))
-	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 
 	return h
 }
 
 type Writer struct {
-	writer io.Writer
+	writer      io.Writer
+	status      StatusCode // 0 until the status line is written
+	httpVersion string
+	dechunk     bool // chunked body requested for an HTTP/1.0 client, sent raw instead
+	keepAlive   bool // the server is willing to keep the connection open
+	closing     bool // set by WriteHeaders, the connection closes after the response
+	headersDone bool
+	hijacker    Hijacker
+	backend     Backend
+}
+
+// Backend frames a response its own way instead of as HTTP/1.1 text, like
+// HTTP/2 does with its streams
+type Backend interface {
+	// WriteHeader sends the status with the fields, 1xx ones as interim
+	// responses
+	WriteHeader(status StatusCode, h *headers.Headers) error
+	Write(p []byte) (int, error)
+	// WriteTrailers ends the response with trailer fields
+	WriteTrailers(h *headers.Headers) error
+}
+
+// NewBackendWriter returns a Writer handing the response to backend. The
+// fields specific to an HTTP/1.1 connection, like Connection and
+// Transfer-Encoding, are dropped and the connection can't be hijacked.
+// Closing reports a response that was never started or cut short.
+func NewBackendWriter(backend Backend) *Writer {
+	return &Writer{writer: backend, httpVersion: "1.1", keepAlive: true, backend: backend}
+}
+
+// connectionFields are only meaningful on an HTTP/1.1 connection
+var connectionFields = []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"}
+
+var ErrorNotHijackable = fmt.Errorf("connection can't be hijacked")
+var ErrorHijacked = fmt.Errorf("connection was hijacked")
+
+// Hijacker hands the connection of a response over, see Writer.Hijack
+type Hijacker func() (net.Conn, *bufio.Reader, error)
+
+// SetHijacker is called by the server for the requests whose connection
+// can be taken over
+func (w *Writer) SetHijacker(hijacker Hijacker) {
+	w.hijacker = hijacker
+}
+
+// Hijack takes the connection over from the server, which then neither
+// writes to nor closes it. The reader holds the bytes the server had read
+// ahead. Only CONNECT requests and those asking for "Connection: upgrade"
+// can be hijacked, anything written through the Writer before is sent
+// first and writing through it after fails with ErrorHijacked.
+func (w *Writer) Hijack() (net.Conn, *bufio.Reader, error) {
+	if w.hijacker == nil {
+		return nil, nil, ErrorNotHijackable
+	}
+	conn, reader, err := w.hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacker = nil
+	w.writer = hijackedWriter{}
+	return conn, reader, nil
+}
+
+type hijackedWriter struct{}
+
+func (hijackedWriter) Write(p []byte) (int, error) {
+	return 0, ErrorHijacked
 }
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{writer: w}
+	return &Writer{writer: w, httpVersion: "1.1", keepAlive: true}
+}
+
+// SetKeepAlive tells the writer whether the connection may stay open after
+// the response. When it can't, WriteHeaders sends "Connection: close".
+// Once the headers are written it still closes the connection, for
+// responses cut short.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+	if !keepAlive && w.headersDone {
+		w.closing = true
+	}
+}
+
+// Closing reports whether the connection has to close after the response:
+// it is close delimited, says "Connection: close", or its headers were
+// never written.
+func (w *Writer) Closing() bool {
+	return !w.headersDone || w.closing
+}
+
+// SetHttpVersion tells the writer which HTTP version the client spoke.
+// HTTP/1.0 clients can't decode chunked bodies, so for them the
+// Transfer-Encoding is dropped and the body is delimited by closing the
+// connection.
+func (w *Writer) SetHttpVersion(version string) {
+	w.httpVersion = version
+}
+
+// Status returns the status written by WriteStatusLine, 0 before that
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// WriteContinue sends the interim 100 Continue response, telling a client
+// that sent Expect: 100-continue to go on with the body. It doesn't count
+// as the start of the response.
+func (w *Writer) WriteContinue() error {
+	if w.backend != nil {
+		return w.backend.WriteHeader(StatusContinue, headers.NewHeaders())
+	}
+	_, err := w.writer.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	return err
 }
 
+// WriteStatusLine writes the status line of the response. Any three digit
+// status is accepted, the ones without a known reason phrase are sent with
+// an empty one, as a proxy relaying them needs.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	var statusLine []byte
-	switch statusCode {
-	case StatusOk:
-		statusLine = []byte("HTTP/1.1 200 OK\r\n")
-	case StatusBadRequest:
-		statusLine = []byte("HTTP/1.1 400 Bad Request\r\n")
-	case StatusInternalServerError:
-		statusLine = []byte("HTTP/1.1 500 Internal Server Error\r\n")
-	case StatusNotFound:
-		statusLine = []byte("HTTP/1.1 404 Not Found\r\n")
-	default:
-		return fmt.Errorf("unrecognized error code")
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("unrecognized status code %d", statusCode)
+	}
+	text := statusText[statusCode]
+	if w.backend != nil {
+		// sent along with the headers
+		w.status = statusCode
+		return nil
 	}
+	statusLine := fmt.Appendf(nil, "HTTP/1.1 %d %s\r\n", statusCode, text)
 
 	_, err := w.writer.Write(statusLine)
+	if err == nil {
+		w.status = statusCode
+	}
 	return err
 }
 
+// WriteHeaders writes the field lines followed by the empty line. Nothing is
+// written when a name or value is invalid, the validation error is returned.
 func (w *Writer) WriteHeaders(h headers.Headers) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	if w.backend != nil {
+		return w.writeBackendHeaders(h)
+	}
+
+	fields := h.GetAll()
+	_, chunked := fields["transfer-encoding"]
+	_, sized := fields["content-length"]
+	if w.httpVersion == "1.0" && chunked {
+		w.dechunk = true
+	}
+	// HTTP/1.0 has implicit close semantics, and without a length or
+	// chunked framing the end of the body is the end of the connection
+	// 1xx, 204 and 304 responses have no body at all
+	bodyless := w.status >= 100 && w.status < 200 || w.status == StatusNoContent || w.status == StatusNotModified
+	closing := !w.keepAlive || w.httpVersion == "1.0" || !chunked && !sized && !bodyless ||
+		headers.HasToken(fields["connection"], "close")
+
 	var err error = nil
 	headerStr := []byte{}
-	for k, v := range h.GetAll() {
+	for k, v := range fields {
+		if w.httpVersion == "1.0" {
+			switch k {
+			case "transfer-encoding", "trailer", "trailers":
+				continue
+			}
+		}
+		if k == "connection" && closing {
+			v = "close"
+		}
 		headerStr = fmt.Appendf(headerStr, "%s: %s\r\n", k, v)
 	}
+	if _, ok := fields["connection"]; !ok && closing {
+		headerStr = fmt.Append(headerStr, "connection: close\r\n")
+	}
 	headerStr = fmt.Append(headerStr, "\r\n")
 	_, err = w.writer.Write(headerStr)
+	if err == nil {
+		w.headersDone = true
+		w.closing = closing
+	}
 	return err
 }
 
+func (w *Writer) writeBackendHeaders(h headers.Headers) error {
+	out := headers.NewHeaders()
+	for k, v := range h.GetAll() {
+		out.Replace(k, v)
+	}
+	for _, name := range connectionFields {
+		out.Delete(name)
+	}
+	if err := w.backend.WriteHeader(w.status, out); err != nil {
+		return err
+	}
+	if w.status >= 200 {
+		w.headersDone = true
+		w.closing = !w.keepAlive
+	}
+	return nil
+}
+
 func (w *Writer) WriteBody(p []byte) (int, error) {
 	return w.writer.Write(p)
 }
+
+// WriteChunkedBody writes p as a single chunk of a chunked body
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.dechunk || w.backend != nil {
+		return w.writer.Write(p)
+	}
+	if len(p) == 0 {
+		// a zero sized chunk would end the body
+		return 0, nil
+	}
+
+	chunk := fmt.Appendf(nil, "%x\r\n", len(p))
+	chunk = append(chunk, p...)
+	chunk = append(chunk, "\r\n"...)
+	if _, err := w.writer.Write(chunk); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteChunkedBodyDone writes the last chunk followed by the trailers,
+// pass nil when there are none
+func (w *Writer) WriteChunkedBodyDone(trailers *headers.Headers) error {
+	if w.dechunk {
+		return nil
+	}
+	if trailers == nil {
+		trailers = headers.NewHeaders()
+	}
+	if err := trailers.Validate(); err != nil {
+		return err
+	}
+	if w.backend != nil {
+		return w.backend.WriteTrailers(trailers)
+	}
+
+	out := []byte("0\r\n")
+	for k, v := range trailers.GetAll() {
+		out = fmt.Appendf(out, "%s: %s\r\n", k, v)
+	}
+	out = append(out, "\r\n"...)
+	_, err := w.writer.Write(out)
+	return err
+}
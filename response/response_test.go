@@ -0,0 +1,99 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkedBody(t *testing.T) {
+	// Test: HTTP/1.1 gets chunk framing and trailers
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	h := GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Delete("Content-Type")
+	h.Delete("Connection")
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	trailers := GetDefaultHeaders(0)
+	trailers.Delete("Content-Type")
+	trailers.Delete("Connection")
+	require.NoError(t, w.WriteChunkedBodyDone(trailers))
+	assert.Equal(t, "transfer-encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\ncontent-length: 0\r\n\r\n", buf.String())
+
+	// Test: HTTP/1.0 gets a raw, close delimited body
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetHttpVersion("1.0")
+	h = GetDefaultHeaders(0)
+	h.Delete("Content-Length")
+	h.Delete("Content-Type")
+	h.Delete("Connection")
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(*h))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteChunkedBodyDone(nil))
+	assert.Equal(t, "connection: close\r\n\r\nhello", buf.String())
+
+	// Test: Invalid values are refused before anything is written
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	h = GetDefaultHeaders(0)
+	h.Set("Location", "/\r\nSet-Cookie: admin=1")
+	require.Error(t, w.WriteHeaders(*h))
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestResponseFromReader(t *testing.T) {
+	// Test: Content-Length bodies
+	res, err := ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5\r\nX-Folded: a\r\n b\r\n\r\nhelloextra"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusOk, res.StatusCode)
+	assert.Equal(t, "OK", res.Reason)
+	assert.Equal(t, "1.1", res.HttpVersion)
+	assert.Equal(t, "hello", string(res.Body))
+	folded, _ := res.Headers.Get("x-folded")
+	assert.Equal(t, "a b", folded)
+
+	// Test: Chunked bodies with trailers, extensions are ignored
+	res, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5;name=value\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(res.Body))
+	checksum, _ := res.Trailers.Get("x-checksum")
+	assert.Equal(t, "abc", checksum)
+
+	// Test: Bodies without framing end with the stream, an empty reason is fine
+	res, err = ResponseFromReader(strings.NewReader("HTTP/1.0 299 \r\n\r\nuntil the end"))
+	require.NoError(t, err)
+	assert.Equal(t, StatusCode(299), res.StatusCode)
+	assert.Equal(t, "until the end", string(res.Body))
+	assert.False(t, res.KeepAlive())
+	assert.False(t, res.Delimited("GET"))
+
+	// Test: Responses without body, whatever their headers say
+	res, err = ResponseFromReader(strings.NewReader("HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, res.Body)
+	assert.True(t, res.Delimited("GET"))
+
+	// Test: Malformed and truncated responses
+	for _, raw := range []string{"HTTP/1.1 20 OK\r\n\r\n", "HTTP/2 200 OK\r\n\r\n", "HTTP/1.1\r\n\r\n"} {
+		_, err = ResponseFromReader(strings.NewReader(raw))
+		assert.ErrorIs(t, err, ErrorMalformedStatusLine, raw)
+	}
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n"))
+	assert.ErrorIs(t, err, ErrorMalformedResponse)
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
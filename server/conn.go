@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+	"vivalchemy/http-server-from-scratch/request"
+)
+
+// conn is a connection accepted by the server
+type conn struct {
+	net.Conn
+	id       uint64
+	start    time.Time
+	requests atomic.Int64 // requests read so far, HTTP/2 streams read them concurrently
+}
+
+// next counts a request read on the connection and returns the connection
+// metadata for it
+func (c *conn) next() request.ConnInfo {
+	requests := c.requests.Add(1)
+	return request.ConnInfo{
+		RemoteAddr:   c.RemoteAddr(),
+		PeerAddr:     c.RemoteAddr(),
+		LocalAddr:    c.LocalAddr(),
+		ConnID:       c.id,
+		ConnStart:    c.start,
+		ConnRequests: int(requests),
+	}
+}
+
+// isConnError tells errors of the connection itself, like the client
+// hanging up, from malformed requests that get a 400
+func isConnError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &netErr)
+}
+
+// aLongTimeAgo is a read deadline in the past, it unblocks a pending read
+var aLongTimeAgo = time.Unix(1, 0)
+
+// setReadDeadline bounds the next reads of conn by timeout, none when 0.
+// The deadline Close set stays once the server is closed.
+func (s *Server) setReadDeadline(conn net.Conn, timeout time.Duration) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetReadDeadline(deadline)
+	if s.ctx.Err() != nil {
+		conn.SetReadDeadline(aLongTimeAgo)
+	}
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// connReader reads the requests from a connection. While a handler runs it
+// keeps a read pending in the background, so a client hanging up is
+// noticed and can cancel the request context. Bytes that read gets are
+// handed to the next Read.
+type connReader struct {
+	conn io.Reader
+	buf  []byte        // read ahead by the background read
+	err  error         // error of the background read, returned by the next Read
+	done chan struct{} // closed when the background read returns, nil when none runs
+}
+
+func newConnReader(conn io.Reader) *connReader {
+	return &connReader{conn: conn}
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.abortBackgroundRead()
+	if len(cr.buf) > 0 {
+		n := copy(p, cr.buf)
+		cr.buf = cr.buf[n:]
+		return n, nil
+	}
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	return cr.conn.Read(p)
+}
+
+// startBackgroundRead waits for data or an error on the connection and
+// calls onHangup when the client is gone
+func (cr *connReader) startBackgroundRead(onHangup func()) {
+	if cr.done != nil || cr.err != nil {
+		return
+	}
+	cr.done = make(chan struct{})
+	go func() {
+		defer close(cr.done)
+		var b [1]byte
+		n, err := cr.conn.Read(b[:])
+		if n == 1 {
+			cr.buf = append(cr.buf, b[0])
+		}
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cr.err = err
+			onHangup()
+		}
+	}()
+}
+
+// abortBackgroundRead stops the background read and waits for it. Without
+// read deadlines on the connection it can only wait for the read to end.
+func (cr *connReader) abortBackgroundRead() {
+	if cr.done == nil {
+		return
+	}
+	if conn, ok := cr.conn.(readDeadliner); ok {
+		conn.SetReadDeadline(aLongTimeAgo)
+		<-cr.done
+		conn.SetReadDeadline(time.Time{})
+	} else {
+		<-cr.done
+	}
+	cr.done = nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+var (
+	HandlerErrorExpectationFailed HandlerError = fmt.Errorf("expectation failed")
+	HandlerErrorContentTooLarge   HandlerError = fmt.Errorf("content too large")
+)
+
+// readBody reads the body of a request a route was found for, or sets
+// BodyStream for the handler to read it when stream is set. A request
+// sending Expect: 100-continue gets the interim response once MaxBodySize
+// and CheckContinue accept it. A rejected request is answered through the
+// BadRequestHandler without reading its body, and readBody returns false.
+func (s *Server) readBody(requests *request.Reader, w *response.Writer, r *request.Request, stream bool) bool {
+	if !r.BodyPending() {
+		return true
+	}
+
+	expect, expecting := r.Headers.Get("Expect")
+	if r.HttpVersion == "1.0" {
+		// HTTP/1.0 clients don't wait for 100 Continue, RFC 9110 section 10.1.1
+		expecting = false
+	}
+	if expecting && !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+		err := fmt.Errorf("%w: %q", HandlerErrorExpectationFailed, expect)
+		errorHandler(s.BadRequestHandler)(w, r, response.StatusExpectationFailed, err)
+		return false
+	}
+
+	if err := s.checkBody(r, expecting); err != nil {
+		s.rejectBody(w, r, err)
+		return false
+	}
+
+	if expecting {
+		if err := w.WriteContinue(); err != nil {
+			return false
+		}
+	}
+	if stream {
+		r.BodyStream = requests.BodyReader(r)
+		return true
+	}
+	if err := requests.ReadBody(r); err != nil {
+		errorHandler(s.BadRequestHandler)(w, r, badRequestStatus(err), err)
+		return false
+	}
+	return true
+}
+
+// rejectBody answers a request checkBody refused through the
+// BadRequestHandler
+func (s *Server) rejectBody(w *response.Writer, r *request.Request, err error) {
+	status := response.StatusExpectationFailed
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		status = httpErr.Status
+	} else if errors.Is(err, HandlerErrorContentTooLarge) {
+		status = response.StatusContentTooLarge
+	}
+	errorHandler(s.BadRequestHandler)(w, r, status, err)
+}
+
+// checkBody runs the checks deciding on a body before it is read
+func (s *Server) checkBody(r *request.Request, expecting bool) error {
+	// chunked bodies are held to MaxBodySize while they are read
+	length := r.ContentLength()
+	if s.MaxBodySize > 0 && length > s.MaxBodySize {
+		return fmt.Errorf("%w: %d bytes, at most %d", HandlerErrorContentTooLarge, length, s.MaxBodySize)
+	}
+	if expecting && s.CheckContinue != nil {
+		return s.CheckContinue(r)
+	}
+	return nil
+}
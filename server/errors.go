@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+// ErrorHandler answers a request the server couldn't pass to a route
+// handler, or whose handler failed. status is the code the server would
+// send and err the cause, like request.ErrorMalformedRequestLine or
+// HandlerErrorNotFound. req is nil when the request couldn't be parsed.
+type ErrorHandler func(res *response.Writer, req *request.Request, status response.StatusCode, err error)
+
+// MethodNotAllowedError is the error given to the MethodNotAllowedHandler,
+// it matches HandlerErrorMethodNotAllowed with errors.Is
+type MethodNotAllowedError struct {
+	Allowed []string // methods the path has routes for, for the Allow header
+}
+
+func (e *MethodNotAllowedError) Error() string {
+	return fmt.Sprintf("%v, allowed: %s", HandlerErrorMethodNotAllowed, strings.Join(e.Allowed, ", "))
+}
+
+func (e *MethodNotAllowedError) Unwrap() error {
+	return HandlerErrorMethodNotAllowed
+}
+
+// badRequestStatus maps a parse error to the status sent back
+func badRequestStatus(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrorUnsupportedHttpVersion):
+		return response.StatusHTTPVersionNotSupported
+	case errors.Is(err, request.ErrorUnsupportedTransferEncoding):
+		return response.StatusNotImplemented
+	case errors.Is(err, request.ErrorBodyTooLarge):
+		return response.StatusContentTooLarge
+	case errors.Is(err, request.ErrorHeadersTooLarge):
+		return response.StatusHeaderFieldsTooLarge
+	}
+	return response.StatusBadRequest
+}
+
+// allowed lists the methods that have a route for path
+func (s *Server) allowed(router *Router, path string) []string {
+	allowed := []string{}
+	for _, method := range s.methods() {
+		if _, _, err := router.tree.find(HTTPMethod(method), path); err == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// errorHandler returns the hook or RenderError when it is unset
+func errorHandler(hook ErrorHandler) ErrorHandler {
+	if hook == nil {
+		return RenderError
+	}
+	return hook
+}
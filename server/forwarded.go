@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"vivalchemy/http-server-from-scratch/request"
+)
+
+// SetTrustedProxies lists the proxies, as CIDRs or single addresses, whose
+// Forwarded and X-Forwarded-For headers set the request's RemoteAddr
+func (s *Server) SetTrustedProxies(proxies ...string) error {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	s.trustedProxies = nets
+	return nil
+}
+
+func (s *Server) trusted(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range s.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr walks the forwarding chain from the peer back towards the
+// client, stopping at the first hop that isn't a trusted proxy. Hops that
+// can't be read, like "unknown" or obfuscated ones, stop the walk too.
+func (s *Server) clientAddr(r *request.Request) net.Addr {
+	addr := r.PeerAddr
+	if !s.trusted(addr) {
+		return addr
+	}
+
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseNode(hops[i])
+		if hop == nil {
+			return addr
+		}
+		addr = hop
+		if !s.trusted(addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+// forwardedFor returns the client side of each hop, oldest first. Forwarded
+// (RFC 7239) wins over X-Forwarded-For when a request has both.
+func forwardedFor(r *request.Request) []string {
+	if value, ok := r.Headers.Get("Forwarded"); ok {
+		hops := []string{}
+		for _, element := range splitQuoted(value, ',') {
+			node := ""
+			for _, pair := range splitQuoted(element, ';') {
+				name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(name, "for") {
+					node = strings.Trim(value, `"`)
+				}
+			}
+			hops = append(hops, node)
+		}
+		return hops
+	}
+
+	if value, ok := r.Headers.Get("X-Forwarded-For"); ok {
+		hops := strings.Split(value, ",")
+		for i := range hops {
+			hops[i] = strings.TrimSpace(hops[i])
+		}
+		return hops
+	}
+	return nil
+}
+
+// splitQuoted splits s on sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	parts := []string{}
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNode reads "ip", "ip:port", "[ipv6]" or "[ipv6]:port", it returns
+// nil for anything else
+func parseNode(node string) net.Addr {
+	if ip := net.ParseIP(node); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	if strings.HasPrefix(node, "[") && strings.HasSuffix(node, "]") {
+		if ip := net.ParseIP(node[1 : len(node)-1]); ip != nil && ip.To4() == nil {
+			return &net.TCPAddr{IP: ip}
+		}
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	number, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		// obfuscated ports like "_abc" keep the address
+		if ip != nil && strings.HasPrefix(port, "_") {
+			return &net.TCPAddr{IP: ip}
+		}
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(number)}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"io"
+	"vivalchemy/http-server-from-scratch/http2"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+// serveHTTP2 speaks HTTP/2 on the connection from its preface on, or after
+// answering upgrade with 101 when it isn't nil. Every stream is routed like
+// an HTTP/1.1 request.
+func (s *Server) serveHTTP2(ctx context.Context, conn *conn, reader io.Reader, upgrade *request.Request) {
+	h2 := &http2.Server{
+		MaxBodySize: s.MaxBodySize,
+		Handler: func(w *response.Writer, r *request.Request) {
+			if r != upgrade {
+				r.ConnInfo = conn.next()
+				r.RemoteAddr = s.clientAddr(r)
+			}
+			if s.RequestTimeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), s.RequestTimeout)
+				defer cancel()
+				r.SetContext(ctx)
+			}
+
+			handler, _ := s.route(w, r)
+			if handler == nil {
+				return
+			}
+			if err := s.checkBody(r, false); err != nil {
+				s.rejectBody(w, r, err)
+				return
+			}
+			s.serve(handler, w, r)
+		},
+	}
+	if upgrade != nil {
+		h2.ServeUpgrade(ctx, conn, reader, upgrade)
+		return
+	}
+	h2.ServeConn(ctx, conn, reader)
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+// ErrHandler is a handler that can fail. Register it through
+// Server.HandleErr, which answers the returned error.
+type ErrHandler func(res *response.Writer, req *request.Request) error
+
+// HTTPError is an error with the status to answer with. Message is safe to
+// show to the client, Err is the internal cause and only gets logged.
+type HTTPError struct {
+	Status     response.StatusCode
+	Message    string
+	Err        error
+	RetryAfter time.Duration // sent as Retry-After, in seconds, when set
+}
+
+// NewHTTPError returns an HTTPError, err may be nil
+func NewHTTPError(status response.StatusCode, message string, err error) *HTTPError {
+	return &HTTPError{Status: status, Message: message, Err: err}
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%d %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("%d %s: %v", e.Status, e.Message, e.Err)
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// HandleErr adapts h to a Handler. A returned error goes to the
+// ErrorHandler with the status of the HTTPError it wraps, 500 for any other
+// error. When h already started its response the error is only logged.
+func (s *Server) HandleErr(h ErrHandler) Handler {
+	return func(res *response.Writer, req *request.Request) {
+		err := h(res, req)
+		if err == nil {
+			return
+		}
+		if res.Status() != 0 {
+			log.Printf("%s %s: error after the response started: %v", req.Method, req.TargetPath, err)
+			// the response may be cut short, don't reuse the connection
+			res.SetKeepAlive(false)
+			return
+		}
+
+		status := response.StatusInternalServerError
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) {
+			status = httpErr.Status
+		}
+		errorHandler(s.ErrorHandler)(res, req, status, err)
+	}
+}
+
+// RenderError is the default ErrorHandler. It answers with an HTML, JSON or
+// plain text body depending on the Accept header of the request. Only the
+// message of an HTTPError reaches the client, the internal cause of 5xx
+// responses and of HTTPErrors is logged.
+func RenderError(res *response.Writer, req *request.Request, status response.StatusCode, err error) {
+	message := response.StatusText(status)
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.Message != "" {
+		message = httpErr.Message
+	}
+	if status >= 500 || httpErr != nil && httpErr.Err != nil {
+		if req != nil {
+			log.Printf("%s %s: %v", req.Method, req.TargetPath, err)
+		} else {
+			log.Printf("%d %s: %v", status, response.StatusText(status), err)
+		}
+	}
+
+	accept := ""
+	if req != nil {
+		accept, _ = req.Headers.Get("accept")
+	}
+
+	var body []byte
+	contentType := "text/plain"
+	switch preferredType(accept, "text/plain", "text/html", "application/json") {
+	case "application/json":
+		contentType = "application/json"
+		body, _ = json.Marshal(map[string]any{
+			"status":  int(status),
+			"error":   response.StatusText(status),
+			"message": message,
+		})
+	case "text/html":
+		contentType = "text/html"
+		title := html.EscapeString(fmt.Sprintf("%d %s", status, response.StatusText(status)))
+		body = fmt.Appendf(nil, "<html>\n  <head>\n    <title>%s</title>\n  </head>\n  <body>\n    <h1>%s</h1>\n    <p>%s</p>\n  </body>\n</html>\n",
+			title, title, html.EscapeString(message))
+	default:
+		body = fmt.Appendf(nil, "%d %s\n", status, message)
+	}
+
+	headers := response.GetDefaultHeaders(len(body))
+	headers.Replace("Content-Type", contentType)
+	var notAllowed *MethodNotAllowedError
+	if errors.As(err, &notAllowed) {
+		headers.Set("Allow", strings.Join(notAllowed.Allowed, ", "))
+	}
+	if httpErr != nil && httpErr.RetryAfter > 0 {
+		headers.Set("Retry-After", RetryAfter(httpErr.RetryAfter))
+	}
+	res.WriteStatusLine(status)
+	res.WriteHeaders(*headers)
+	res.WriteBody(body)
+}
+
+// RetryAfter formats d as the delay-seconds of a Retry-After header,
+// rounded up
+func RetryAfter(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
+
+// preferredType picks the offer with the highest q-value in an Accept
+// header. The first offer wins ties and is used when nothing is acceptable.
+func preferredType(accept string, offers ...string) string {
+	best, bestQ, bestSpecific := offers[0], 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		for _, offer := range offers {
+			specific := -1
+			switch {
+			case mediaType == offer:
+				specific = 2
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+				specific = 1
+			case mediaType == "*/*":
+				specific = 0
+			}
+			if specific == -1 {
+				continue
+			}
+			if q > bestQ || q == bestQ && specific > bestSpecific {
+				best, bestQ, bestSpecific = offer, q, specific
+			}
+		}
+	}
+	return best
+}
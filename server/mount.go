@@ -0,0 +1,92 @@
+package server
+
+import (
+	"strings"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+// Mountable is what Mount can serve under a prefix: a *Router, a
+// *PathTreeNode or any Handler
+type Mountable interface {
+	// find returns the handler for method and path, and whether it reads
+	// the body itself, see StreamBody
+	find(method HTTPMethod, path string) (Handler, bool, error)
+}
+
+func (r *Router) find(method HTTPMethod, path string) (Handler, bool, error) {
+	return r.tree.find(method, path)
+}
+
+// A mounted Handler takes every method and path below the prefix
+func (h Handler) find(method HTTPMethod, path string) (Handler, bool, error) {
+	return h, false, nil
+}
+
+type mountPoint struct {
+	target Mountable
+	wrap   func(Handler) Handler // middlewares of the router that mounted it
+	site   string                // file:line of the Mount call
+
+	middlewares []string
+	streamBody  bool // set with the StreamBody option
+}
+
+// find looks up the part of path below the mount. sections are the path
+// sections consumed to reach the mount point.
+func (m *mountPoint) find(method HTTPMethod, sections []string, path string) (Handler, bool, error) {
+	prefix := "/" + strings.Join(sections, "/")
+
+	// strip the prefix section by section, the raw path may repeat slashes
+	rest, query, _ := strings.Cut(path, "?")
+	for _, section := range sections {
+		rest = strings.TrimLeft(rest, "/")
+		rest = strings.TrimPrefix(rest, section)
+	}
+	rest = "/" + strings.TrimLeft(rest, "/")
+	if query != "" {
+		rest += "?" + query
+	}
+
+	handler, streamBody, err := m.target.find(method, rest)
+	if err != nil {
+		return nil, false, err
+	}
+	return m.wrap(func(res *response.Writer, req *request.Request) {
+		req.MountPrefix = strings.TrimSuffix(req.MountPrefix, "/") + prefix
+		req.StrippedPath = rest
+		handler(res, req)
+	}), streamBody || m.streamBody, nil
+}
+
+func (m *mountPoint) addOptions() {
+	switch target := m.target.(type) {
+	case *Router:
+		target.tree.addOptions()
+	case *PathTreeNode:
+		target.addOptions()
+	}
+}
+
+// Mount serves target for every request under prefix. The mounted code sees
+// the path without the prefix in req.StrippedPath and the prefix in
+// req.MountPrefix, nested mounts add up. Like AddHandler, a failure is
+// returned and also kept for Serve. Of the options only StreamBody applies,
+// to everything below the prefix.
+func (r *Router) Mount(prefix string, target Mountable, options ...RouteOption) error {
+	entry := routeEntry{}
+	for _, option := range options {
+		option(&entry)
+	}
+	mount := &mountPoint{target: target, wrap: r.wrap, site: callerSite(), streamBody: entry.streamBody}
+	for _, middleware := range r.middlewares {
+		mount.middlewares = append(mount.middlewares, funcName(middleware))
+	}
+	err := r.tree.mountAt(r.join(prefix), mount)
+	if err == nil {
+		if router, ok := target.(*Router); ok {
+			r.reg.mounted = append(r.reg.mounted, mountedRouter{prefix: r.join(prefix), router: router})
+		}
+	}
+	return r.reg.record(err)
+}
@@ -14,97 +14,349 @@ var (
 	HandlerErrorNotFound         HandlerError = fmt.Errorf("url not found")
 )
 
+type RouteError error
+
+var (
+	RouteErrorInvalid   RouteError = fmt.Errorf("invalid route")
+	RouteErrorDuplicate RouteError = fmt.Errorf("duplicate route")
+	RouteErrorConflict  RouteError = fmt.Errorf("conflicting route")
+)
+
 type Handler func(res *response.Writer, req *request.Request)
 
+// PathTreeNode is a trie of path sections. A section is either static
+// ("users"), a pattern with parameters ("{id:int}", "{name}.{ext}") or the
+// "*" wildcard. Lookup tries static sections first, then patterns in the
+// order they were registered, then the wildcard, backtracking when a
+// branch has no route.
 type PathTreeNode struct {
 	section        string
-	AllowedMethods map[HTTPMethod]Handler   // METHOD -> Handler
-	children       map[string]*PathTreeNode // path section -> Its tree
+	route          string                    // pattern of the route up to this node
+	AllowedMethods map[HTTPMethod]Handler    // METHOD -> Handler
+	children       map[string]*PathTreeNode  // path section -> Its tree
+	patterns       []*PathTreeNode           // children whose section has parameters
+	pattern        *segmentPattern           // set on pattern nodes
+	mount          *mountPoint               // serves everything from this node down
+	entries        map[HTTPMethod]routeEntry // METHOD -> what was registered
+	site           string                    // file:line of the registration that made the node
 }
 
 func NewPathTree() *PathTreeNode {
 	return &PathTreeNode{
 		section:        "",
+		route:          "/",
 		AllowedMethods: make(map[HTTPMethod]Handler),
 		children:       make(map[string]*PathTreeNode),
+		entries:        make(map[HTTPMethod]routeEntry),
 	}
 }
 
-func (t *PathTreeNode) add(method HTTPMethod, path string, handler Handler) {
-	// Handle root path specially
-	if path == "/" || path == "" {
-		if t.AllowedMethods[method] != nil {
-			panic("duplicate handler for method")
+// splitPath drops the query and returns the non empty path sections
+func splitPath(path string) []string {
+	path, _, _ = strings.Cut(path, "?")
+
+	var sections []string
+	for _, section := range strings.Split(path, "/") {
+		if section != "" {
+			sections = append(sections, section)
 		}
-		t.AllowedMethods[method] = handler
-		return
 	}
+	return sections
+}
 
-	// Split path into sections, removing empty segments
-	pathSections := strings.Split(strings.Trim(path, "/"), "/")
-
-	// Filter out empty sections
-	var cleanSections []string
-	for _, section := range pathSections {
-		if section != "" {
-			cleanSections = append(cleanSections, section)
+// lookupChild returns the existing node for section below t, or nil when
+// there is none. It fails when section is a pattern an existing one
+// already matches every section of, patterns being tried in registration
+// order the new route could never match.
+func (t *PathTreeNode) lookupChild(section string, pattern *segmentPattern) (*PathTreeNode, error) {
+	if pattern == nil {
+		return t.children[section], nil
+	}
+	for _, existing := range t.patterns {
+		if existing.section == section {
+			return existing, nil
+		}
+		if existing.pattern.key == pattern.key {
+			return nil, fmt.Errorf("%w: section %q conflicts with %q of %q registered at %s: same pattern with different parameter names",
+				RouteErrorConflict, section, existing.section, existing.route, existing.site)
+		}
+		if existing.pattern.covers(pattern) {
+			return nil, fmt.Errorf("%w: section %q is shadowed by %q of %q registered at %s, which matches every section it does",
+				RouteErrorConflict, section, existing.section, existing.route, existing.site)
 		}
 	}
-	pathSections = cleanSections
+	return nil, nil
+}
 
-	currentTree := t
-	for i, section := range pathSections {
-		if i == len(pathSections)-1 {
-			// Last section - create child node and add handler to it
-			if _, ok := currentTree.children[section]; !ok {
-				currentTree.children[section] = NewPathTree()
-				currentTree.children[section].section = section
-			}
+// child returns the node for section below t, creating it when needed
+func (t *PathTreeNode) child(section string, pattern *segmentPattern, site string) (*PathTreeNode, error) {
+	existing, err := t.lookupChild(section, pattern)
+	if err != nil || existing != nil {
+		return existing, err
+	}
+
+	node := NewPathTree()
+	node.section = section
+	node.route = strings.TrimSuffix(t.route, "/") + "/" + section
+	node.pattern = pattern
+	node.site = site
+	if pattern == nil {
+		t.children[section] = node
+	} else {
+		t.patterns = append(t.patterns, node)
+	}
+	return node, nil
+}
+
+// parseRoute splits path into sections and compiles the patterns, checking
+// the rules that don't depend on other routes
+func parseRoute(path string) ([]string, []*segmentPattern, error) {
+	sections := splitPath(path)
+	patterns := make([]*segmentPattern, len(sections))
+	names := map[string]bool{}
 
-			// Add handler to the child node
-			if currentTree.children[section].AllowedMethods[method] != nil {
-				t.print(0)
-				panic("duplicate handler for method")
+	for i, section := range sections {
+		if section == "*" {
+			if i != len(sections)-1 {
+				return nil, nil, fmt.Errorf("%w: wildcard \"*\" must be the last section", RouteErrorInvalid)
 			}
-			currentTree.children[section].AllowedMethods[method] = handler
-		} else {
-			// Intermediate section - create child if doesn't exist
-			if _, ok := currentTree.children[section]; !ok {
-				currentTree.children[section] = NewPathTree()
-				currentTree.children[section].section = section
+			continue
+		}
+		if strings.Contains(section, "*") && !strings.ContainsAny(section, "{}") {
+			return nil, nil, fmt.Errorf("%w: wildcard \"*\" must be a whole section, got %q", RouteErrorInvalid, section)
+		}
+		if !strings.ContainsAny(section, "{}") {
+			continue
+		}
+
+		pattern, err := parseSegment(section)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", RouteErrorInvalid, err)
+		}
+		for _, name := range pattern.names {
+			if names[name] {
+				return nil, nil, fmt.Errorf("%w: parameter %q is used twice", RouteErrorInvalid, name)
 			}
-			currentTree = currentTree.children[section]
+			names[name] = true
 		}
+		patterns[i] = pattern
 	}
+	return sections, patterns, nil
+}
+
+// routeEntry describes a registration for introspection and errors
+type routeEntry struct {
+	name        string // set with the Name option
+	site        string // file:line of the registration
+	handler     string // function name of the handler
+	middlewares []string
+	streamBody  bool // set with the StreamBody option
 }
 
-func (t *PathTreeNode) find(method HTTPMethod, path string) (Handler, error) {
-	pathSections := strings.Split(strings.Trim(path, "/"), "/")
-	// for / it will return an empty array
+// add registers handler for method and path. Nothing is changed in the
+// tree when the route is invalid or conflicts with an existing one.
+func (t *PathTreeNode) add(method HTTPMethod, path string, handler Handler, entry routeEntry) error {
+	site := entry.site
+	sections, patterns, err := parseRoute(path)
+	if err != nil {
+		return fmt.Errorf("route %q at %s: %w", path, site, err)
+	}
+
+	// check against the existing routes before creating any node
 	currentTree := t
+	for i, section := range sections {
+		if currentTree == nil || currentTree.mount != nil {
+			break
+		}
+		next, err := currentTree.lookupChild(section, patterns[i])
+		if err != nil {
+			return fmt.Errorf("route %q at %s: %w", path, site, err)
+		}
+		currentTree = next
+	}
+	if currentTree != nil {
+		if currentTree.mount != nil {
+			return fmt.Errorf("route %q at %s: %w: it is below the mount at %q registered at %s",
+				path, site, RouteErrorConflict, currentTree.route, currentTree.mount.site)
+		}
+		if currentTree.AllowedMethods[method] != nil {
+			return fmt.Errorf("route %q at %s: %w: %s handler already registered at %s",
+				path, site, RouteErrorDuplicate, method, currentTree.entries[method].site)
+		}
+	}
 
-	for _, section := range pathSections {
-		if child, ok := currentTree.children[section]; ok {
-			// it has a child traverse to that child
-			currentTree = child
-		} else if wildcard, ok := currentTree.children["*"]; ok {
-			currentTree = wildcard
+	currentTree = t
+	for i, section := range sections {
+		currentTree, _ = currentTree.child(section, patterns[i], site)
+	}
+	currentTree.AllowedMethods[method] = handler
+	currentTree.entries[method] = entry
+	return nil
+}
+
+// mountAt puts target at the node for path
+func (t *PathTreeNode) mountAt(path string, mount *mountPoint) error {
+	sections, patterns, err := parseRoute(path)
+	if err != nil {
+		return fmt.Errorf("mount %q at %s: %w", path, mount.site, err)
+	}
+	for _, pattern := range patterns {
+		if pattern != nil {
+			return fmt.Errorf("mount %q at %s: %w: mount prefixes can't have parameters", path, mount.site, RouteErrorInvalid)
+		}
+	}
+	if len(sections) > 0 && sections[len(sections)-1] == "*" {
+		return fmt.Errorf("mount %q at %s: %w: mount prefixes can't have wildcards", path, mount.site, RouteErrorInvalid)
+	}
+
+	currentTree := t
+	for _, section := range sections {
+		if currentTree.mount != nil {
 			break
-		} else {
-			return nil, HandlerErrorNotFound
 		}
+		next := currentTree.children[section]
+		if next == nil {
+			currentTree = nil
+			break
+		}
+		currentTree = next
+	}
+	if currentTree != nil {
+		if currentTree.mount != nil {
+			return fmt.Errorf("mount %q at %s: %w: overlaps the mount at %q registered at %s",
+				path, mount.site, RouteErrorConflict, currentTree.route, currentTree.mount.site)
+		}
+		if route, site := currentTree.firstRoute(); route != "" {
+			return fmt.Errorf("mount %q at %s: %w: route %q registered at %s would be hidden by it",
+				path, mount.site, RouteErrorConflict, route, site)
+		}
+	}
+
+	currentTree = t
+	for _, section := range sections {
+		currentTree, _ = currentTree.child(section, nil, mount.site)
+	}
+	currentTree.mount = mount
+	return nil
+}
+
+// firstRoute returns the pattern and site of some route at or below t
+func (t *PathTreeNode) firstRoute() (string, string) {
+	for method, entry := range t.entries {
+		return string(method) + " " + t.route, entry.site
+	}
+	for _, child := range t.allChildren() {
+		if route, site := child.firstRoute(); route != "" {
+			return route, site
+		}
+	}
+	return "", ""
+}
+
+func (t *PathTreeNode) find(method HTTPMethod, path string) (Handler, bool, error) {
+	m := &matcher{method: method, path: path, sections: splitPath(path)}
+	handler, err := m.match(t, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	if m.mounted {
+		// the mount point fills in the request itself
+		return handler, m.streamBody, nil
 	}
 
-	if handler, ok := currentTree.AllowedMethods[method]; ok {
-		// match the handler directly
-		// doesn't resolve the /path if the route mentioned is /path/*
-		// so need the else if part to do it
-		return handler, nil
-	} else if wildcard, ok := currentTree.children["*"]; ok {
-		// if there is /domain/* then it will match /domain and /domain/anything
-		return wildcard.AllowedMethods[method], nil
+	params := request.Params{}
+	for _, c := range m.captures {
+		params.Set(c.name, c.value, c.typed)
 	}
-	return nil, HandlerErrorMethodNotAllowed
+	return func(res *response.Writer, req *request.Request) {
+		req.Params = params
+		handler(res, req)
+	}, m.streamBody, nil
+}
+
+// matcher is the state of one lookup
+type matcher struct {
+	method   HTTPMethod
+	path     string
+	sections []string
+	captures []capture
+	mounted  bool
+	// streamBody is set when the handler found reads the body itself
+	streamBody bool
+}
+
+// match finds the handler for sections[i:] below node. The error is
+// HandlerErrorMethodNotAllowed when some route matched the path but not
+// the method.
+func (m *matcher) match(node *PathTreeNode, i int) (Handler, error) {
+	if node.mount != nil {
+		m.mounted = true
+		handler, streamBody, err := node.mount.find(m.method, m.sections[:i], m.path)
+		m.streamBody = streamBody
+		return handler, err
+	}
+
+	notFound := HandlerErrorNotFound
+	if i == len(m.sections) {
+		if handler, ok := node.AllowedMethods[m.method]; ok {
+			m.streamBody = node.entries[m.method].streamBody
+			return handler, nil
+		}
+		if len(node.AllowedMethods) > 0 {
+			notFound = HandlerErrorMethodNotAllowed
+		}
+	} else {
+		section := m.sections[i]
+		if child, ok := node.children[section]; ok && section != "*" {
+			handler, err := m.match(child, i+1)
+			if handler != nil || m.mounted {
+				// a mount point owns everything below it, no backtracking
+				return handler, err
+			}
+			if err == HandlerErrorMethodNotAllowed {
+				notFound = err
+			}
+		}
+
+		for _, child := range node.patterns {
+			captures, ok := child.pattern.match(section)
+			if !ok {
+				continue
+			}
+			before := len(m.captures)
+			m.captures = append(m.captures, captures...)
+			handler, err := m.match(child, i+1)
+			if handler != nil || m.mounted {
+				return handler, err
+			}
+			if err == HandlerErrorMethodNotAllowed {
+				notFound = err
+			}
+			m.captures = m.captures[:before]
+		}
+	}
+
+	// if there is /domain/* then it will match /domain and /domain/anything
+	if wildcard, ok := node.children["*"]; ok {
+		if handler, ok := wildcard.AllowedMethods[m.method]; ok {
+			m.captures = append(m.captures, capture{name: "*", value: strings.Join(m.sections[i:], "/")})
+			m.streamBody = wildcard.entries[m.method].streamBody
+			return handler, nil
+		}
+		if len(wildcard.AllowedMethods) > 0 {
+			notFound = HandlerErrorMethodNotAllowed
+		}
+	}
+	return nil, notFound
+}
+
+// allChildren lists the static and pattern children of t
+func (t *PathTreeNode) allChildren() []*PathTreeNode {
+	children := make([]*PathTreeNode, 0, len(t.children)+len(t.patterns))
+	for _, child := range t.children {
+		children = append(children, child)
+	}
+	return append(children, t.patterns...)
 }
 
 func (t *PathTreeNode) addOptions() {
@@ -127,30 +379,19 @@ func (t *PathTreeNode) addOptions() {
 	}
 
 	// Recursively add OPTIONS to all children
-	for _, child := range t.children {
+	for _, child := range t.allChildren() {
 		child.addOptions()
 	}
-}
-
-func (t *PathTreeNode) print(depth int) {
-	indent := strings.Repeat("  ", depth)
-
-	if t.section != "" {
-		fmt.Printf("%sSection: %s\n", indent, t.section)
+	if t.mount != nil {
+		t.mount.addOptions()
 	}
+}
 
-	if len(t.AllowedMethods) > 0 {
-		fmt.Printf("%sAllowedMethods:\n", indent)
-		for method := range t.AllowedMethods {
-			fmt.Printf("%s  - %v\n", indent, method)
-		}
+func (t *PathTreeNode) collectMethods(seen map[HTTPMethod]bool) {
+	for method := range t.AllowedMethods {
+		seen[method] = true
 	}
-
-	if len(t.children) > 0 {
-		fmt.Printf("%sChildren:\n", indent)
-		for section, child := range t.children {
-			fmt.Printf("%s  %s:\n", indent, section)
-			child.print(depth + 2) // Fixed: call print on the child, not t
-		}
+	for _, child := range t.allChildren() {
+		child.collectMethods(seen)
 	}
 }
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"testing"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lookup finds the handler for path and returns the request it was called
+// with and the name of the route that served it
+func lookup(t *testing.T, tree *PathTreeNode, method HTTPMethod, path string) (*request.Request, string, error) {
+	t.Helper()
+	handler, _, err := tree.find(method, path)
+	if err != nil {
+		return nil, "", err
+	}
+	req := request.NewRequest()
+	handler(nil, req)
+	return req, req.Params.Get("route"), nil
+}
+
+func named(name string) Handler {
+	return func(res *response.Writer, req *request.Request) {
+		req.Params.Set("route", name, nil)
+	}
+}
+
+func TestPathTreeParams(t *testing.T) {
+	tree := NewPathTree()
+	require.NoError(t, tree.add(MethodGet, "/users/{id:int}", named("user by id"), routeEntry{site: "routes.go:1"}))
+	require.NoError(t, tree.add(MethodGet, "/users/{name}", named("user by name"), routeEntry{site: "routes.go:1"}))
+	require.NoError(t, tree.add(MethodGet, "/users/me", named("me"), routeEntry{site: "routes.go:1"}))
+	require.NoError(t, tree.add(MethodGet, "/files/{name:[a-z0-9_-]+}.{ext}", named("file"), routeEntry{site: "routes.go:1"}))
+	require.NoError(t, tree.add(MethodGet, "/v{version:uint}/status", named("status"), routeEntry{site: "routes.go:1"}))
+	require.NoError(t, tree.add(MethodGet, "/v{version:uint}/score/{score:float}", named("score"), routeEntry{site: "routes.go:1"}))
+	require.NoError(t, tree.add(MethodDelete, "/users/{id:int}", named("delete user"), routeEntry{site: "routes.go:1"}))
+	require.NoError(t, tree.add(MethodGet, "/static/*", named("static"), routeEntry{site: "routes.go:1"}))
+
+	// Test: Static sections win
+	_, route, err := lookup(t, tree, MethodGet, "/users/me")
+	require.NoError(t, err)
+	assert.Equal(t, "me", route)
+
+	// Test: Typed constraint
+	req, route, err := lookup(t, tree, MethodGet, "/users/42")
+	require.NoError(t, err)
+	assert.Equal(t, "user by id", route)
+	assert.Equal(t, "42", req.Params.Get("id"))
+	id, ok := req.Params.Int("id")
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), id)
+
+	// Test: Failed constraint falls through to the next pattern
+	req, route, err = lookup(t, tree, MethodGet, "/users/bob")
+	require.NoError(t, err)
+	assert.Equal(t, "user by name", route)
+	assert.Equal(t, "bob", req.Params.Get("name"))
+	_, ok = req.Params.Int("id")
+	assert.False(t, ok)
+
+	// Test: Overflowing int falls through too
+	_, route, err = lookup(t, tree, MethodGet, "/users/99999999999999999999")
+	require.NoError(t, err)
+	assert.Equal(t, "user by name", route)
+
+	// Test: Values are percent decoded
+	req, _, err = lookup(t, tree, MethodGet, "/users/jane%20doe")
+	require.NoError(t, err)
+	assert.Equal(t, "jane doe", req.Params.Get("name"))
+
+	// Test: Several parameters in one section
+	req, route, err = lookup(t, tree, MethodGet, "/files/report_2024.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, "file", route)
+	assert.Equal(t, "report_2024", req.Params.Get("name"))
+	assert.Equal(t, "tar.gz", req.Params.Get("ext"))
+	_, _, err = tree.find(MethodGet, "/files/Report.pdf")
+	require.ErrorIs(t, err, HandlerErrorNotFound)
+
+	// Test: Prefix literal with typed parameter
+	req, route, err = lookup(t, tree, MethodGet, "/v2/status?verbose=1")
+	require.NoError(t, err)
+	assert.Equal(t, "status", route)
+	version, ok := req.Params.Uint("version")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), version)
+	req, _, err = lookup(t, tree, MethodGet, "/v1/score/-1.5e2")
+	require.NoError(t, err)
+	score, ok := req.Params.Float("score")
+	assert.True(t, ok)
+	assert.Equal(t, -150.0, score)
+	_, _, err = tree.find(MethodGet, "/v-1/status")
+	require.ErrorIs(t, err, HandlerErrorNotFound)
+
+	// Test: Method falls through to a pattern that has it
+	_, route, err = lookup(t, tree, MethodDelete, "/users/7")
+	require.NoError(t, err)
+	assert.Equal(t, "delete user", route)
+	_, _, err = tree.find(MethodDelete, "/users/me")
+	require.ErrorIs(t, err, HandlerErrorMethodNotAllowed)
+
+	// Test: Wildcard remainder
+	req, route, err = lookup(t, tree, MethodGet, "/static/css/site.css")
+	require.NoError(t, err)
+	assert.Equal(t, "static", route)
+	assert.Equal(t, "css/site.css", req.Params.Get("*"))
+}
+
+func TestPathTreeConflicts(t *testing.T) {
+	tree := NewPathTree()
+	require.NoError(t, tree.add(MethodGet, "/users/{id:int}", named("user"), routeEntry{site: "routes.go:1"}))
+
+	// Test: Same pattern, same names shares the node
+	require.NoError(t, tree.add(MethodPost, "/users/{id:int}", named("user"), routeEntry{site: "routes.go:2"}))
+	require.NoError(t, tree.add(MethodGet, "/users/{id:int}/posts", named("posts"), routeEntry{site: "routes.go:3"}))
+
+	// Test: Duplicate handler names both registrations
+	err := tree.add(MethodGet, "/users/{id:int}/", named("again"), routeEntry{site: "routes.go:4"})
+	require.ErrorIs(t, err, RouteErrorDuplicate)
+	assert.EqualError(t, err, `route "/users/{id:int}/" at routes.go:4: duplicate route: GET handler already registered at routes.go:1`)
+
+	// Test: Same pattern with another name
+	err = tree.add(MethodGet, "/users/{uid:int}/avatar", named("avatar"), routeEntry{site: "routes.go:5"})
+	require.ErrorIs(t, err, RouteErrorConflict)
+	assert.EqualError(t, err, `route "/users/{uid:int}/avatar" at routes.go:5: conflicting route: section "{uid:int}" conflicts with "{id:int}" of "/users/{id:int}" registered at routes.go:1: same pattern with different parameter names`)
+
+	// Test: A pattern an earlier sibling matches all of can never match
+	require.NoError(t, tree.add(MethodGet, "/items/{id}", named("item"), routeEntry{site: "routes.go:17"}))
+	err = tree.add(MethodGet, "/items/{id:int}", named("typed"), routeEntry{site: "routes.go:18"})
+	require.ErrorIs(t, err, RouteErrorConflict)
+	assert.EqualError(t, err, `route "/items/{id:int}" at routes.go:18: conflicting route: section "{id:int}" is shadowed by "{id}" of "/items/{id}" registered at routes.go:17, which matches every section it does`)
+	require.NoError(t, tree.add(MethodGet, "/files/{name}.{ext}", named("file"), routeEntry{site: "routes.go:19"}))
+	err = tree.add(MethodPost, "/files/{base}.{kind:alpha}", named("typed"), routeEntry{site: "routes.go:20"})
+	require.ErrorIs(t, err, RouteErrorConflict)
+
+	// Test: Registered the other way around the typed pattern is tried first
+	require.NoError(t, tree.add(MethodGet, "/orders/{id:int}", named("typed"), routeEntry{site: "routes.go:21"}))
+	require.NoError(t, tree.add(MethodGet, "/orders/{id}", named("order"), routeEntry{site: "routes.go:22"}))
+	_, route, err := lookup(t, tree, MethodGet, "/orders/42")
+	require.NoError(t, err)
+	assert.Equal(t, "typed", route)
+	_, route, err = lookup(t, tree, MethodGet, "/orders/latest")
+	require.NoError(t, err)
+	assert.Equal(t, "order", route)
+
+	// Test: Failed registrations leave the tree untouched
+	require.NoError(t, tree.add(MethodGet, "/users/{id:int}/avatar", named("avatar"), routeEntry{site: "routes.go:6"}))
+
+	// Test: Parameter used twice
+	err = tree.add(MethodGet, "/teams/{id}/users/{id}", named("member"), routeEntry{site: "routes.go:7"})
+	require.ErrorIs(t, err, RouteErrorInvalid)
+
+	// Test: Wildcard only as the last section
+	err = tree.add(MethodGet, "/a/*/b", named("bad"), routeEntry{site: "routes.go:8"})
+	require.ErrorIs(t, err, RouteErrorInvalid)
+	err = tree.add(MethodGet, "/a/b*", named("bad"), routeEntry{site: "routes.go:9"})
+	require.ErrorIs(t, err, RouteErrorInvalid)
+	_, _, err = tree.find(MethodGet, "/a")
+	require.ErrorIs(t, err, HandlerErrorNotFound)
+
+	// Test: Broken patterns
+	require.ErrorIs(t, tree.add(MethodGet, "/files/{name:[a-z}", named("bad"), routeEntry{site: "routes.go:10"}), RouteErrorInvalid)
+	require.ErrorIs(t, tree.add(MethodGet, "/files/{name", named("bad"), routeEntry{site: "routes.go:11"}), RouteErrorInvalid)
+	require.ErrorIs(t, tree.add(MethodGet, "/files/{1st}", named("bad"), routeEntry{site: "routes.go:12"}), RouteErrorInvalid)
+
+	// Test: Routes and mounts can't hide each other
+	require.NoError(t, tree.mountAt("/admin", &mountPoint{target: Handler(named("admin")), site: "routes.go:13"}))
+	err = tree.add(MethodGet, "/admin/users", named("hidden"), routeEntry{site: "routes.go:14"})
+	assert.EqualError(t, err, `route "/admin/users" at routes.go:14: conflicting route: it is below the mount at "/admin" registered at routes.go:13`)
+	err = tree.mountAt("/users", &mountPoint{target: Handler(named("users")), site: "routes.go:15"})
+	require.ErrorIs(t, err, RouteErrorConflict)
+	err = tree.mountAt("/admin/sub", &mountPoint{target: Handler(named("sub")), site: "routes.go:16"})
+	require.ErrorIs(t, err, RouteErrorConflict)
+}
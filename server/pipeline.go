@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+var errConnectionClosed = fmt.Errorf("connection closed by an earlier response")
+
+// pipeline puts the responses to the requests of one connection on the
+// wire in the order the requests came in, while their handlers may run
+// concurrently. A response is written straight through once every earlier
+// one is done, until then it is buffered.
+type pipeline struct {
+	mu      sync.Mutex
+	conn    io.Writer
+	queue   []*pipelined // responses not done yet, the first one is written through
+	closed  bool         // a response closed or hijacked the connection, later ones are dropped
+	err     error        // first write error, the connection is unusable after it
+	onClose func()
+	turn    *sync.Cond // signalled when the first response changes
+}
+
+func newPipeline(conn io.Writer, onClose func()) *pipeline {
+	p := &pipeline{conn: conn, onClose: onClose}
+	p.turn = sync.NewCond(&p.mu)
+	return p
+}
+
+// pipelined is the io.Writer of one response of a pipeline
+type pipelined struct {
+	p     *pipeline
+	buf   []byte
+	done  bool
+	close bool
+}
+
+// add queues the response to the next request
+func (p *pipeline) add() *pipelined {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := &pipelined{p: p}
+	p.queue = append(p.queue, w)
+	return w
+}
+
+// full reports whether max responses or more are queued
+func (p *pipeline) full(max int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue) >= max
+}
+
+// wait blocks until fewer than max responses are queued, or nothing more
+// can be written
+func (p *pipeline) wait(max int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) >= max && !p.closed && p.err == nil {
+		p.turn.Wait()
+	}
+}
+
+func (w *pipelined) Write(b []byte) (int, error) {
+	p := w.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, errConnectionClosed
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	if p.queue[0] != w {
+		w.buf = append(w.buf, b...)
+		return len(b), nil
+	}
+	n, err := p.conn.Write(b)
+	if err != nil {
+		p.err = err
+	}
+	return n, err
+}
+
+// finish marks the response done, closing the connection after it when
+// close is set, and writes whatever the responses behind it buffered
+func (w *pipelined) finish(close bool) {
+	p := w.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.done, w.close = true, close
+	defer p.turn.Broadcast()
+
+	for len(p.queue) > 0 && !p.closed {
+		head := p.queue[0]
+		if len(head.buf) > 0 && p.err == nil {
+			if _, err := p.conn.Write(head.buf); err != nil {
+				p.err = err
+			}
+		}
+		head.buf = nil
+		if !head.done {
+			return
+		}
+		p.queue = p.queue[1:]
+		if head.close {
+			p.closed = true
+			p.onClose()
+		}
+	}
+}
+
+// hijack waits for the responses before w to be done and writes what w
+// buffered. Nothing is written to the connection or closed after it.
+func (w *pipelined) hijack() error {
+	p := w.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed && p.err == nil && p.queue[0] != w {
+		p.turn.Wait()
+	}
+	if p.closed {
+		return errConnectionClosed
+	}
+	if p.err != nil {
+		return p.err
+	}
+	if len(w.buf) > 0 {
+		if _, err := p.conn.Write(w.buf); err != nil {
+			return err
+		}
+		w.buf = nil
+	}
+	p.closed = true
+	return nil
+}
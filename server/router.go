@@ -0,0 +1,266 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"vivalchemy/http-server-from-scratch/request"
+)
+
+// Middleware wraps a handler, running code before and/or after it
+type Middleware func(next Handler) Handler
+
+// Router registers handlers on a path tree. Routers made by Group share
+// the tree of their parent and add their prefix and middlewares to every
+// route.
+type Router struct {
+	tree        *PathTreeNode
+	prefix      string
+	middlewares []Middleware
+	reg         *registry // shared with the groups of the router
+}
+
+func NewRouter() *Router {
+	return &Router{tree: NewPathTree(), reg: &registry{}}
+}
+
+// registry keeps the registration errors and named routes of a tree and
+// its groups, and the routers mounted in it
+type registry struct {
+	errs    []error
+	names   map[string]string // route name -> pattern
+	mounted []mountedRouter
+}
+
+type mountedRouter struct {
+	prefix string
+	router *Router
+}
+
+func (reg *registry) record(err error) error {
+	if err != nil {
+		reg.errs = append(reg.errs, err)
+	}
+	return err
+}
+
+// Err returns every registration error of the router, its groups and the
+// routers mounted in them, nil when all routes are valid
+func (r *Router) Err() error {
+	errs := append([]error{}, r.reg.errs...)
+	for _, mounted := range r.reg.mounted {
+		if err := mounted.router.Err(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var packagePath = reflect.TypeOf(Router{}).PkgPath()
+
+// callerSite returns the file:line of the code registering a route,
+// skipping the router methods it went through
+func callerSite() string {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		method := strings.TrimPrefix(frame.Function, packagePath+".")
+		if method == frame.Function || !strings.HasPrefix(method, "(*") {
+			return fmt.Sprintf("%s:%d", filepath.Base(frame.File), frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// Group returns a router whose routes live under prefix and run through
+// middlewares, after the middlewares of r. Groups can be nested.
+func (r *Router) Group(prefix string, middlewares ...Middleware) *Router {
+	return &Router{
+		tree:        r.tree,
+		prefix:      r.join(prefix),
+		middlewares: append(append([]Middleware{}, r.middlewares...), middlewares...),
+		reg:         r.reg,
+	}
+}
+
+// join puts path under the router prefix
+func (r *Router) join(path string) string {
+	if r.prefix == "" {
+		return path
+	}
+	return strings.TrimRight(r.prefix, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// wrap applies the middlewares so the first one registered runs first
+func (r *Router) wrap(handler Handler) Handler {
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		handler = r.middlewares[i](handler)
+	}
+	return handler
+}
+
+func (r *Router) Get(path string, handler Handler) error {
+	return r.AddHandler(MethodGet, path, handler)
+}
+
+func (r *Router) Post(path string, handler Handler) error {
+	return r.AddHandler(MethodPost, path, handler)
+}
+
+func (r *Router) Put(path string, handler Handler) error {
+	return r.AddHandler(MethodPut, path, handler)
+}
+
+func (r *Router) Delete(path string, handler Handler) error {
+	return r.AddHandler(MethodDelete, path, handler)
+}
+
+func (r *Router) Patch(path string, handler Handler) error {
+	return r.AddHandler(MethodPatch, path, handler)
+}
+
+// Connect registers the handler of CONNECT requests, whose target is a
+// host:port instead of a path. They are routed as if for "/", so register
+// it on a router without prefix. The handler can hijack the connection,
+// see the tunnel package.
+func (r *Router) Connect(handler Handler) error {
+	return r.AddHandler(MethodConnect, "/", handler)
+}
+
+// RouteOption sets optional properties of a route registered with AddHandler
+type RouteOption func(entry *routeEntry)
+
+// Name names the route so Server.URL can build paths for it
+func Name(name string) RouteOption {
+	return func(entry *routeEntry) {
+		entry.name = name
+	}
+}
+
+// StreamBody leaves the request body to the handler, which reads it from
+// req.BodyStream instead of finding it in req.Body. BodyStream is nil for
+// the requests without a body and over HTTP/2, whose body is in Body. A
+// malformed body or one past MaxBodySize fails the read with an HTTPError
+// HandleErr answers. The connection is only kept once the body was read to
+// its end.
+func StreamBody() RouteOption {
+	return func(entry *routeEntry) {
+		entry.streamBody = true
+	}
+}
+
+// AddHandler registers handler for method and path. An invalid or
+// conflicting route is returned as an error and also kept, so Serve
+// refuses to start with it.
+func (r *Router) AddHandler(method HTTPMethod, path string, handler Handler, options ...RouteOption) error {
+	entry := routeEntry{site: callerSite(), handler: funcName(handler)}
+	for _, middleware := range r.middlewares {
+		entry.middlewares = append(entry.middlewares, funcName(middleware))
+	}
+	for _, option := range options {
+		option(&entry)
+	}
+
+	pattern := r.join(path)
+	if entry.name != "" {
+		if existing, ok := r.reg.names[entry.name]; ok && existing != pattern {
+			return r.reg.record(fmt.Errorf("route %q at %s: %w: name %q is already used by %q",
+				path, entry.site, RouteErrorDuplicate, entry.name, existing))
+		}
+	}
+	if err := r.tree.add(method, pattern, r.wrap(handler), entry); err != nil {
+		return r.reg.record(err)
+	}
+
+	if entry.name != "" {
+		if r.reg.names == nil {
+			r.reg.names = map[string]string{}
+		}
+		r.reg.names[entry.name] = pattern
+	}
+	return nil
+}
+
+// virtualHost is a route tree served for one host pattern, either an exact
+// name like "api.example.com" or a wildcard like "*.example.com"
+type virtualHost struct {
+	pattern string
+	router  *Router
+}
+
+func (v *virtualHost) matches(host string) bool {
+	if suffix, ok := strings.CutPrefix(v.pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == v.pattern
+}
+
+// normalizeHost lowercases the host and drops the port and trailing dot
+func normalizeHost(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Host returns the router for requests whose Host matches pattern. Patterns
+// are exact names or "*.domain" wildcards matching any subdomain depth.
+// Requests that match no host use the server's own routes. An invalid
+// pattern is kept as a registration error and gets a router that is never
+// served.
+func (s *Server) Host(pattern string) *Router {
+	pattern = normalizeHost(pattern)
+	name := strings.TrimPrefix(pattern, "*.")
+	if name == "" || strings.Contains(name, "*") || !request.ValidHost(name) {
+		s.Router.reg.record(fmt.Errorf("host %q at %s: %w: invalid host pattern", pattern, callerSite(), RouteErrorInvalid))
+		return NewRouter()
+	}
+
+	for _, vhost := range s.hosts {
+		if vhost.pattern == pattern {
+			return vhost.router
+		}
+	}
+	vhost := &virtualHost{pattern: pattern, router: NewRouter()}
+	s.hosts = append(s.hosts, vhost)
+	return vhost.router
+}
+
+// routerFor picks the router for a request host. Exact names win over
+// wildcards and the longest wildcard wins over shorter ones.
+func (s *Server) routerFor(host string) *Router {
+	host = normalizeHost(host)
+
+	var best *virtualHost
+	for _, vhost := range s.hosts {
+		if !vhost.matches(host) {
+			continue
+		}
+		if vhost.pattern == host {
+			return vhost.router
+		}
+		if best == nil || len(vhost.pattern) > len(best.pattern) {
+			best = vhost
+		}
+	}
+	if best != nil {
+		return best.router
+	}
+	return s.Router
+}
+
+// routers lists the default router followed by every virtual host
+func (s *Server) routers() []*Router {
+	routers := []*Router{s.Router}
+	for _, vhost := range s.hosts {
+		routers = append(routers, vhost.router)
+	}
+	return routers
+}
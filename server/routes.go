@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+// RouteInfo describes a registered route. Method is "*" for a handler
+// mounted with Mount, which takes every method. The OPTIONS handlers added
+// by Serve are not listed.
+type RouteInfo struct {
+	Host        string     `json:"host,omitempty"` // empty for the default routes
+	Name        string     `json:"name,omitempty"`
+	Method      HTTPMethod `json:"method"`
+	Pattern     string     `json:"pattern"`
+	Handler     string     `json:"handler"`
+	Middlewares []string   `json:"middlewares,omitempty"`
+	Site        string     `json:"site"` // file:line of the registration
+}
+
+// funcName returns the name of a function value, like "main.videoHandler"
+func funcName(fn any) string {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return "<nil>"
+	}
+	if f := runtime.FuncForPC(v.Pointer()); f != nil {
+		return f.Name()
+	}
+	return "<unknown>"
+}
+
+// joinRoute puts a route pattern under a mount prefix
+func joinRoute(prefix string, route string) string {
+	if route == "/" {
+		if prefix == "" {
+			return "/"
+		}
+		return prefix
+	}
+	return strings.TrimSuffix(prefix, "/") + route
+}
+
+func (t *PathTreeNode) routes(host string, prefix string, routes []RouteInfo) []RouteInfo {
+	for method, entry := range t.entries {
+		routes = append(routes, RouteInfo{
+			Host:        host,
+			Name:        entry.name,
+			Method:      method,
+			Pattern:     joinRoute(prefix, t.route),
+			Handler:     entry.handler,
+			Middlewares: entry.middlewares,
+			Site:        entry.site,
+		})
+	}
+
+	if t.mount != nil {
+		mountPrefix := joinRoute(prefix, t.route)
+		switch target := t.mount.target.(type) {
+		case *Router:
+			routes = target.tree.routes(host, mountPrefix, routes)
+		case *PathTreeNode:
+			routes = target.routes(host, mountPrefix, routes)
+		default:
+			routes = append(routes, RouteInfo{
+				Host:        host,
+				Method:      "*",
+				Pattern:     joinRoute(mountPrefix, "/*"),
+				Handler:     funcName(target),
+				Middlewares: t.mount.middlewares,
+				Site:        t.mount.site,
+			})
+		}
+	}
+
+	for _, child := range t.allChildren() {
+		routes = child.routes(host, prefix, routes)
+	}
+	return routes
+}
+
+// Routes lists every registered route sorted by host, pattern and method
+func (s *Server) Routes() []RouteInfo {
+	routes := s.Router.tree.routes("", "", nil)
+	for _, vhost := range s.hosts {
+		routes = vhost.router.tree.routes(vhost.pattern, "", routes)
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		if a.Pattern != b.Pattern {
+			return a.Pattern < b.Pattern
+		}
+		return a.Method < b.Method
+	})
+	return routes
+}
+
+// WriteRoutes writes the routes as an aligned table
+func (s *Server) WriteRoutes(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tMETHOD\tPATTERN\tHANDLER\tMIDDLEWARES\tREGISTERED AT")
+	for _, route := range s.Routes() {
+		host := route.Host
+		if host == "" {
+			host = "(default)"
+		}
+		middlewares := strings.Join(route.Middlewares, ", ")
+		if middlewares == "" {
+			middlewares = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", host, route.Method, route.Pattern, route.Handler, middlewares, route.Site)
+	}
+	return tw.Flush()
+}
+
+// RoutesHandler serves the routes of s as JSON, for a debug endpoint
+func (s *Server) RoutesHandler() Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body, err := json.MarshalIndent(s.Routes(), "", "  ")
+		if err != nil {
+			h := response.GetDefaultHeaders(0)
+			w.WriteStatusLine(response.StatusInternalServerError)
+			w.WriteHeaders(*h)
+			return
+		}
+
+		h := response.GetDefaultHeaders(len(body))
+		h.Replace("Content-Type", "application/json")
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*h)
+		w.WriteBody(body)
+	}
+}
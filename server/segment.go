@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// constraints are the named types a route parameter can be limited to, as
+// in {id:int}. Anything else after the colon is used as a regular expression.
+var constraints = map[string]string{
+	"int":   `[-+]?[0-9]+`,
+	"uint":  `[0-9]+`,
+	"float": `[-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?`,
+	"alpha": `[a-zA-Z]+`,
+	"uuid":  `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+}
+
+var paramName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// segmentPattern is a path section holding parameters, like "{id:int}" or
+// "{name:[a-z0-9_-]+}.{ext}"
+type segmentPattern struct {
+	raw   string
+	key   string // raw without the parameter names, equal keys match the same sections
+	regex *regexp.Regexp
+	names []string
+	kinds []string // constraint of each parameter, "" when there is none
+
+	literals []string // text around the parameters, one more than names
+}
+
+// parseSegment compiles a section containing parameters
+func parseSegment(section string) (*segmentPattern, error) {
+	p := &segmentPattern{raw: section}
+	expr := strings.Builder{}
+	key := strings.Builder{}
+	expr.WriteString("^")
+
+	rest := section
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start == -1 {
+			if strings.IndexByte(rest, '}') != -1 {
+				return nil, fmt.Errorf("unbalanced '}' in %q", section)
+			}
+			expr.WriteString(regexp.QuoteMeta(rest))
+			key.WriteString(rest)
+			p.literals = append(p.literals, rest)
+			rest = ""
+			break
+		}
+		if strings.IndexByte(rest[:start], '}') != -1 {
+			return nil, fmt.Errorf("unbalanced '}' in %q", section)
+		}
+		expr.WriteString(regexp.QuoteMeta(rest[:start]))
+		key.WriteString(rest[:start])
+		p.literals = append(p.literals, rest[:start])
+
+		// find the closing brace, regular expressions may nest them
+		end, depth := -1, 0
+		for i := start; i < len(rest) && end == -1; i++ {
+			switch rest[i] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+				if depth == 0 {
+					end = i
+				}
+			}
+		}
+		if end == -1 {
+			return nil, fmt.Errorf("unbalanced '{' in %q", section)
+		}
+
+		name, constraint, _ := strings.Cut(rest[start+1:end], ":")
+		if !paramName.MatchString(name) {
+			return nil, fmt.Errorf("invalid parameter name %q in %q", name, section)
+		}
+
+		group := constraints[constraint]
+		if constraint == "" {
+			group = `[^/]+`
+		} else if group == "" {
+			if _, err := regexp.Compile(constraint); err != nil {
+				return nil, fmt.Errorf("invalid constraint for %q in %q: %w", name, section, err)
+			}
+			group = constraint
+		}
+		fmt.Fprintf(&expr, "(?P<p%d>%s)", len(p.names), group)
+		fmt.Fprintf(&key, "{:%s}", constraint)
+		p.names = append(p.names, name)
+		p.kinds = append(p.kinds, constraint)
+		rest = rest[end+1:]
+	}
+
+	if len(p.literals) == len(p.names) {
+		p.literals = append(p.literals, "")
+	}
+
+	expr.WriteString("$")
+	regex, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", section, err)
+	}
+	p.regex = regex
+	p.key = key.String()
+	return p, nil
+}
+
+// covers reports whether p matches every section q matches, so that q
+// can never match after p. Custom regular expressions are only compared as
+// written.
+func (p *segmentPattern) covers(q *segmentPattern) bool {
+	named := true
+	for _, kind := range q.kinds {
+		if kind != "" && constraints[kind] == "" {
+			named = false
+		}
+	}
+	// a lone parameter takes any section, named constraints never match
+	// a slash or nothing
+	if named && len(p.names) == 1 && p.kinds[0] == "" && p.literals[0] == "" && p.literals[1] == "" {
+		return true
+	}
+	if len(p.names) != len(q.names) {
+		return false
+	}
+	for i, kind := range p.kinds {
+		if p.literals[i] != q.literals[i] {
+			return false
+		}
+		if kind != q.kinds[i] && (kind != "" || constraints[q.kinds[i]] == "") {
+			return false
+		}
+	}
+	return p.literals[len(p.names)] == q.literals[len(q.names)]
+}
+
+// match returns the captures of section, or false when the section doesn't
+// fit the pattern or a typed value doesn't parse
+func (p *segmentPattern) match(section string) ([]capture, bool) {
+	decoded, err := url.PathUnescape(section)
+	if err != nil {
+		return nil, false
+	}
+	groups := p.regex.FindStringSubmatch(decoded)
+	if groups == nil {
+		return nil, false
+	}
+
+	captures := make([]capture, 0, len(p.names))
+	for i, name := range p.names {
+		value := groups[p.regex.SubexpIndex(fmt.Sprintf("p%d", i))]
+		var typed any
+		switch p.kinds[i] {
+		case "int":
+			typed, err = strconv.ParseInt(value, 10, 64)
+		case "uint":
+			typed, err = strconv.ParseUint(value, 10, 64)
+		case "float":
+			typed, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return nil, false
+		}
+		captures = append(captures, capture{name: name, value: value, typed: typed})
+	}
+	return captures, true
+}
+
+// capture is a parameter value found while matching a route
+type capture struct {
+	name  string
+	value string
+	typed any
+}
@@ -1,9 +1,22 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/http2"
+	"vivalchemy/http-server-from-scratch/proxyproto"
 	"vivalchemy/http-server-from-scratch/request"
 	"vivalchemy/http-server-from-scratch/response"
 )
@@ -17,43 +30,312 @@ const (
 	MethodPut     HTTPMethod = "PUT"
 	MethodPatch   HTTPMethod = "PATCH"
 	MethodOptions HTTPMethod = "OPTIONS"
+	MethodConnect HTTPMethod = "CONNECT"
 	// MethodHead    HTTPMethod = "HEAD"
-	// MethodConnect HTTPMethod = "CONNECT"
 	// MethodTrace   HTTPMethod = "TRACE"
 )
 
+// DefaultMaxPipelined is the MaxPipelined of a Server leaving it 0
+const DefaultMaxPipelined = 16
+
+// Server routes requests to its own Router unless a virtual host from Host
+// matches the request
 type Server struct {
-	closed   bool
+	*Router
+	closed   atomic.Bool
 	listener net.Listener
-	tree     *PathTreeNode
+	hosts    []*virtualHost
+	ctx      context.Context // parent of every request context
+	cancel   context.CancelFunc
+	connID   atomic.Uint64
+
+	// RequestTimeout is the deadline of the request context, none when 0
+	RequestTimeout time.Duration
+	// IdleTimeout closes a connection waiting that long for its next
+	// request, ReadHeaderTimeout one taking that long to send the request
+	// line and headers. None when 0.
+	IdleTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	// MaxBodySize rejects requests with a larger Content-Length with 413
+	// before reading their body, and chunked bodies once they grow past it,
+	// no limit when 0
+	MaxBodySize int
+	// CheckContinue decides on the requests sending Expect: 100-continue
+	// before their body is read, once a route was found. Returning an
+	// error answers with it instead of 100 Continue, an HTTPError picking
+	// the status and 417 Expectation Failed otherwise. HTTP/2 requests are
+	// only served once their body arrived and skip it.
+	CheckContinue func(req *request.Request) error
+	// MaxConnHandlers caps the handlers running at once for the pipelined
+	// requests of one connection, no limit when 0. Their responses are
+	// written in request order either way.
+	MaxConnHandlers int
+	// MaxPipelined caps the responses of one connection waiting to go out,
+	// DefaultMaxPipelined when 0. No more requests are read from the
+	// connection until one is written.
+	MaxPipelined int
+	// ObsFoldPolicy decides on the obs-fold lines of the request headers,
+	// rejected with 400 by default, see headers.ObsFoldPolicy
+	ObsFoldPolicy headers.ObsFoldPolicy
+	// DisableHTTP2 answers the HTTP/2 connection preface with 505 and
+	// ignores "Upgrade: h2c", see the http2 package
+	DisableHTTP2 bool
+	// ProxyProtocol makes Serve expect a PROXY protocol header on every
+	// connection, see the proxyproto package
+	ProxyProtocol bool
+	// trustedProxies may set the client address through forwarding headers
+	trustedProxies []*net.IPNet
+
+	// Hooks answering the requests no route handler served, they default
+	// to RenderError. ErrorHandler gets the panics of handlers and
+	// the errors returned through HandleErr.
+	NotFoundHandler         ErrorHandler
+	MethodNotAllowedHandler ErrorHandler
+	BadRequestHandler       ErrorHandler
+	ErrorHandler            ErrorHandler
 }
 
 func NewServer() *Server {
-	return &Server{closed: false, listener: nil, tree: NewPathTree()}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{Router: NewRouter(), listener: nil, ctx: ctx, cancel: cancel}
 }
 
-func (s *Server) handle(conn io.ReadWriteCloser) {
-	defer conn.Close()
+func (s *Server) handle(netConn net.Conn) {
+	hijacked := atomic.Bool{}
+	defer func() {
+		if !hijacked.Load() {
+			netConn.Close()
+		}
+	}()
+	conn := &conn{Conn: netConn, id: s.connID.Add(1), start: time.Now()}
 
-	responseWriter := response.NewWriter(conn)
-	headers := response.GetDefaultHeaders(0)
-	r, err := request.RequestFromReader(conn)
-	if err != nil {
-		responseWriter.WriteStatusLine(response.StatusBadRequest)
-		responseWriter.WriteHeaders(*headers)
-		return
+	// connCtx is cancelled when the client hangs up, ending every request
+	// in flight on the connection
+	connCtx, hangup := context.WithCancel(s.ctx)
+	defer hangup()
+	// Close ends idle connections waiting for their next request too
+	stop := context.AfterFunc(s.ctx, func() { netConn.SetReadDeadline(aLongTimeAgo) })
+	defer stop()
+
+	reader := newConnReader(conn)
+	requests := request.NewReader(reader)
+	requests.MaxBodySize = s.MaxBodySize
+	requests.ObsFoldPolicy = s.ObsFoldPolicy
+	responses := newPipeline(conn, func() { netConn.Close() })
+	handlers := &sync.WaitGroup{}
+	var limit chan struct{}
+	if s.MaxConnHandlers > 0 {
+		limit = make(chan struct{}, s.MaxConnHandlers)
+	}
+
+	maxPipelined := s.MaxPipelined
+	if maxPipelined <= 0 {
+		maxPipelined = DefaultMaxPipelined
+	}
+
+	for s.ctx.Err() == nil {
+		if responses.full(maxPipelined) {
+			// keep noticing a client hanging up while the responses drain
+			reader.startBackgroundRead(hangup)
+			responses.wait(maxPipelined)
+		}
+		timeouts := s.IdleTimeout > 0 || s.ReadHeaderTimeout > 0
+		if timeouts {
+			// the background read would clear the deadlines
+			reader.abortBackgroundRead()
+		}
+		if s.IdleTimeout > 0 {
+			s.setReadDeadline(netConn, s.IdleTimeout)
+			if err := requests.Wait(); err != nil {
+				hangup()
+				break
+			}
+		}
+		if timeouts {
+			s.setReadDeadline(netConn, s.ReadHeaderTimeout)
+		}
+		r, err := requests.ReadHeaders()
+		if timeouts {
+			s.setReadDeadline(netConn, 0)
+		}
+		if err != nil {
+			if isConnError(err) {
+				hangup()
+				break
+			}
+			if errors.Is(err, request.ErrorHTTP2Preface) && conn.requests.Load() == 0 && !s.DisableHTTP2 {
+				buffered := bytes.NewReader(requests.Buffered())
+				s.serveHTTP2(connCtx, conn, io.MultiReader(buffered, reader), nil)
+				break
+			}
+			slot := responses.add()
+			w := response.NewWriter(slot)
+			w.SetKeepAlive(false)
+			errorHandler(s.BadRequestHandler)(w, nil, badRequestStatus(err), err)
+			slot.finish(true)
+			break
+		}
+		r.ConnInfo = conn.next()
+		r.RemoteAddr = s.clientAddr(r)
+
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if s.RequestTimeout > 0 {
+			ctx, cancel = context.WithTimeout(connCtx, s.RequestTimeout)
+		} else {
+			ctx, cancel = context.WithCancel(connCtx)
+		}
+		r.SetContext(ctx)
+
+		slot := responses.add()
+		if r.Upgrade() && !r.BodyPending() && !s.DisableHTTP2 && http2.IsUpgrade(r) {
+			cancel()
+			// the responses before it go out first, HTTP/2 frames follow
+			handlers.Wait()
+			if slot.hijack() == nil {
+				buffered := bytes.NewReader(requests.Buffered())
+				s.serveHTTP2(connCtx, conn, io.MultiReader(buffered, reader), r)
+			}
+			return
+		}
+		w := response.NewWriter(slot)
+		w.SetHttpVersion(r.HttpVersion)
+		// a body left unread can't be told apart from the next request
+		keepAlive := r.HttpVersion == "1.1" && r.KeepAlive() && s.ctx.Err() == nil
+		w.SetKeepAlive(keepAlive && !r.BodyPending())
+		// nothing is read past an upgrade or CONNECT request, so its handler
+		// can take the connection over
+		upgrade := r.Upgrade() || r.Method == string(MethodConnect)
+		if upgrade {
+			w.SetHijacker(func() (net.Conn, *bufio.Reader, error) {
+				if err := slot.hijack(); err != nil {
+					return nil, nil, err
+				}
+				hijacked.Store(true)
+				stop()
+				buffered := bytes.NewReader(requests.Buffered())
+				return netConn, bufio.NewReader(io.MultiReader(buffered, reader)), nil
+			})
+		}
+
+		handler, streamBody := s.route(w, r)
+		streamBody = streamBody && r.BodyPending()
+		// the body is only read once the request has a handler
+		var body *streamedBody
+		if handler != nil && s.readBody(requests, w, r, streamBody) {
+			if streamBody {
+				// the connection is kept once the handler read the body
+				body = newStreamedBody(r.BodyStream, func() { w.SetKeepAlive(keepAlive) })
+				r.BodyStream = body
+			} else {
+				w.SetKeepAlive(keepAlive)
+			}
+		} else {
+			handler = nil
+		}
+		// a streamed body is pending until the handler reads it
+		keepAlive = keepAlive && (body != nil || !r.BodyPending())
+
+		if limit != nil {
+			select {
+			case limit <- struct{}{}:
+			default:
+				// keep noticing a client hanging up while waiting for a handler
+				reader.startBackgroundRead(hangup)
+				limit <- struct{}{}
+			}
+		}
+		handlers.Add(1)
+		finished := make(chan struct{})
+		go func() {
+			defer handlers.Done()
+			defer cancel()
+			defer close(finished)
+			if handler != nil {
+				s.serve(handler, w, r)
+			}
+			if limit != nil {
+				<-limit
+			}
+			slot.finish(!keepAlive || w.Closing() || body != nil && !body.consumed())
+		}()
+
+		if body != nil {
+			// the next request follows the body the handler is reading
+			select {
+			case <-body.done:
+			case <-finished:
+			}
+			if !body.consumed() {
+				reader.startBackgroundRead(hangup)
+				break
+			}
+		}
+
+		if upgrade {
+			handlers.Wait()
+			if hijacked.Load() {
+				return
+			}
+		}
+		if !keepAlive {
+			reader.startBackgroundRead(hangup)
+			break
+		}
+	}
+	handlers.Wait()
+}
+
+// route finds the handler of a request and whether it streams the body.
+// When there is none it answers the request itself and returns nil.
+func (s *Server) route(w *response.Writer, r *request.Request) (Handler, bool) {
+	if r.TargetForm == request.FormAsterisk {
+		// OPTIONS * asks about the server as a whole
+		headers := response.GetDefaultHeaders(0)
+		headers.Delete("Content-Type")
+		headers.Set("Allow", strings.Join(s.methods(), ", "))
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*headers)
+		return nil, false
+	}
+
+	r.StrippedPath = r.TargetPath
+	path := r.TargetPath
+	if r.TargetForm == request.FormAuthority {
+		// CONNECT has no path, see Router.Connect
+		path = "/"
 	}
 
-	// NOTE: read the request path here
-	// instead of this use the tree from the server
-	handler, err := s.tree.find(HTTPMethod(r.Method), r.TargetPath)
+	router := s.routerFor(r.Host)
+	handler, streamBody, err := router.tree.find(HTTPMethod(r.Method), path)
+	if errors.Is(err, HandlerErrorMethodNotAllowed) {
+		err = &MethodNotAllowedError{Allowed: s.allowed(router, path)}
+		errorHandler(s.MethodNotAllowedHandler)(w, r, response.StatusMethodNotAllowed, err)
+		return nil, false
+	}
 	if err != nil {
-		responseWriter.WriteStatusLine(response.StatusNotFound)
-		responseWriter.WriteHeaders(*headers)
-		return
+		errorHandler(s.NotFoundHandler)(w, r, response.StatusNotFound, err)
+		return nil, false
 	}
+	return handler, streamBody
+}
 
-	handler(responseWriter, r)
+// serve runs the handler, turning a panic into a call to the ErrorHandler
+// when the handler hasn't started its response yet
+func (s *Server) serve(handler Handler, res *response.Writer, req *request.Request) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := fmt.Errorf("handler panic: %v", v)
+			if res.Status() != 0 {
+				// too late for an error response, the connection is closed
+				log.Printf("%s %s: %v", req.Method, req.TargetPath, err)
+				res.SetKeepAlive(false)
+				return
+			}
+			errorHandler(s.ErrorHandler)(res, req, response.StatusInternalServerError, err)
+		}
+	}()
+	handler(res, req)
 }
 
 func (s *Server) run(listener net.Listener) {
@@ -62,59 +344,90 @@ func (s *Server) run(listener net.Listener) {
 		if err != nil {
 			return
 		}
-		if s.closed {
+		if s.closed.Load() {
 			return
 		}
 		go s.handle(conn)
 	}
 }
 
+// Err returns the registration errors of every router of the server
+func (s *Server) Err() error {
+	errs := []error{}
+	for _, router := range s.routers() {
+		errs = append(errs, router.Err())
+	}
+	return errors.Join(errs...)
+}
+
+// Serve starts listening on port. It refuses to start when a route failed
+// to register, returning every registration error.
 func (s *Server) Serve(port uint16) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
 
-	s.addOptions() // recursively add the options to each node of the tree
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return err
 	}
+	if s.ProxyProtocol {
+		listener = proxyproto.NewListener(listener)
+	}
+	return s.ServeListener(listener)
+}
+
+// ServeListener serves the connections accepted by listener, like Serve
+func (s *Server) ServeListener(listener net.Listener) error {
+	if err := s.Err(); err != nil {
+		listener.Close()
+		return err
+	}
+
+	s.addOptions() // recursively add the options to each node of the tree
+	s.listener = listener
 	go s.run(listener)
 
 	return nil
 }
 
+// Addr returns the address the server listens on, nil before Serve
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops accepting connections and cancels the context of every
+// request in flight
 func (s *Server) Close() error {
-	s.closed = true
+	s.closed.Store(true)
+	s.cancel()
 	if s.listener != nil {
 		s.listener.Close()
 	}
 	return nil
 }
 
-// NOTE: add the methods to the server here
-func (s *Server) Get(path string, handler Handler) {
-	s.tree.add(MethodGet, path, handler)
-}
-
-func (s *Server) Post(path string, handler Handler) {
-	s.tree.add(MethodPost, path, handler)
-}
-
-func (s *Server) Put(path string, handler Handler) {
-	s.tree.add(MethodPut, path, handler)
-}
-
-func (s *Server) Delete(path string, handler Handler) {
-	s.tree.add(MethodDelete, path, handler)
-}
+// methods lists every method that has at least one route
+func (s *Server) methods() []string {
+	seen := map[HTTPMethod]bool{}
+	for _, router := range s.routers() {
+		router.tree.collectMethods(seen)
+	}
 
-func (s *Server) Patch(path string, handler Handler) {
-	s.tree.add(MethodPatch, path, handler)
+	methods := []string{}
+	for method := range seen {
+		methods = append(methods, string(method))
+	}
+	sort.Strings(methods)
+	return methods
 }
 
 func (s *Server) addOptions() {
-	// traverse the tree and add the options handler to all the leaf nodes
-	s.tree.addOptions()
-}
-
-func (s *Server) AddHandler(method HTTPMethod, path string, handler Handler) {
-	s.tree.add(method, path, handler)
+	// traverse the trees and add the options handler to all the leaf nodes
+	for _, router := range s.routers() {
+		router.tree.addOptions()
+	}
 }
@@ -0,0 +1,1199 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip sends raw over an in-memory connection and returns everything
+// the server wrote before closing it
+func roundTrip(t *testing.T, s *Server, raw string) string {
+	t.Helper()
+	// ask HTTP/1.1 connections to close after the response, so reading
+	// until the server hangs up returns it
+	if line, rest, ok := strings.Cut(raw, "\r\n"); ok && strings.HasSuffix(line, "HTTP/1.1") &&
+		!strings.Contains(strings.ToLower(rest), "\r\nconnection:") && !strings.HasPrefix(strings.ToLower(rest), "connection:") {
+		raw = line + "\r\nConnection: close\r\n" + rest
+	}
+	client, conn := net.Pipe()
+	go s.handle(conn)
+	go func() {
+		client.Write([]byte(raw))
+	}()
+
+	out, err := io.ReadAll(client)
+	if err != nil && err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func textHandler(text string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(len(text))
+		w.WriteStatusLine(response.StatusOk)
+		w.WriteHeaders(*h)
+		w.WriteBody([]byte(text))
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	s := NewServer()
+	s.Get("/", textHandler("default"))
+	s.Host("api.example.com").Get("/", textHandler("api"))
+	s.Host("*.example.com").Get("/", textHandler("wildcard"))
+	s.Host("*.eu.example.com").Get("/", textHandler("eu"))
+	s.addOptions()
+
+	// Test: Exact host, port and case are ignored
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: API.example.com:5173\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\napi"), out)
+
+	// Test: Wildcard subdomain
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nwildcard"), out)
+
+	// Test: Longest wildcard wins
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: a.b.eu.example.com\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\neu"), out)
+
+	// Test: Unknown host falls back to the default routes
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\ndefault"), out)
+
+	// Test: absolute-form authority overrides the Host header
+	out = roundTrip(t, s, "GET http://api.example.com/ HTTP/1.1\r\nHost: other.org\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\napi"), out)
+
+	// Test: HTTP/1.0 without Host uses the default routes
+	out = roundTrip(t, s, "GET / HTTP/1.0\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\ndefault"), out)
+}
+
+func TestHostHeaderValidation(t *testing.T) {
+	s := NewServer()
+	s.Get("/", textHandler("default"))
+	s.addOptions()
+
+	// Test: Missing Host
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+
+	// Test: Two Host headers
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: a.com\r\nHost: b.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+
+	// Test: Invalid Host
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: a b.com\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: a.com:http\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+
+	// Test: IP literal
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: [::1]:5173\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+}
+
+func TestHeaderLimit(t *testing.T) {
+	s := NewServer()
+	s.Get("/", textHandler("default"))
+
+	// Test: Heads past request.MaxHeaderBytes are answered with 431
+	out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Filler: "+strings.Repeat("a", request.MaxHeaderBytes)+"\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 431 Request Header Fields Too Large\r\n"), out)
+	assert.Contains(t, out, "connection: close\r\n")
+}
+
+func TestObsFold(t *testing.T) {
+	echo := func(w *response.Writer, req *request.Request) {
+		folded, _ := req.Headers.Get("X-Folded")
+		textHandler(folded)(w, req)
+	}
+	s := NewServer()
+	s.Get("/", echo)
+	const folded = "GET / HTTP/1.1\r\nHost: localhost\r\nX-Folded: first\r\n second\r\n\r\n"
+
+	// Test: obs-fold lines are rejected by default
+	out := roundTrip(t, s, folded)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+
+	// Test: ObsFoldPolicy of the server applies to its connections only
+	other := NewServer()
+	other.ObsFoldPolicy = headers.ObsFoldReplace
+	other.Get("/", echo)
+	out = roundTrip(t, other, folded)
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nfirst second"), out)
+	out = roundTrip(t, s, folded)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"), out)
+}
+
+func TestRouteGroups(t *testing.T) {
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				req.Headers.Set("X-Trace", name)
+				next(w, req)
+			}
+		}
+	}
+	echoTrace := func(w *response.Writer, req *request.Request) {
+		trace, _ := req.Headers.Get("X-Trace")
+		textHandler(trace)(w, req)
+	}
+
+	s := NewServer()
+	api := s.Group("/api", trace("api"))
+	api.Get("/status", echoTrace)
+	v1 := api.Group("/v1/", trace("v1"))
+	v1.Get("/", echoTrace)
+	v1.Post("users", echoTrace)
+	s.Host("admin.example.com").Group("/api").Get("/status", textHandler("admin"))
+	s.addOptions()
+
+	// Test: Group prefix and middleware
+	out := roundTrip(t, s, "GET /api/status HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\napi"), out)
+
+	// Test: Nested group runs parent middleware first
+	out = roundTrip(t, s, "GET /api/v1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\napi,v1"), out)
+	out = roundTrip(t, s, "POST /api/v1/users HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\napi,v1"), out)
+
+	// Test: Group on a virtual host
+	out = roundTrip(t, s, "GET /api/status HTTP/1.1\r\nHost: admin.example.com\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nadmin"), out)
+
+	// Test: Group routes don't leak outside the prefix
+	out = roundTrip(t, s, "GET /status HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"), out)
+}
+
+func TestMount(t *testing.T) {
+	echoPath := func(w *response.Writer, req *request.Request) {
+		textHandler(req.MountPrefix+" "+req.StrippedPath)(w, req)
+	}
+
+	admin := NewRouter()
+	admin.Get("/", echoPath)
+	admin.Get("/users", echoPath)
+	reports := NewRouter()
+	reports.Get("/daily", echoPath)
+	admin.Mount("/reports", reports)
+
+	s := NewServer()
+	s.Get("/*", textHandler("catch all"))
+	s.Mount("/admin", admin)
+	s.Group("/ext").Mount("/proxy", Handler(echoPath))
+	s.addOptions()
+
+	// Test: Mounted router sees the stripped path
+	out := roundTrip(t, s, "GET /admin/users?page=2 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n/admin /users?page=2"), out)
+
+	// Test: Mount point itself
+	out = roundTrip(t, s, "GET /admin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n/admin /"), out)
+
+	// Test: Nested mounts add up
+	out = roundTrip(t, s, "GET /admin/reports/daily HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n/admin/reports /daily"), out)
+
+	// Test: Mounted router misses don't fall back to the parent
+	out = roundTrip(t, s, "GET /admin/missing HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"), out)
+
+	// Test: Handler takes any method and path under the prefix
+	out = roundTrip(t, s, "POST /ext/proxy/a/b HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n/ext/proxy /a/b"), out)
+
+	// Test: Routes outside of mounts keep the full path
+	out = roundTrip(t, s, "GET /elsewhere HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\ncatch all"), out)
+}
+
+func TestRegistrationErrors(t *testing.T) {
+	s := NewServer()
+	require.NoError(t, s.Get("/users/{id}", textHandler("user")))
+	api := s.Group("/api")
+	require.NoError(t, api.Get("/status", textHandler("status")))
+	err := api.Get("/status", textHandler("status")) // second registration
+	require.ErrorIs(t, err, RouteErrorDuplicate)
+	assert.Regexp(t, `at server_test.go:\d+: duplicate route: GET handler already registered at server_test.go:\d+$`, err.Error())
+
+	mounted := NewRouter()
+	require.ErrorIs(t, mounted.Get("/a/*/b", textHandler("bad")), RouteErrorInvalid)
+	require.NoError(t, s.Mount("/mounted", mounted))
+	s.Host("bad host")
+
+	// Test: Serve refuses to start and reports every error
+	err = s.Serve(0)
+	require.Error(t, err)
+	require.ErrorIs(t, err, RouteErrorDuplicate)
+	require.ErrorIs(t, err, RouteErrorInvalid)
+	assert.Equal(t, 3, strings.Count(err.Error(), "\n")+1, err.Error())
+	assert.Nil(t, s.listener)
+}
+
+func logRequests(next Handler) Handler {
+	return next
+}
+
+func TestRoutes(t *testing.T) {
+	s := NewServer()
+	s.Get("/users/{id:int}", textHandler("user"))
+	s.Post("/users", textHandler("create"))
+	s.Group("/api", logRequests).Get("/status", textHandler("status"))
+	admin := NewRouter()
+	admin.Delete("/cache", textHandler("purge"))
+	s.Mount("/admin", admin)
+	s.Mount("/proxy", Handler(textHandler("proxy")))
+	s.Host("api.example.com").Get("/", textHandler("api"))
+	s.addOptions()
+
+	routes := s.Routes()
+	summary := []string{}
+	for _, route := range routes {
+		summary = append(summary, route.Host+" "+string(route.Method)+" "+route.Pattern)
+	}
+	assert.Equal(t, []string{
+		" DELETE /admin/cache",
+		" GET /api/status",
+		" * /proxy/*",
+		" POST /users",
+		" GET /users/{id:int}",
+		"api.example.com GET /",
+	}, summary)
+	assert.Equal(t, []string{"vivalchemy/http-server-from-scratch/server.logRequests"}, routes[1].Middlewares)
+	assert.Equal(t, "vivalchemy/http-server-from-scratch/server.textHandler.func1", routes[1].Handler)
+	assert.Regexp(t, `^server_test.go:\d+$`, routes[1].Site)
+
+	// Test: JSON debug endpoint
+	s.Get("/debug/routes", s.RoutesHandler())
+	out := roundTrip(t, s, "GET /debug/routes HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, out, "content-type: application/json\r\n")
+	assert.Contains(t, out, `"pattern": "/admin/cache"`)
+}
+
+func TestURL(t *testing.T) {
+	s := NewServer()
+	require.NoError(t, s.AddHandler(MethodGet, "/users/{id:int}", textHandler("user"), Name("user")))
+	require.NoError(t, s.AddHandler(MethodGet, "/files/{name}.{ext:[a-z]+}", textHandler("file"), Name("file")))
+	require.NoError(t, s.AddHandler(MethodGet, "/static/*", textHandler("static"), Name("static")))
+	require.NoError(t, s.Group("/api/v1").AddHandler(MethodGet, "/", textHandler("api"), Name("api")))
+	admin := NewRouter()
+	require.NoError(t, admin.AddHandler(MethodGet, "/reports/{day}", textHandler("report"), Name("report")))
+	require.NoError(t, s.Mount("/admin", admin))
+
+	// Test: Parameters and query
+	u, err := s.URL("user", "id", "42", "tab", "posts & likes")
+	require.NoError(t, err)
+	assert.Equal(t, "/users/42?tab=posts+%26+likes", u)
+
+	// Test: Values are percent-encoded
+	u, err = s.URL("file", "name", "my report?v2", "ext", "pdf")
+	require.NoError(t, err)
+	assert.Equal(t, "/files/my%20report%3Fv2.pdf", u)
+
+	// Test: Wildcard remainder keeps its slashes
+	u, err = s.URL("static", "*", "css/site main.css")
+	require.NoError(t, err)
+	assert.Equal(t, "/static/css/site%20main.css", u)
+
+	// Test: Group prefix and mounted routers
+	u, err = s.URL("api")
+	require.NoError(t, err)
+	assert.Equal(t, "/api/v1", u)
+	u, err = s.URL("report", "day", "2026-10-19")
+	require.NoError(t, err)
+	assert.Equal(t, "/admin/reports/2026-10-19", u)
+
+	// Test: Errors
+	_, err = s.URL("nope")
+	require.ErrorIs(t, err, URLErrorUnknownRoute)
+	_, err = s.URL("user")
+	require.ErrorIs(t, err, URLErrorMissingParam)
+	_, err = s.URL("user", "id")
+	require.ErrorIs(t, err, URLErrorParams)
+	_, err = s.URL("user", "id", "forty-two")
+	require.ErrorIs(t, err, URLErrorConstraint)
+	_, err = s.URL("file", "name", "report", "ext", "PDF")
+	require.ErrorIs(t, err, URLErrorConstraint)
+	_, err = s.URL("report", "day", "2026/10/19")
+	require.ErrorIs(t, err, URLErrorConstraint)
+
+	// Test: Names are unique per router
+	err = s.AddHandler(MethodGet, "/people/{id}", textHandler("person"), Name("user"))
+	require.ErrorIs(t, err, RouteErrorDuplicate)
+	require.NoError(t, s.AddHandler(MethodDelete, "/users/{id:int}", textHandler("delete"), Name("user")))
+
+	// Test: Built URLs route back to the named route
+	s.addOptions()
+	u, _ = s.URL("file", "name", "a b", "ext", "txt")
+	out := roundTrip(t, s, "GET "+u+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nfile"), out)
+}
+
+func TestErrorHandlers(t *testing.T) {
+	type call struct {
+		status response.StatusCode
+		err    error
+		hasReq bool
+	}
+	calls := []call{}
+	hook := func(w *response.Writer, req *request.Request, status response.StatusCode, err error) {
+		calls = append(calls, call{status: status, err: err, hasReq: req != nil})
+		textHandler("branded")(w, req)
+	}
+
+	s := NewServer()
+	s.Get("/users", textHandler("users"))
+	s.Post("/users", textHandler("create"))
+	s.Get("/panic", func(w *response.Writer, req *request.Request) { panic("boom") })
+	s.NotFoundHandler = hook
+	s.MethodNotAllowedHandler = hook
+	s.BadRequestHandler = hook
+	s.ErrorHandler = hook
+	s.addOptions()
+
+	// Test: Routing miss
+	out := roundTrip(t, s, "GET /missing HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nbranded"), out)
+	require.Len(t, calls, 1)
+	assert.Equal(t, response.StatusNotFound, calls[0].status)
+	assert.ErrorIs(t, calls[0].err, HandlerErrorNotFound)
+	assert.True(t, calls[0].hasReq)
+
+	// Test: Wrong method lists the allowed ones
+	roundTrip(t, s, "DELETE /users HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.Len(t, calls, 2)
+	assert.Equal(t, response.StatusMethodNotAllowed, calls[1].status)
+	assert.ErrorIs(t, calls[1].err, HandlerErrorMethodNotAllowed)
+	var notAllowed *MethodNotAllowedError
+	require.ErrorAs(t, calls[1].err, &notAllowed)
+	assert.Equal(t, []string{"GET", "OPTIONS", "POST"}, notAllowed.Allowed)
+
+	// Test: Parse failures
+	roundTrip(t, s, "GET /users\r\nHost: localhost\r\n\r\n")
+	require.Len(t, calls, 3)
+	assert.Equal(t, response.StatusBadRequest, calls[2].status)
+	assert.ErrorIs(t, calls[2].err, request.ErrorMalformedRequestLine)
+	assert.False(t, calls[2].hasReq)
+	roundTrip(t, s, "GET /users HTTP/1.2\r\nHost: localhost\r\n\r\n")
+	require.Len(t, calls, 4)
+	assert.Equal(t, response.StatusHTTPVersionNotSupported, calls[3].status)
+
+	// Test: Handler panics
+	out = roundTrip(t, s, "GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.Len(t, calls, 5)
+	assert.Equal(t, response.StatusInternalServerError, calls[4].status)
+	assert.EqualError(t, calls[4].err, "handler panic: boom")
+
+	// Test: The default renders the error and sets Allow
+	s.MethodNotAllowedHandler = nil
+	out = roundTrip(t, s, "PUT /users HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"), out)
+	assert.Contains(t, out, "allow: GET, OPTIONS, POST\r\n")
+	assert.Contains(t, out, "content-type: text/plain\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n405 Method Not Allowed\n"), out)
+}
+
+func TestHandleErr(t *testing.T) {
+	s := NewServer()
+	s.Get("/missing", s.HandleErr(func(w *response.Writer, req *request.Request) error {
+		return NewHTTPError(response.StatusNotFound, "no such <user>", fmt.Errorf("lookup failed"))
+	}))
+	s.Get("/broken", s.HandleErr(func(w *response.Writer, req *request.Request) error {
+		return fmt.Errorf("database password is hunter2")
+	}))
+	s.Get("/busy", s.HandleErr(func(w *response.Writer, req *request.Request) error {
+		err := NewHTTPError(response.StatusServiceUnavailable, "busy", nil)
+		err.RetryAfter = 1500 * time.Millisecond
+		return err
+	}))
+	s.Get("/ok", s.HandleErr(func(w *response.Writer, req *request.Request) error {
+		textHandler("fine")(w, req)
+		return nil
+	}))
+	s.addOptions()
+
+	// Test: HTTPError status and public message, JSON when preferred
+	out := roundTrip(t, s, "GET /missing HTTP/1.1\r\nHost: localhost\r\nAccept: text/html;q=0.5, application/json\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"), out)
+	assert.Contains(t, out, "content-type: application/json\r\n")
+	assert.True(t, strings.HasSuffix(out, `{"error":"Not Found","message":"no such \u003cuser\u003e","status":404}`), out)
+
+	// Test: HTML is escaped
+	out = roundTrip(t, s, "GET /missing HTTP/1.1\r\nHost: localhost\r\nAccept: text/html,*/*;q=0.8\r\n\r\n")
+	assert.Contains(t, out, "content-type: text/html\r\n")
+	assert.Contains(t, out, "<p>no such &lt;user&gt;</p>")
+
+	// Test: Other errors are a 500 that doesn't leak the cause
+	out = roundTrip(t, s, "GET /broken HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n"), out)
+	assert.Contains(t, out, "content-type: text/plain\r\n")
+	assert.NotContains(t, out, "hunter2")
+
+	// Test: RetryAfter is sent in whole seconds, rounded up
+	out = roundTrip(t, s, "GET /busy HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"), out)
+	assert.Contains(t, out, "retry-after: 2\r\n")
+
+	// Test: Hook gets the wrapped error
+	var got error
+	s.ErrorHandler = func(w *response.Writer, req *request.Request, status response.StatusCode, err error) {
+		got = err
+		RenderError(w, req, status, err)
+	}
+	roundTrip(t, s, "GET /missing HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	var httpErr *HTTPError
+	require.ErrorAs(t, got, &httpErr)
+	assert.Equal(t, response.StatusNotFound, httpErr.Status)
+	assert.EqualError(t, errors.Unwrap(got), "lookup failed")
+
+	// Test: Success
+	out = roundTrip(t, s, "GET /ok HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nfine"), out)
+}
+
+type ctxKey string
+
+func TestRequestContext(t *testing.T) {
+	cancelled := make(chan error, 1)
+	s := NewServer()
+	s.Get("/wait", func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		cancelled <- req.Context().Err()
+	})
+	withUser := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			req.SetValue(ctxKey("user"), "ada")
+			next(w, req)
+		}
+	}
+	s.addOptions()
+
+	// Test: Client hangs up
+	client, conn := net.Pipe()
+	go s.handle(conn)
+	client.Write([]byte("GET /wait HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	client.Close()
+	select {
+	case err := <-cancelled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled on hang up")
+	}
+
+	// Test: Request deadline
+	s.RequestTimeout = 10 * time.Millisecond
+	client, conn = net.Pipe()
+	go s.handle(conn)
+	client.Write([]byte("GET /wait HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	select {
+	case err := <-cancelled:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled at the deadline")
+	}
+	client.Close()
+	s.RequestTimeout = 0
+
+	// Test: Server shutdown
+	client, conn = net.Pipe()
+	go s.handle(conn)
+	client.Write([]byte("GET /wait HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	s.Close()
+	select {
+	case err := <-cancelled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled on shutdown")
+	}
+	client.Close()
+
+	// Test: Request scoped values
+	s = NewServer()
+	s.Group("/", withUser).Get("/me", func(w *response.Writer, req *request.Request) {
+		textHandler(req.Value(ctxKey("user")).(string))(w, req)
+	})
+	s.addOptions()
+	out := roundTrip(t, s, "GET /me HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nada"), out)
+}
+
+func TestConnInfo(t *testing.T) {
+	infos := make(chan request.ConnInfo, 2)
+	s := NewServer()
+	s.Get("/", func(w *response.Writer, req *request.Request) {
+		infos <- req.ConnInfo
+		textHandler("ok")(w, req)
+	})
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+
+	before := time.Now()
+	ids := []uint64{}
+	for range 2 {
+		client, err := net.Dial("tcp", s.listener.Addr().String())
+		require.NoError(t, err)
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+		io.ReadAll(client)
+		client.Close()
+
+		info := <-infos
+		assert.Equal(t, client.LocalAddr().String(), info.RemoteAddr.String())
+		assert.Equal(t, client.RemoteAddr().String(), info.LocalAddr.String())
+		assert.Equal(t, 1, info.ConnRequests)
+		assert.False(t, info.ConnStart.Before(before))
+		ids = append(ids, info.ConnID)
+	}
+
+	// Test: Every connection gets its own ID
+	assert.NotEqual(t, ids[0], ids[1])
+}
+
+func TestForwardedClient(t *testing.T) {
+	infos := make(chan request.ConnInfo, 1)
+	s := NewServer()
+	s.ProxyProtocol = true
+	assert.Error(t, s.SetTrustedProxies("10.0.0.0/33"))
+	require.NoError(t, s.SetTrustedProxies("10.0.0.0/8", "2001:db8::5"))
+	s.Get("/", func(w *response.Writer, req *request.Request) {
+		infos <- req.ConnInfo
+		textHandler("ok")(w, req)
+	})
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+
+	send := func(peer, headers string) request.ConnInfo {
+		t.Helper()
+		client, err := net.Dial("tcp", s.listener.Addr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		family := "TCP4"
+		if strings.Contains(peer, ":") {
+			family = "TCP6"
+		}
+		fmt.Fprintf(client, "PROXY %s %s %s 5000 80\r\n", family, peer, peer)
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n" + headers + "\r\n"))
+		io.ReadAll(client)
+		return <-infos
+	}
+
+	// Test: The PROXY header sets the peer address
+	info := send("192.0.2.1", "X-Forwarded-For: 203.0.113.7\r\n")
+	assert.Equal(t, "192.0.2.1:5000", info.PeerAddr.String())
+	// Test: Untrusted peers can't set the client address
+	assert.Equal(t, "192.0.2.1:5000", info.RemoteAddr.String())
+
+	// Test: The first untrusted hop from the right is the client
+	info = send("10.0.0.1", "X-Forwarded-For: 198.51.100.1, 203.0.113.7, 10.0.0.2\r\n")
+	assert.Equal(t, "10.0.0.1:5000", info.PeerAddr.String())
+	assert.Equal(t, "203.0.113.7:0", info.RemoteAddr.String())
+
+	// Test: Forwarded wins over X-Forwarded-For
+	info = send("2001:db8::5", "Forwarded: for=\"[2001:db8::1]:4711\";proto=http, for=10.0.0.3;by=_lb\r\nX-Forwarded-For: 203.0.113.7\r\n")
+	assert.Equal(t, "[2001:db8::1]:4711", info.RemoteAddr.String())
+
+	// Test: An unknown hop stops at the last trusted address
+	info = send("10.0.0.1", "Forwarded: for=unknown, for=10.0.0.4\r\n")
+	assert.Equal(t, "10.0.0.4:0", info.RemoteAddr.String())
+
+	// Test: Trusted all the way, the leftmost hop is the client
+	info = send("10.0.0.1", "X-Forwarded-For: 10.1.1.1, 10.0.0.2\r\n")
+	assert.Equal(t, "10.1.1.1:0", info.RemoteAddr.String())
+}
+
+func TestExpectContinue(t *testing.T) {
+	s := NewServer()
+	s.MaxBodySize = 10
+	s.CheckContinue = func(req *request.Request) error {
+		if _, ok := req.Headers.Get("X-Reject"); ok {
+			return errors.New("rejected")
+		}
+		return nil
+	}
+	s.Post("/echo", func(w *response.Writer, req *request.Request) {
+		textHandler(string(req.Body))(w, req)
+	})
+
+	const interim = "HTTP/1.1 100 Continue\r\n\r\n"
+	// send writes the headers and, once 100 Continue came back, the body
+	send := func(head, body string) (string, string) {
+		t.Helper()
+		client, conn := net.Pipe()
+		go s.handle(conn)
+		client.Write([]byte(head))
+
+		buf := make([]byte, len(interim))
+		n, _ := io.ReadFull(client, buf)
+		if string(buf[:n]) != interim {
+			rest, _ := io.ReadAll(client)
+			return "", string(buf[:n]) + string(rest)
+		}
+		go client.Write([]byte(body))
+		out, _ := io.ReadAll(client)
+		return string(buf), string(out)
+	}
+	head := func(length int, extra string) string {
+		return fmt.Sprintf("POST /echo HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Length: %d\r\nExpect: 100-continue\r\n%s\r\n", length, extra)
+	}
+
+	// Test: An accepted request gets 100 Continue before its body is read
+	got, out := send(head(5, ""), "hello")
+	assert.Equal(t, interim, got)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nhello"))
+
+	// Test: A body over MaxBodySize gets 413 without 100 Continue
+	got, out = send(head(50, ""), "")
+	assert.Empty(t, got)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+
+	// Test: CheckContinue rejecting gets 417
+	got, out = send(head(5, "X-Reject: 1\r\n"), "")
+	assert.Empty(t, got)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 417 Expectation Failed\r\n"))
+
+	// Test: Expectations other than 100-continue get 417
+	got, out = send(strings.Replace(head(5, ""), "100-continue", "fancy", 1), "")
+	assert.Empty(t, got)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 417 Expectation Failed\r\n"))
+
+	// Test: No route, no 100 Continue
+	got, out = send(strings.Replace(head(5, ""), "/echo", "/missing", 1), "")
+	assert.Empty(t, got)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: HTTP/1.0 clients don't wait, the body is read right away
+	out = roundTrip(t, s, "POST /echo HTTP/1.0\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\nhello")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "hello"))
+
+	// Test: MaxBodySize applies without Expect too
+	out = roundTrip(t, s, "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"))
+}
+
+// readResponse reads one Content-Length delimited response
+func readResponse(t *testing.T, r *bufio.Reader) (string, string) {
+	t.Helper()
+	head := ""
+	length := 0
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+		if line == "\r\n" {
+			break
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "content-length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			require.NoError(t, err)
+		}
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(r, body)
+	require.NoError(t, err)
+	return head, string(body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	infos := make(chan request.ConnInfo, 3)
+	s := NewServer()
+	s.Get("/", func(w *response.Writer, req *request.Request) {
+		infos <- req.ConnInfo
+		textHandler("ok")(w, req)
+	})
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+
+	client, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	// Test: HTTP/1.1 connections stay open between requests
+	for i := 1; i <= 2; i++ {
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		head, body := readResponse(t, r)
+		assert.NotContains(t, head, "connection: close")
+		assert.Equal(t, "ok", body)
+		info := <-infos
+		assert.Equal(t, i, info.ConnRequests)
+	}
+
+	// Test: A body the server didn't read closes the connection
+	client.Write([]byte("POST /missing HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+	head, _ := readResponse(t, r)
+	assert.Contains(t, head, "HTTP/1.1 404 Not Found\r\n")
+	assert.Contains(t, head, "connection: close\r\n")
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Close ends idle connections
+	client, err = net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	readResponse(t, bufio.NewReader(client))
+	<-infos
+	s.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestConnTimeouts(t *testing.T) {
+	s := NewServer()
+	s.IdleTimeout = 100 * time.Millisecond
+	s.ReadHeaderTimeout = 50 * time.Millisecond
+	s.Get("/", textHandler("ok"))
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+
+	// Test: An idle keep-alive connection is closed after IdleTimeout
+	client, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(client)
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	head, body := readResponse(t, r)
+	assert.NotContains(t, head, "connection: close")
+	assert.Equal(t, "ok", body)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A request sent within IdleTimeout keeps the connection
+	client, err = net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	r = bufio.NewReader(client)
+	for range 3 {
+		time.Sleep(20 * time.Millisecond)
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		_, body = readResponse(t, r)
+		assert.Equal(t, "ok", body)
+	}
+
+	// Test: Headers sent slower than ReadHeaderTimeout close the connection
+	client, err = net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("GET / HTTP/1.1\r\n"))
+	out, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestPipelining(t *testing.T) {
+	const pipelined = "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+		"GET /last HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"
+
+	// send writes the requests in pieces of size bytes to a server allowing
+	// limit handlers per connection. It returns the bodies of the
+	// responses in the order they came back, the order the handlers
+	// finished in and whether /last started while /slow was running.
+	send := func(limit int, size int) ([]string, []string, bool) {
+		t.Helper()
+		overlapped := false
+		lastStarted := make(chan struct{})
+		finished := make(chan string, 3)
+		handler := func(w *response.Writer, req *request.Request) {
+			body := req.Params.Get("name")
+			switch {
+			case body == "slow":
+				select {
+				case <-lastStarted:
+					overlapped = true
+				case <-time.After(50 * time.Millisecond):
+				}
+			case body == "last":
+				close(lastStarted)
+			case req.Method == "POST":
+				body = string(req.Body)
+			}
+			textHandler(body)(w, req)
+			finished <- body
+		}
+		s := NewServer()
+		s.MaxConnHandlers = limit
+		s.Get("/{name}", handler)
+		s.Post("/echo", handler)
+		require.NoError(t, s.Serve(0))
+		defer s.Close()
+
+		client, err := net.Dial("tcp", s.listener.Addr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		client.(*net.TCPConn).SetNoDelay(true)
+		go func() {
+			for i := 0; i < len(pipelined); i += size {
+				client.Write([]byte(pipelined[i:min(i+size, len(pipelined))]))
+				if size < len(pipelined) {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+
+		r := bufio.NewReader(client)
+		bodies := []string{}
+		for range 3 {
+			_, body := readResponse(t, r)
+			bodies = append(bodies, body)
+		}
+		// Test: The connection closes after the request asking for it
+		_, err = r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+
+		order := []string{}
+		for range 3 {
+			order = append(order, <-finished)
+		}
+		return bodies, order, overlapped
+	}
+
+	// Test: Coalesced requests are answered in order while the handlers
+	// run concurrently
+	bodies, _, overlapped := send(0, len(pipelined))
+	assert.Equal(t, []string{"slow", "hello", "last"}, bodies)
+	assert.True(t, overlapped)
+
+	// Test: Requests split across many reads
+	bodies, _, _ = send(0, 7)
+	assert.Equal(t, []string{"slow", "hello", "last"}, bodies)
+
+	// Test: MaxConnHandlers runs the handlers one after another
+	bodies, order, overlapped := send(1, len(pipelined))
+	assert.Equal(t, []string{"slow", "hello", "last"}, bodies)
+	assert.Equal(t, []string{"slow", "hello", "last"}, order)
+	assert.False(t, overlapped)
+
+	// Test: No more requests are read once MaxPipelined responses wait
+	started := atomic.Int64{}
+	release := make(chan struct{})
+	s := NewServer()
+	s.MaxPipelined = 2
+	s.Get("/", func(w *response.Writer, req *request.Request) {
+		started.Add(1)
+		<-release
+		textHandler("ok")(w, req)
+	})
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+	client, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.Write([]byte(strings.Repeat("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", 5)))
+	require.Eventually(t, func() bool { return started.Load() == 2 }, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(2), started.Load())
+	close(release)
+	r := bufio.NewReader(client)
+	for range 5 {
+		_, body := readResponse(t, r)
+		assert.Equal(t, "ok", body)
+	}
+	assert.Equal(t, int64(5), started.Load())
+}
+
+func TestStreamBody(t *testing.T) {
+	firstChunk := make(chan string, 1)
+	s := NewServer()
+	s.MaxBodySize = 16
+	s.AddHandler(MethodPost, "/stream", s.HandleErr(func(w *response.Writer, req *request.Request) error {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(req.BodyStream, buf); err != nil {
+			return err
+		}
+		firstChunk <- string(buf)
+		rest, err := io.ReadAll(req.BodyStream)
+		if err != nil {
+			return err
+		}
+		textHandler(string(buf)+string(rest))(w, req)
+		return nil
+	}), StreamBody())
+	s.AddHandler(MethodPost, "/skip", textHandler("skipped"), StreamBody())
+	s.Get("/", textHandler("ok"))
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+
+	client, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(client)
+
+	// Test: The handler reads the body as it comes, the next request is
+	// served once it was read to its end
+	client.Write([]byte("POST /stream HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"))
+	select {
+	case chunk := <-firstChunk:
+		assert.Equal(t, "hello", chunk)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler didn't get the first chunk")
+	}
+	client.Write([]byte("6\r\n world\r\n0\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	head, body := readResponse(t, r)
+	assert.NotContains(t, head, "connection: close")
+	assert.Equal(t, "hello world", body)
+	_, body = readResponse(t, r)
+	assert.Equal(t, "ok", body)
+
+	// Test: A body the handler didn't read closes the connection
+	client.Write([]byte("POST /skip HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+	head, body = readResponse(t, r)
+	assert.Contains(t, head, "connection: close\r\n")
+	assert.Equal(t, "skipped", body)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A body past MaxBodySize fails the read with 413
+	out := roundTrip(t, s, "POST /stream HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"5\r\nhello\r\n10\r\n0123456789abcdef\r\n0\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 413 Content Too Large\r\n"), out)
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	served := make(chan string, 10)
+	s := NewServer()
+	s.MaxBodySize = 8
+	s.Post("/echo", func(w *response.Writer, req *request.Request) {
+		served <- "echo"
+		textHandler(string(req.Body))(w, req)
+	})
+	s.Get("/admin", func(w *response.Writer, req *request.Request) {
+		served <- "admin"
+		textHandler("secret")(w, req)
+	})
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+
+	// send pipelines raw with a GET /admin hidden behind it
+	send := func(raw string) *bufio.Reader {
+		t.Helper()
+		client, err := net.Dial("tcp", s.listener.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		client.Write([]byte(raw + "GET /admin HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		return bufio.NewReader(client)
+	}
+
+	// Test: Ambiguous framing is answered with an error and the connection
+	// closes before the smuggled request is read
+	for fields, status := range map[string]string{
+		"Content-Length: 5\r\nContent-Length: 40\r\n":         "400 Bad Request",
+		"Content-Length: 5, 40\r\n":                           "400 Bad Request",
+		"Content-Length: -1\r\n":                              "400 Bad Request",
+		"Content-Length: 0x5\r\n":                             "400 Bad Request",
+		"Content-Length: \r\n":                                "400 Bad Request",
+		"Content-Length: 5\r\nTransfer-Encoding: chunked\r\n": "400 Bad Request",
+		"Transfer-Encoding: chunked, identity\r\n":            "400 Bad Request",
+		"Transfer-Encoding: gzip, chunked\r\n":                "501 Not Implemented",
+	} {
+		r := send("POST /echo HTTP/1.1\r\nHost: localhost\r\n" + fields + "\r\nhello")
+		head, _ := readResponse(t, r)
+		assert.Contains(t, head, "HTTP/1.1 "+status+"\r\n", fields)
+		assert.Contains(t, head, "connection: close\r\n", fields)
+		_, err := r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF, fields)
+	}
+	assert.Empty(t, served)
+
+	// Test: Chunked bodies are decoded and the next request is served
+	r := send("POST /echo HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n")
+	_, body := readResponse(t, r)
+	assert.Equal(t, "hello", body)
+	_, body = readResponse(t, r)
+	assert.Equal(t, "secret", body)
+	assert.ElementsMatch(t, []string{"echo", "admin"}, []string{<-served, <-served})
+
+	// Test: A malformed chunk ends the connection
+	r = send("POST /echo HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello world\r\n0\r\n\r\n")
+	head, _ := readResponse(t, r)
+	assert.Contains(t, head, "HTTP/1.1 400 Bad Request\r\n")
+	_, err := r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Empty(t, served)
+
+	// Test: Chunked bodies are held to MaxBodySize
+	r = send("POST /echo HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+	head, _ = readResponse(t, r)
+	assert.Contains(t, head, "HTTP/1.1 413 ")
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Empty(t, served)
+}
+
+func TestHijack(t *testing.T) {
+	errs := make(chan error, 1)
+	s := NewServer()
+	s.Get("/plain", func(w *response.Writer, req *request.Request) {
+		_, _, err := w.Hijack()
+		errs <- err
+		textHandler("ok")(w, req)
+	})
+	s.Get("/upgrade", func(w *response.Writer, req *request.Request) {
+		conn, r, err := w.Hijack()
+		errs <- err
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := r.ReadString('\n')
+		fmt.Fprintf(conn, "echo %s", line)
+	})
+	s.addOptions()
+
+	// Test: Only upgrade requests can be hijacked
+	out := roundTrip(t, s, "GET /plain HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.ErrorIs(t, <-errs, response.ErrorNotHijackable)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: The handler owns the connection, bytes sent right after the
+	// request included
+	out = roundTrip(t, s, "GET /upgrade HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: line\r\n\r\nhello\n")
+	require.NoError(t, <-errs)
+	assert.Equal(t, "echo hello\n", out)
+}
+
+// h2Frame encodes an HTTP/2 frame, h2Request a header block of literal fields
+func h2Frame(typ byte, flags byte, stream uint32, payload []byte) []byte {
+	out := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags}
+	out = binary.BigEndian.AppendUint32(out, stream)
+	return append(out, payload...)
+}
+
+func h2Request(method string, path string) []byte {
+	block := []byte{}
+	for _, field := range [][2]string{{":method", method}, {":scheme", "http"}, {":authority", "localhost"}, {":path", path}} {
+		block = append(block, 0x00, byte(len(field[0])))
+		block = append(block, field[0]...)
+		block = append(block, byte(len(field[1])))
+		block = append(block, field[1]...)
+	}
+	return block
+}
+
+// h2Response is the first byte of the header block of a response, the
+// indexed :status, and its body
+type h2Response struct {
+	status byte
+	body   string
+}
+
+// readH2Responses reads frames until every stream given ended and returns
+// their responses by stream, the frames may come interleaved
+func readH2Responses(t *testing.T, r *bufio.Reader, streams ...uint32) map[uint32]h2Response {
+	t.Helper()
+	responses := map[uint32]h2Response{}
+	pending := map[uint32]bool{}
+	for _, stream := range streams {
+		pending[stream] = true
+	}
+	for len(pending) > 0 {
+		head := make([]byte, 9)
+		_, err := io.ReadFull(r, head)
+		require.NoError(t, err)
+		payload := make([]byte, int(head[0])<<16|int(head[1])<<8|int(head[2]))
+		_, err = io.ReadFull(r, payload)
+		require.NoError(t, err)
+		stream := binary.BigEndian.Uint32(head[5:])
+		if !pending[stream] {
+			continue
+		}
+		res := responses[stream]
+		switch head[3] {
+		case 0x1:
+			res.status = payload[0]
+		case 0x0:
+			res.body += string(payload)
+		}
+		responses[stream] = res
+		if head[4]&0x1 != 0 {
+			delete(pending, stream)
+		}
+	}
+	return responses
+}
+
+func TestHTTP2(t *testing.T) {
+	infos := make(chan request.ConnInfo, 2)
+	s := NewServer()
+	s.Get("/", func(w *response.Writer, req *request.Request) {
+		infos <- req.ConnInfo
+		textHandler(req.HttpVersion)(w, req)
+	})
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+
+	dial := func(first string) (net.Conn, *bufio.Reader) {
+		client, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		client.Write([]byte(first))
+		return client, bufio.NewReader(client)
+	}
+	settings := h2Frame(0x4, 0, 0, nil)
+
+	// Test: The connection preface switches to HTTP/2 and streams are
+	// routed like HTTP/1.1 requests
+	client, r := dial("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	client.Write(settings)
+	client.Write(h2Frame(0x1, 0x5, 1, h2Request("GET", "/")))
+	client.Write(h2Frame(0x1, 0x5, 3, h2Request("GET", "/missing")))
+	responses := readH2Responses(t, r, 1, 3)
+	assert.Equal(t, byte(0x88), responses[1].status) // :status 200
+	assert.Equal(t, "2.0", responses[1].body)
+	assert.Equal(t, byte(0x8d), responses[3].status) // :status 404
+	// the streams are counted in the order the server took them
+	assert.Contains(t, []int{1, 2}, (<-infos).ConnRequests)
+
+	// Test: Upgrade: h2c answers the request as stream 1
+	client, r = dial("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	head, _ := readResponse(t, r)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+	client.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	client.Write(settings)
+	responses = readH2Responses(t, r, 1)
+	assert.Equal(t, byte(0x88), responses[1].status)
+	assert.Equal(t, "2.0", responses[1].body)
+	<-infos
+
+	// Test: Without HTTP/2 the preface gets 505 and upgrades are ignored
+	s.DisableHTTP2 = true
+	out := roundTrip(t, s, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 505 HTTP Version Not Supported\r\n"))
+	out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings, close\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "1.1"))
+}
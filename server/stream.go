@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// streamedBody is the BodyStream of a request whose route streams its
+// body. The connection loop waits on done before reading the next request.
+type streamedBody struct {
+	r     io.Reader
+	onEOF func()
+	done  chan struct{} // closed once the body was read to its end or failed
+	eof   bool          // set before done is closed
+	once  sync.Once
+}
+
+func newStreamedBody(r io.Reader, onEOF func()) *streamedBody {
+	return &streamedBody{r: r, onEOF: onEOF, done: make(chan struct{})}
+}
+
+// Read fails with an HTTPError carrying the status a malformed or
+// oversized body is answered with
+func (b *streamedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.once.Do(func() {
+			b.eof = true
+			b.onEOF()
+			close(b.done)
+		})
+	} else if err != nil {
+		b.once.Do(func() { close(b.done) })
+		err = NewHTTPError(badRequestStatus(err), "", err)
+	}
+	return n, err
+}
+
+// consumed reports whether the body was read to its end
+func (b *streamedBody) consumed() bool {
+	select {
+	case <-b.done:
+		return b.eof
+	default:
+		return false
+	}
+}
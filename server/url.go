@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type URLError error
+
+var (
+	URLErrorUnknownRoute URLError = fmt.Errorf("unknown route name")
+	URLErrorParams       URLError = fmt.Errorf("parameters must be name, value pairs")
+	URLErrorMissingParam URLError = fmt.Errorf("missing route parameter")
+	URLErrorConstraint   URLError = fmt.Errorf("route parameter does not match its constraint")
+)
+
+// pattern returns the full pattern of a named route, looking into the
+// mounted routers too
+func (reg *registry) pattern(name string) (string, bool) {
+	if pattern, ok := reg.names[name]; ok {
+		return pattern, true
+	}
+	for _, mounted := range reg.mounted {
+		if pattern, ok := mounted.router.reg.pattern(name); ok {
+			return joinRoute(mounted.prefix, "/"+strings.Trim(pattern, "/")), true
+		}
+	}
+	return "", false
+}
+
+// URL builds the path of the route registered with Name(name). params are
+// name, value pairs: values are percent-encoded into the matching route
+// parameters and the pairs left over are appended as the query. The value
+// for a trailing "*" is given with the name "*".
+//
+//	s.AddHandler(server.MethodGet, "/users/{id:int}", userHandler, server.Name("user"))
+//	s.URL("user", "id", "42", "tab", "posts") // "/users/42?tab=posts"
+func (s *Server) URL(name string, params ...string) (string, error) {
+	for _, router := range s.routers() {
+		if pattern, ok := router.reg.pattern(name); ok {
+			return buildURL(name, pattern, params)
+		}
+	}
+	return "", fmt.Errorf("%w: %q", URLErrorUnknownRoute, name)
+}
+
+// URL builds the path of a route named in r, see Server.URL
+func (r *Router) URL(name string, params ...string) (string, error) {
+	if pattern, ok := r.reg.pattern(name); ok {
+		return buildURL(name, pattern, params)
+	}
+	return "", fmt.Errorf("%w: %q", URLErrorUnknownRoute, name)
+}
+
+func buildURL(name string, pattern string, params []string) (string, error) {
+	if len(params)%2 != 0 {
+		return "", fmt.Errorf("route %q: %w", name, URLErrorParams)
+	}
+	values := map[string]string{}
+	for i := 0; i < len(params); i += 2 {
+		values[params[i]] = params[i+1]
+	}
+	used := map[string]bool{}
+
+	sections, patterns, err := parseRoute(pattern)
+	if err != nil {
+		return "", fmt.Errorf("route %q: %w", name, err)
+	}
+
+	path := strings.Builder{}
+	for i, section := range sections {
+		switch {
+		case section == "*":
+			used["*"] = true
+			if rest := strings.Trim(values["*"], "/"); rest != "" {
+				for _, part := range strings.Split(rest, "/") {
+					path.WriteString("/" + url.PathEscape(part))
+				}
+			}
+		case patterns[i] == nil:
+			path.WriteString("/" + section)
+		default:
+			built := strings.Builder{}
+			for j, param := range patterns[i].names {
+				value, ok := values[param]
+				if !ok {
+					return "", fmt.Errorf("route %q: %w: %q", name, URLErrorMissingParam, param)
+				}
+				used[param] = true
+				built.WriteString(patterns[i].literals[j])
+				built.WriteString(url.PathEscape(value))
+			}
+			built.WriteString(patterns[i].literals[len(patterns[i].names)])
+
+			// the built section has to route back to this pattern
+			captures, ok := patterns[i].match(built.String())
+			if !ok {
+				return "", fmt.Errorf("route %q: %w: %q in section %q", name, URLErrorConstraint, built.String(), section)
+			}
+			for _, c := range captures {
+				if c.value != values[c.name] {
+					return "", fmt.Errorf("route %q: %w: %q is ambiguous in section %q", name, URLErrorConstraint, c.name, section)
+				}
+			}
+			path.WriteString("/" + built.String())
+		}
+	}
+	if path.Len() == 0 {
+		path.WriteString("/")
+	}
+
+	query := []string{}
+	for i := 0; i < len(params); i += 2 {
+		if !used[params[i]] {
+			query = append(query, url.QueryEscape(params[i])+"="+url.QueryEscape(params[i+1]))
+		}
+	}
+	if len(query) > 0 {
+		path.WriteString("?" + strings.Join(query, "&"))
+	}
+	return path.String(), nil
+}
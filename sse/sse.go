@@ -0,0 +1,179 @@
+// Package sse streams Server-Sent Events (the text/event-stream format of
+// the HTML standard) over a response.Writer.
+package sse
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+var ErrorInvalidField = fmt.Errorf("invalid event field")
+var ErrorStreamClosed = fmt.Errorf("event stream closed")
+
+// DefaultHeartbeat is the heartbeat interval of NewStream
+const DefaultHeartbeat = 15 * time.Second
+
+// Event is one event of the stream, only Data is required
+type Event struct {
+	ID    string // sets the client's last event ID, sent back in Last-Event-ID on reconnect
+	Event string // the event type, "message" when empty
+	Data  string // may span several lines
+	Retry time.Duration
+}
+
+// Stream writes events to a response. It sends a heartbeat comment when
+// nothing was written for a while, so proxies don't drop the idle
+// connection, and stops once the request context is done.
+type Stream struct {
+	mu          sync.Mutex
+	w           *response.Writer
+	req         *request.Request
+	lastEventID string
+	written     chan struct{} // a write happened, the heartbeat waits again
+	stop        chan struct{}
+	closed      bool
+}
+
+// NewStream starts the event stream response with a heartbeat every
+// DefaultHeartbeat, see NewStreamHeartbeat
+func NewStream(w *response.Writer, req *request.Request) (*Stream, error) {
+	return NewStreamHeartbeat(w, req, DefaultHeartbeat)
+}
+
+// NewStreamHeartbeat starts the event stream response, sending a heartbeat
+// comment after every interval without a write. No heartbeat when 0.
+func NewStreamHeartbeat(w *response.Writer, req *request.Request, interval time.Duration) (*Stream, error) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Transfer-Encoding", "chunked")
+	// no-transform keeps compressing proxies from holding events back and
+	// X-Accel-Buffering turns off nginx's response buffering
+	h.Set("Cache-Control", "no-cache, no-transform")
+	h.Set("X-Accel-Buffering", "no")
+	if err := w.WriteStatusLine(response.StatusOk); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(*h); err != nil {
+		return nil, err
+	}
+
+	lastEventID, _ := req.Headers.Get("last-event-id")
+	s := &Stream{
+		w:           w,
+		req:         req,
+		lastEventID: lastEventID,
+		written:     make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	if interval > 0 {
+		go s.heartbeat(interval)
+	}
+	return s, nil
+}
+
+// LastEventID is the ID of the last event a reconnecting client saw,
+// from its Last-Event-ID header, "" on the first connection
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed when the client goes away or the request times out
+func (s *Stream) Done() <-chan struct{} {
+	return s.req.Context().Done()
+}
+
+// Send writes an event. It fails with the context's error once the
+// request context is done.
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return fmt.Errorf("%w: id %q, event %q", ErrorInvalidField, e.ID, e.Event)
+	}
+
+	out := []byte{}
+	if e.ID != "" {
+		out = fmt.Appendf(out, "id: %s\n", e.ID)
+	}
+	if e.Event != "" {
+		out = fmt.Appendf(out, "event: %s\n", e.Event)
+	}
+	if e.Retry > 0 {
+		out = fmt.Appendf(out, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	// every line of the data gets a field of its own, whatever the line ending
+	data := strings.ReplaceAll(strings.ReplaceAll(e.Data, "\r\n", "\n"), "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		out = fmt.Appendf(out, "data: %s\n", line)
+	}
+	out = append(out, '\n')
+	return s.write(out)
+}
+
+// Comment writes a comment line, ignored by clients
+func (s *Stream) Comment(text string) error {
+	out := []byte{}
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		out = fmt.Appendf(out, ": %s\n", line)
+	}
+	return s.write(append(out, '\n'))
+}
+
+func (s *Stream) write(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrorStreamClosed
+	}
+	if err := s.req.Context().Err(); err != nil {
+		return err
+	}
+	if _, err := s.w.WriteChunkedBody(p); err != nil {
+		return err
+	}
+	select {
+	case s.written <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Stream) heartbeat(interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.Done():
+			return
+		case <-s.written:
+			timer.Reset(interval)
+		case <-timer.C:
+			if s.Comment("heartbeat") != nil {
+				return
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// Close stops the heartbeat and ends the response. Call it before the
+// handler returns.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	if s.req.Context().Err() != nil {
+		// the client is gone, there is no one to end the body for
+		return nil
+	}
+	return s.w.WriteChunkedBodyDone(nil)
+}
@@ -0,0 +1,119 @@
+package sse
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer lets the test read what the heartbeat goroutine writes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newRequest(lastEventID string) (*request.Request, context.CancelFunc) {
+	req := request.NewRequest()
+	if lastEventID != "" {
+		req.Headers.Set("Last-Event-ID", lastEventID)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req.SetContext(ctx)
+	return req, cancel
+}
+
+func TestStream(t *testing.T) {
+	buf := &syncBuffer{}
+	req, cancel := newRequest("41")
+	defer cancel()
+	s, err := NewStreamHeartbeat(response.NewWriter(buf), req, 0)
+	require.NoError(t, err)
+
+	// Test: The response announces an event stream
+	head := buf.String()
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, head, "content-type: text/event-stream\r\n")
+	assert.Contains(t, head, "cache-control: no-cache, no-transform\r\n")
+	assert.Contains(t, head, "x-accel-buffering: no\r\n")
+	assert.Equal(t, "41", s.LastEventID())
+
+	// Test: Every field, with multi-line data split on any line ending
+	body := len(buf.String())
+	require.NoError(t, s.Send(Event{ID: "42", Event: "update", Data: "one\ntwo\r\nthree\rfour", Retry: 3 * time.Second}))
+	assert.Equal(t, "id: 42\nevent: update\nretry: 3000\ndata: one\ndata: two\ndata: three\ndata: four\n\n",
+		dechunk(t, buf.String()[body:]))
+
+	// Test: Empty data still makes an event
+	body = len(buf.String())
+	require.NoError(t, s.Send(Event{}))
+	assert.Equal(t, "data: \n\n", dechunk(t, buf.String()[body:]))
+
+	// Test: Line breaks can't sneak into id or event
+	assert.ErrorIs(t, s.Send(Event{ID: "1\ndata: injected"}), ErrorInvalidField)
+	assert.ErrorIs(t, s.Send(Event{Event: "a\rb"}), ErrorInvalidField)
+
+	// Test: Close ends the chunked body
+	require.NoError(t, s.Close())
+	assert.True(t, strings.HasSuffix(buf.String(), "0\r\n\r\n"))
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrorStreamClosed)
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	buf := &syncBuffer{}
+	req, cancel := newRequest("")
+	s, err := NewStreamHeartbeat(response.NewWriter(buf), req, 5*time.Millisecond)
+	require.NoError(t, err)
+
+	// Test: Idle streams get heartbeat comments
+	assert.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), ": heartbeat\n\n")
+	}, time.Second, time.Millisecond)
+
+	// Test: The stream stops with the request context
+	cancel()
+	<-s.Done()
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), context.Canceled)
+	time.Sleep(20 * time.Millisecond)
+	written := buf.String()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, written, buf.String())
+	require.NoError(t, s.Close())
+	assert.False(t, strings.HasSuffix(buf.String(), "0\r\n\r\n"))
+}
+
+// dechunk returns the data of the chunks in s
+func dechunk(t *testing.T, s string) string {
+	t.Helper()
+	out := ""
+	for s != "" {
+		size, rest, ok := strings.Cut(s, "\r\n")
+		require.True(t, ok)
+		n := 0
+		for _, c := range size {
+			n = n*16 + strings.IndexRune("0123456789abcdef", c)
+		}
+		out += rest[:n]
+		s = rest[n+2:]
+	}
+	return out
+}
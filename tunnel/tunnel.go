@@ -0,0 +1,215 @@
+// Package tunnel answers CONNECT requests by dialing their host:port and
+// splicing bytes between the client and it, which makes the server a
+// forward proxy for TLS and any other TCP protocol.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+var ErrorForbiddenTarget = fmt.Errorf("tunnel target not allowed")
+var ErrorDial = fmt.Errorf("tunnel dial failed")
+var ErrorSplice = fmt.Errorf("tunnel splice failed")
+
+// DefaultDialTimeout bounds dialing the target when no Dial is set
+const DefaultDialTimeout = 10 * time.Second
+
+// Tunnel is the handler of CONNECT requests, register its ServeConnect
+// with server.Router.Connect
+type Tunnel struct {
+	// Allow decides on the target of a request, see AllowList. When nil
+	// only port 443 of public addresses is allowed: loopback, private and
+	// link-local ones are refused, whether named by the request or resolved
+	// from its host by the default dialer.
+	Allow func(req *request.Request, host string, port string) bool
+	// Dial connects to the target, a net.Dialer with DialTimeout when nil.
+	// A Dial of its own has to refuse the addresses it shouldn't reach.
+	Dial        func(ctx context.Context, network string, address string) (net.Conn, error)
+	DialTimeout time.Duration
+	// OnError gets the errors of a tunnel: ErrorForbiddenTarget, ErrorDial
+	// and ErrorSplice, the last one after the tunnel was established. They
+	// are logged when nil.
+	OnError func(req *request.Request, err error)
+}
+
+// AllowList allows the targets matching one of the host:port patterns. A
+// "*" host or port matches any, "*.example.com" matches the subdomains.
+func AllowList(patterns ...string) func(req *request.Request, host string, port string) bool {
+	return func(req *request.Request, host string, port string) bool {
+		for _, pattern := range patterns {
+			patternHost, patternPort, ok := strings.Cut(pattern, ":")
+			if !ok || patternPort != "*" && patternPort != port {
+				continue
+			}
+			if suffix, ok := strings.CutPrefix(patternHost, "*"); ok {
+				if suffix == "" || strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+					return true
+				}
+				continue
+			}
+			if strings.EqualFold(patternHost, host) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (t *Tunnel) allow(req *request.Request, host string, port string) bool {
+	if t.Allow == nil {
+		if ip := net.ParseIP(host); ip != nil && !public(ip) {
+			return false
+		}
+		return port == "443"
+	}
+	return t.Allow(req, host, port)
+}
+
+// public tells the addresses a tunnel may reach without an Allow
+func public(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsLinkLocalMulticast()
+}
+
+// refusePrivate is the Control of the default dialer without an Allow, it
+// sees the address a host name resolved to
+func refusePrivate(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !public(ip) {
+		return fmt.Errorf("%w: %s", ErrorForbiddenTarget, address)
+	}
+	return nil
+}
+
+func (t *Tunnel) report(req *request.Request, err error) {
+	if t.OnError != nil {
+		t.OnError(req, err)
+		return
+	}
+	log.Printf("CONNECT %s: %v", req.Authority, err)
+}
+
+// ServeConnect establishes the tunnel to the target of a CONNECT request.
+// Forbidden targets get 403 and ones that can't be reached 502, otherwise
+// the client gets 200 and the bytes flow both ways until either side is
+// done. An established tunnel outlives the request context, so the
+// RequestTimeout of the server only bounds dialing the target.
+func (t *Tunnel) ServeConnect(w *response.Writer, req *request.Request) {
+	if req.Method != "CONNECT" || req.TargetForm != request.FormAuthority {
+		t.reply(w, response.StatusBadRequest)
+		return
+	}
+	host, port, err := net.SplitHostPort(req.Authority)
+	if err != nil {
+		t.reply(w, response.StatusBadRequest)
+		return
+	}
+	if !t.allow(req, strings.ToLower(host), port) {
+		t.report(req, fmt.Errorf("%w: %s", ErrorForbiddenTarget, req.Authority))
+		t.reply(w, response.StatusForbidden)
+		return
+	}
+
+	upstream, err := t.dial(req)
+	if errors.Is(err, ErrorForbiddenTarget) {
+		t.report(req, err)
+		t.reply(w, response.StatusForbidden)
+		return
+	}
+	if err != nil {
+		t.report(req, fmt.Errorf("%w: %w", ErrorDial, err))
+		t.reply(w, response.StatusBadGateway)
+		return
+	}
+	conn, reader, err := w.Hijack()
+	if err != nil {
+		// HTTP/2 streams can't be taken over
+		upstream.Close()
+		t.report(req, fmt.Errorf("%w: %w", ErrorSplice, err))
+		t.reply(w, response.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	defer upstream.Close()
+
+	// a 2xx to CONNECT has no body and no framing headers, RFC 9110 9.3.6
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		t.report(req, fmt.Errorf("%w: %w", ErrorSplice, err))
+		return
+	}
+	if err := splice(conn, reader, upstream); err != nil {
+		t.report(req, fmt.Errorf("%w: %w", ErrorSplice, err))
+	}
+}
+
+func (t *Tunnel) dial(req *request.Request) (net.Conn, error) {
+	if t.Dial != nil {
+		return t.Dial(req.Context(), "tcp", req.Authority)
+	}
+	timeout := t.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if t.Allow == nil {
+		dialer.Control = refusePrivate
+	}
+	return dialer.DialContext(req.Context(), "tcp", req.Authority)
+}
+
+func (t *Tunnel) reply(w *response.Writer, status response.StatusCode) {
+	w.WriteStatusLine(status)
+	w.WriteHeaders(*response.GetDefaultHeaders(0))
+}
+
+// closeWriter is implemented by TCP connections, closing their write side
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies both ways until both sides are done. When one side stops
+// sending the other one is told through a half close, so protocols that
+// finish one direction first keep working.
+func splice(client net.Conn, clientReader io.Reader, upstream net.Conn) error {
+	errs := make([]error, 2)
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	copyHalf := func(i int, dst net.Conn, src io.Reader) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if err != nil && !closedErr(err) {
+			errs[i] = err
+		}
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			cw.CloseWrite()
+		} else {
+			// without half closes the tunnel ends with the first side done
+			client.Close()
+			upstream.Close()
+		}
+	}
+	go copyHalf(0, upstream, clientReader)
+	go copyHalf(1, client, upstream)
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// closedErr tells the errors of a side closed by the tunnel itself
+func closedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoUpstream accepts connections and echoes them until the client
+// closes its side, then answers "bye"
+func echoUpstream(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				io.WriteString(conn, "bye")
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// connect sends a CONNECT request and returns the connection with the
+// status line of the response
+func connect(t *testing.T, proxy string, target string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			return conn, r, status
+		}
+	}
+}
+
+func TestServeConnect(t *testing.T) {
+	upstream := echoUpstream(t)
+	errs := make(chan error, 1)
+	tun := &Tunnel{
+		Allow:   AllowList("127.0.0.1:*"),
+		OnError: func(req *request.Request, err error) { errs <- err },
+	}
+	s := server.NewServer()
+	s.RequestTimeout = 50 * time.Millisecond
+	s.Connect(tun.ServeConnect)
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+	proxy := s.Addr().String()
+
+	// Test: Bytes flow both ways and a half close reaches the upstream
+	conn, r, status := connect(t, proxy, upstream)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", status)
+	// the tunnel outlives the RequestTimeout
+	time.Sleep(100 * time.Millisecond)
+	io.WriteString(conn, "hello")
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(r, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	conn.(*net.TCPConn).CloseWrite()
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(rest))
+
+	// Test: Targets outside the allow list get 403
+	_, _, status = connect(t, proxy, "localhost:22")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n", status)
+	assert.ErrorIs(t, <-errs, ErrorForbiddenTarget)
+
+	// Test: Targets that can't be dialed get 502
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := listener.Addr().String()
+	listener.Close()
+	_, _, status = connect(t, proxy, closed)
+	assert.Equal(t, "HTTP/1.1 502 Bad Gateway\r\n", status)
+	assert.ErrorIs(t, <-errs, ErrorDial)
+
+	// Test: Without an Allow, host names resolving to private addresses
+	// get 403
+	s = server.NewServer()
+	s.Connect((&Tunnel{OnError: tun.OnError}).ServeConnect)
+	require.NoError(t, s.Serve(0))
+	defer s.Close()
+	_, _, status = connect(t, s.Addr().String(), "localhost:443")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n", status)
+	assert.ErrorIs(t, <-errs, ErrorForbiddenTarget)
+
+	// Test: Other methods aren't routed to the tunnel
+	conn, err = net.Dial("tcp", proxy)
+	require.NoError(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	status, _ = bufio.NewReader(conn).ReadString('\n')
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed\r\n", status)
+}
+
+func TestAllowList(t *testing.T) {
+	allow := AllowList("example.com:443", "*.internal:*", "*:8443")
+	cases := []struct {
+		host  string
+		port  string
+		allow bool
+	}{
+		{"example.com", "443", true},
+		{"EXAMPLE.com", "443", true},
+		{"example.com", "80", false},
+		{"db.internal", "5432", true},
+		{"internal", "5432", false},
+		{"anything", "8443", true},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.allow, allow(nil, strings.ToLower(tc.host), tc.port), tc.host+":"+tc.port)
+	}
+
+	// Test: Only port 443 of public addresses without an Allow
+	tun := &Tunnel{}
+	assert.True(t, tun.allow(nil, "example.com", "443"))
+	assert.True(t, tun.allow(nil, "93.184.215.14", "443"))
+	assert.False(t, tun.allow(nil, "example.com", "25"))
+	for _, host := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "0.0.0.0", "::1", "fd00::1", "::ffff:127.0.0.1"} {
+		assert.False(t, tun.allow(nil, host, "443"), host)
+	}
+}
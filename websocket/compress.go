@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// deflateTail ends every flushed deflate stream, permessage-deflate strips
+// it from the messages (RFC 7692 section 7.2.1)
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// compress deflates one message without context from earlier ones
+func compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// decompress inflates one message, refusing to grow it past limit
+func decompress(data []byte, limit int64) ([]byte, error) {
+	// the tail back and a final empty block so the reader sees the end
+	tail := strings.NewReader("\x00\x00\xff\xff\x01\x00\x00\xff\xff")
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(data), tail))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorInvalidPayload, err)
+	}
+	if int64(len(out)) > limit {
+		return nil, ErrorMessageTooBig
+	}
+	return out, nil
+}
@@ -0,0 +1,403 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	continuationFrame MessageType = 0
+	TextMessage       MessageType = 1
+	BinaryMessage     MessageType = 2
+	CloseMessage      MessageType = 8
+	PingMessage       MessageType = 9
+	PongMessage       MessageType = 10
+)
+
+// Close codes of RFC 6455 section 7.4.1
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005 // never sent, reported when a close has no code
+	CloseAbnormalClosure         = 1006 // never sent
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+)
+
+var ErrorProtocol = fmt.Errorf("websocket protocol error")
+var ErrorMessageTooBig = fmt.Errorf("websocket message too big")
+var ErrorInvalidPayload = fmt.Errorf("invalid websocket payload")
+var ErrorClosed = fmt.Errorf("websocket close sent")
+
+// CloseError is returned by ReadMessage once the peer closed the connection
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. One goroutine may read while another
+// writes, pings are answered by ReadMessage.
+type Conn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	server         bool // servers read masked frames and write unmasked ones
+	subprotocol    string
+	compress       bool // permessage-deflate was negotiated
+	maxMessageSize int64
+	frameSize      int
+	pongHandler    func(data []byte)
+	readErr        error // reads fail with it once set
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, server bool) *Conn {
+	return &Conn{conn: conn, reader: reader, server: server, maxMessageSize: DefaultMaxMessageSize}
+}
+
+// Subprotocol returns the subprotocol picked in the handshake, if any
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// NetConn returns the underlying connection
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// SetPongHandler is called with the payload of every pong received
+func (c *Conn) SetPongHandler(h func(data []byte)) {
+	c.pongHandler = h
+}
+
+// ReadMessage returns the next text or binary message, put together from
+// its fragments. When the peer closes it returns a *CloseError after
+// answering the close. A peer breaking the protocol gets a close with the
+// matching code and ReadMessage fails with ErrorProtocol,
+// ErrorMessageTooBig or ErrorInvalidPayload from then on.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	typ, data, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+		code := 0
+		switch {
+		case errors.Is(err, ErrorProtocol):
+			code = CloseProtocolError
+		case errors.Is(err, ErrorMessageTooBig):
+			code = CloseMessageTooBig
+		case errors.Is(err, ErrorInvalidPayload):
+			code = CloseInvalidFramePayloadData
+		}
+		if code != 0 {
+			c.WriteClose(code, "")
+		}
+		return 0, nil, err
+	}
+	return typ, data, nil
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	typ := continuationFrame
+	compressed := false
+	data := []byte{}
+	for {
+		f, err := c.readFrame(c.maxMessageSize - int64(len(data)))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case PingMessage:
+			if err := c.writeControl(PongMessage, f.payload); err != nil && err != ErrorClosed {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if c.pongHandler != nil {
+				c.pongHandler(f.payload)
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.closed(f.payload)
+		case continuationFrame:
+			if typ == continuationFrame {
+				return 0, nil, fmt.Errorf("%w: continuation without a message", ErrorProtocol)
+			}
+			if f.rsv1 {
+				return 0, nil, fmt.Errorf("%w: RSV1 on a continuation", ErrorProtocol)
+			}
+		default:
+			if typ != continuationFrame {
+				return 0, nil, fmt.Errorf("%w: new message before the last one ended", ErrorProtocol)
+			}
+			if f.rsv1 && !c.compress {
+				return 0, nil, fmt.Errorf("%w: RSV1 without permessage-deflate", ErrorProtocol)
+			}
+			typ, compressed = f.opcode, f.rsv1
+		}
+
+		data = append(data, f.payload...)
+		if f.fin {
+			break
+		}
+	}
+
+	if compressed {
+		var err error
+		if data, err = decompress(data, c.maxMessageSize); err != nil {
+			return 0, nil, err
+		}
+	}
+	if typ == TextMessage && !utf8.Valid(data) {
+		return 0, nil, fmt.Errorf("%w: text message is not UTF-8", ErrorInvalidPayload)
+	}
+	return typ, data, nil
+}
+
+// closed answers a close frame and returns the CloseError it carries
+func (c *Conn) closed(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return fmt.Errorf("%w: close payload of 1 byte", ErrorProtocol)
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return fmt.Errorf("%w: close code %d", ErrorProtocol, closeErr.Code)
+		}
+		if !utf8.Valid(payload[2:]) {
+			return fmt.Errorf("%w: close reason is not UTF-8", ErrorInvalidPayload)
+		}
+	}
+
+	// echo the code, a close without one is answered without one
+	echo := []byte{}
+	if closeErr.Code != CloseNoStatusReceived {
+		echo = binary.BigEndian.AppendUint16(echo, uint16(closeErr.Code))
+	}
+	c.writeControl(CloseMessage, echo)
+	return closeErr
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  MessageType
+	payload []byte
+}
+
+// readFrame reads one frame, refusing data frames larger than limit
+func (c *Conn) readFrame(limit int64) (frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{
+		fin:    head[0]&0x80 != 0,
+		rsv1:   head[0]&0x40 != 0,
+		opcode: MessageType(head[0] & 0x0f),
+	}
+	masked := head[1]&0x80 != 0
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return frame{}, fmt.Errorf("%w: payload length over 63 bits", ErrorProtocol)
+		}
+	}
+
+	if head[0]&0x30 != 0 {
+		return frame{}, fmt.Errorf("%w: RSV2 or RSV3 set", ErrorProtocol)
+	}
+	if masked != c.server {
+		return frame{}, fmt.Errorf("%w: only client frames are masked", ErrorProtocol)
+	}
+	switch f.opcode {
+	case CloseMessage, PingMessage, PongMessage:
+		if !f.fin || length > 125 || f.rsv1 {
+			return frame{}, fmt.Errorf("%w: invalid control frame", ErrorProtocol)
+		}
+	case continuationFrame, TextMessage, BinaryMessage:
+		if length > uint64(max(limit, 0)) {
+			return frame{}, ErrorMessageTooBig
+		}
+	default:
+		return frame{}, fmt.Errorf("%w: unknown opcode %d", ErrorProtocol, f.opcode)
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, key[:]); err != nil {
+			return frame{}, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return frame{}, err
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+// WriteMessage sends a text or binary message, compressed when
+// permessage-deflate was negotiated and split into FrameSize fragments
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	if typ != TextMessage && typ != BinaryMessage {
+		return fmt.Errorf("%w: message type %d", ErrorProtocol, typ)
+	}
+	compressed := false
+	if c.compress {
+		var err error
+		if data, err = compress(data); err != nil {
+			return err
+		}
+		compressed = true
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrorClosed
+	}
+	opcode := typ
+	for {
+		fragment := data
+		if c.frameSize > 0 && len(fragment) > c.frameSize {
+			fragment = data[:c.frameSize]
+		}
+		data = data[len(fragment):]
+		fin := len(data) == 0
+		if err := c.writeFrame(fin, compressed && opcode != continuationFrame, opcode, fragment); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		opcode = continuationFrame
+	}
+}
+
+// WritePing sends a ping, the pong goes to the pong handler
+func (c *Conn) WritePing(data []byte) error {
+	return c.writeControl(PingMessage, data)
+}
+
+// WriteClose starts the closing handshake, the peer's close then comes
+// back from ReadMessage as a *CloseError. Nothing can be written after it.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.writeControl(CloseMessage, append(payload, reason...))
+}
+
+// Close sends a normal close unless one was sent already and closes the
+// connection
+func (c *Conn) Close() error {
+	c.WriteClose(CloseNormalClosure, "")
+	return c.conn.Close()
+}
+
+func (c *Conn) writeControl(opcode MessageType, payload []byte) error {
+	if len(payload) > 125 {
+		return fmt.Errorf("%w: control payload over 125 bytes", ErrorProtocol)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrorClosed
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+	return c.writeFrame(true, false, opcode, payload)
+}
+
+// writeFrame writes one frame, the caller holds writeMu
+func (c *Conn) writeFrame(fin bool, rsv1 bool, opcode MessageType, payload []byte) error {
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+	out := []byte{b0}
+
+	var b1 byte
+	if !c.server {
+		b1 = 0x80
+	}
+	switch length := len(payload); {
+	case length <= 125:
+		out = append(out, b1|byte(length))
+	case length <= 0xffff:
+		out = binary.BigEndian.AppendUint16(append(out, b1|126), uint16(length))
+	default:
+		out = binary.BigEndian.AppendUint64(append(out, b1|127), uint64(length))
+	}
+
+	if c.server {
+		out = append(out, payload...)
+	} else {
+		var key [4]byte
+		rand.Read(key[:])
+		out = append(out, key[:]...)
+		start := len(out)
+		out = append(out, payload...)
+		maskBytes(key, out[start:])
+	}
+	_, err := c.conn.Write(out)
+	return err
+}
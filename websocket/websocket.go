@@ -0,0 +1,199 @@
+// Package websocket upgrades requests to WebSocket connections (RFC 6455),
+// with the permessage-deflate extension of RFC 7692 as an option.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"vivalchemy/http-server-from-scratch/headers"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+)
+
+var ErrorBadHandshake = fmt.Errorf("bad websocket handshake")
+var ErrorUnsupportedVersion = fmt.Errorf("unsupported websocket version")
+var ErrorForbiddenOrigin = fmt.Errorf("websocket origin not allowed")
+
+// acceptGUID is appended to the client key for Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultMaxMessageSize is the message size limit when none is set
+const DefaultMaxMessageSize = 32 << 20
+
+// Upgrader turns requests into WebSocket connections
+type Upgrader struct {
+	// MaxMessageSize limits a message, decompressed and with all of its
+	// fragments, DefaultMaxMessageSize when 0
+	MaxMessageSize int64
+	// FrameSize splits written messages into fragments of this size, no
+	// fragmentation when 0
+	FrameSize int
+	// Subprotocols the server speaks in order of preference
+	Subprotocols []string
+	// EnableCompression accepts permessage-deflate when the client offers it
+	EnableCompression bool
+	// CheckOrigin decides on the Origin header, by default it must be
+	// missing or name the Host of the request
+	CheckOrigin func(req *request.Request) bool
+}
+
+// Upgrade answers the handshake and takes the connection over. A request
+// that isn't a valid handshake gets an error response and
+// ErrorBadHandshake or ErrorForbiddenOrigin is returned, 426 Upgrade
+// Required for an ErrorUnsupportedVersion.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	key, err := u.checkHandshake(req)
+	if err != nil {
+		status := response.StatusBadRequest
+		h := response.GetDefaultHeaders(0)
+		switch {
+		case errors.Is(err, ErrorForbiddenOrigin):
+			status = response.StatusForbidden
+		case errors.Is(err, ErrorUnsupportedVersion):
+			status = response.StatusUpgradeRequired
+			h.Set("Sec-WebSocket-Version", "13")
+		}
+		w.WriteStatusLine(status)
+		w.WriteHeaders(*h)
+		return nil, err
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	protocol := u.subprotocol(req)
+	if protocol != "" {
+		h.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	compress := u.EnableCompression && offersDeflate(req)
+	if compress {
+		// every message is compressed on its own, so neither side keeps
+		// the window between messages
+		h.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+
+	netConn, reader, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	handshake := response.NewWriter(netConn)
+	if err := handshake.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := handshake.WriteHeaders(*h); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	c := newConn(netConn, reader, true)
+	c.subprotocol = protocol
+	c.compress = compress
+	c.frameSize = u.FrameSize
+	if u.MaxMessageSize > 0 {
+		c.maxMessageSize = u.MaxMessageSize
+	}
+	return c, nil
+}
+
+// IsUpgrade reports whether the request asks for a WebSocket
+func IsUpgrade(req *request.Request) bool {
+	upgrade, _ := req.Headers.Get("upgrade")
+	return req.Upgrade() && headers.HasToken(upgrade, "websocket")
+}
+
+// checkHandshake validates the opening handshake of RFC 6455 section 4.2.1
+// and returns the client key
+func (u *Upgrader) checkHandshake(req *request.Request) (string, error) {
+	if req.Method != "GET" || req.HttpVersion != "1.1" {
+		return "", fmt.Errorf("%w: needs a GET over HTTP/1.1", ErrorBadHandshake)
+	}
+	if !IsUpgrade(req) {
+		return "", fmt.Errorf("%w: missing Upgrade: websocket", ErrorBadHandshake)
+	}
+	if version, _ := req.Headers.Get("sec-websocket-version"); strings.TrimSpace(version) != "13" {
+		return "", fmt.Errorf("%w: %w %q", ErrorBadHandshake, ErrorUnsupportedVersion, version)
+	}
+	key, _ := req.Headers.Get("sec-websocket-key")
+	key = strings.TrimSpace(key)
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return "", fmt.Errorf("%w: invalid Sec-WebSocket-Key", ErrorBadHandshake)
+	}
+
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return "", ErrorForbiddenOrigin
+	}
+	return key, nil
+}
+
+func sameOrigin(req *request.Request) bool {
+	origin, ok := req.Headers.Get("origin")
+	if !ok {
+		return true
+	}
+	_, host, found := strings.Cut(origin, "://")
+	return found && strings.EqualFold(host, req.Host)
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// subprotocol picks the first of the server's subprotocols the client offers
+func (u *Upgrader) subprotocol(req *request.Request) string {
+	offered, _ := req.Headers.Get("sec-websocket-protocol")
+	for _, protocol := range u.Subprotocols {
+		if headers.HasToken(offered, protocol) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// offersDeflate reports whether one of the client's permessage-deflate
+// offers can be accepted. Offers limiting the server's window below the
+// 32K compress/flate always uses are declined.
+func offersDeflate(req *request.Request) bool {
+	extensions, _ := req.Headers.Get("sec-websocket-extensions")
+	for _, offer := range strings.Split(extensions, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		ok := true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch strings.TrimSpace(name) {
+			case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+			case "server_max_window_bits":
+				ok = ok && strings.Trim(strings.TrimSpace(value), `"`) == "15"
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// NewClientConn wraps a connection that already completed the handshake
+// as the client, whose frames are masked
+func NewClientConn(conn net.Conn, reader *bufio.Reader) *Conn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return newConn(conn, reader, false)
+}
@@ -0,0 +1,242 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"vivalchemy/http-server-from-scratch/request"
+	"vivalchemy/http-server-from-scratch/response"
+	"vivalchemy/http-server-from-scratch/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoServer serves an echoing WebSocket on /ws
+func echoServer(t *testing.T, u *Upgrader) string {
+	t.Helper()
+	s := server.NewServer()
+	s.Get("/ws", func(w *response.Writer, req *request.Request) {
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			typ, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.WriteMessage(typ, data)
+		}
+	})
+	require.NoError(t, s.Serve(0))
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+// dial sends the handshake and returns the connection with the response head
+func dial(t *testing.T, addr string, extra string) (net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n%s\r\n", addr, extra)
+
+	r := bufio.NewReader(conn)
+	head := ""
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+		if line == "\r\n" {
+			return conn, r, head
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	addr := echoServer(t, &Upgrader{Subprotocols: []string{"chat"}})
+
+	// Test: Handshake with the key of RFC 6455 section 1.3
+	conn, r, head := dial(t, addr, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: superchat, chat\r\nOrigin: http://"+addr+"\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, head, "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "sec-websocket-protocol: chat\r\n")
+	assert.NotContains(t, head, "sec-websocket-extensions")
+
+	// Test: Messages go both ways over the hijacked connection
+	c := NewClientConn(conn, r)
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("hello")))
+	typ, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, typ)
+	assert.Equal(t, "hello", string(data))
+
+	// Test: Closing handshake
+	require.NoError(t, c.WriteClose(CloseGoingAway, "bye"))
+	_, _, err = c.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+
+	// Test: Unsupported versions get 426
+	_, _, head = dial(t, addr, "Sec-WebSocket-Version: 8\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 426 Upgrade Required\r\n"))
+	assert.Contains(t, head, "sec-websocket-version: 13\r\n")
+
+	// Test: Other origins get 403
+	_, _, head = dial(t, addr, "Sec-WebSocket-Version: 13\r\nOrigin: http://evil.example\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden\r\n"))
+}
+
+func TestUpgradeCompression(t *testing.T) {
+	addr := echoServer(t, &Upgrader{EnableCompression: true, MaxMessageSize: 100})
+
+	// Test: Offers limiting the server window are declined
+	_, _, head := dial(t, addr, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10\r\n")
+	assert.NotContains(t, head, "sec-websocket-extensions")
+
+	// Test: permessage-deflate is negotiated
+	conn, r, head := dial(t, addr, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	assert.Contains(t, head, "sec-websocket-extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n")
+
+	c := NewClientConn(conn, r)
+	c.compress = true
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("hello hello hello")))
+	typ, data, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, typ)
+	assert.Equal(t, "hello hello hello", string(data))
+
+	// Test: The limit applies to the decompressed message
+	require.NoError(t, c.WriteMessage(BinaryMessage, make([]byte, 1000)))
+	_, _, err = c.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseMessageTooBig, closeErr.Code)
+}
+
+// pipe returns a server and a client end of an in-memory connection
+func pipe() (*Conn, *Conn) {
+	a, b := net.Pipe()
+	return newConn(a, bufio.NewReader(a), true), newConn(b, bufio.NewReader(b), false)
+}
+
+type result struct {
+	typ  MessageType
+	data []byte
+	err  error
+}
+
+func readAsync(c *Conn) chan result {
+	results := make(chan result, 1)
+	go func() {
+		typ, data, err := c.ReadMessage()
+		results <- result{typ, data, err}
+	}()
+	return results
+}
+
+func closeCode(t *testing.T, f frame) int {
+	t.Helper()
+	require.Equal(t, CloseMessage, f.opcode)
+	require.GreaterOrEqual(t, len(f.payload), 2)
+	return int(binary.BigEndian.Uint16(f.payload))
+}
+
+func TestFrames(t *testing.T) {
+	// Test: Fragments with a ping in between make one message
+	srv, client := pipe()
+	results := readAsync(srv)
+	require.NoError(t, client.writeFrame(false, false, TextMessage, []byte("hel")))
+	require.NoError(t, client.writeFrame(true, false, PingMessage, []byte("are you there")))
+	pong, err := client.readFrame(125)
+	require.NoError(t, err)
+	assert.Equal(t, PongMessage, pong.opcode)
+	assert.Equal(t, "are you there", string(pong.payload))
+	require.NoError(t, client.writeFrame(true, false, continuationFrame, []byte("lo")))
+	res := <-results
+	require.NoError(t, res.err)
+	assert.Equal(t, "hello", string(res.data))
+
+	// Test: FrameSize fragments written messages
+	srv.frameSize = 2
+	results = readAsync(client)
+	go srv.WriteMessage(BinaryMessage, []byte("hello"))
+	res = <-results
+	require.NoError(t, res.err)
+	assert.Equal(t, BinaryMessage, res.typ)
+	assert.Equal(t, "hello", string(res.data))
+	srv.frameSize = 0
+
+	// Test: Messages over the limit
+	srv.maxMessageSize = 4
+	results = readAsync(srv)
+	go client.WriteMessage(BinaryMessage, []byte("too long"))
+	f, err := client.readFrame(125)
+	require.NoError(t, err)
+	assert.Equal(t, CloseMessageTooBig, closeCode(t, f))
+	assert.ErrorIs(t, (<-results).err, ErrorMessageTooBig)
+
+	// Test: Protocol violations close with their code
+	cases := []struct {
+		name string
+		send func(c *Conn)
+		code int
+		err  error
+	}{
+		{"unmasked", func(c *Conn) { newConn(c.conn, nil, true).writeFrame(true, false, TextMessage, []byte("hi")) }, CloseProtocolError, ErrorProtocol},
+		{"invalid utf-8", func(c *Conn) { c.writeFrame(true, false, TextMessage, []byte{0xff, 0xfe}) }, CloseInvalidFramePayloadData, ErrorInvalidPayload},
+		{"stray continuation", func(c *Conn) { c.writeFrame(true, false, continuationFrame, []byte("hi")) }, CloseProtocolError, ErrorProtocol},
+		{"fragmented ping", func(c *Conn) { c.writeFrame(false, false, PingMessage, nil) }, CloseProtocolError, ErrorProtocol},
+		{"reserved close code", func(c *Conn) { c.writeFrame(true, false, CloseMessage, []byte{0x03, 0xe7}) }, CloseProtocolError, ErrorProtocol},
+		{"rsv1 without deflate", func(c *Conn) { c.writeFrame(true, true, TextMessage, []byte("hi")) }, CloseProtocolError, ErrorProtocol},
+	}
+	for _, tc := range cases {
+		srv, client := pipe()
+		results := readAsync(srv)
+		go tc.send(client)
+		f, err := client.readFrame(125)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.code, closeCode(t, f), tc.name)
+		assert.ErrorIs(t, (<-results).err, tc.err, tc.name)
+	}
+
+	// Test: A close without a code is answered without one
+	srv, client = pipe()
+	results = readAsync(srv)
+	go client.writeFrame(true, false, CloseMessage, nil)
+	f, err = client.readFrame(125)
+	require.NoError(t, err)
+	assert.Equal(t, CloseMessage, f.opcode)
+	assert.Empty(t, f.payload)
+	var closeErr *CloseError
+	require.ErrorAs(t, (<-results).err, &closeErr)
+	assert.Equal(t, CloseNoStatusReceived, closeErr.Code)
+	assert.ErrorIs(t, srv.WriteMessage(TextMessage, []byte("late")), ErrorClosed)
+}
+
+func TestCompress(t *testing.T) {
+	for _, data := range [][]byte{{}, []byte("hello"), bytes.Repeat([]byte("abc"), 10000)} {
+		compressed, err := compress(data)
+		require.NoError(t, err)
+		assert.False(t, bytes.HasSuffix(compressed, deflateTail))
+		out, err := decompress(compressed, int64(len(data)))
+		require.NoError(t, err)
+		assert.Equal(t, data, out)
+	}
+
+	// Test: Example of RFC 7692 section 7.2.3.1
+	out, err := decompress([]byte{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00}, 100)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", string(out))
+
+	_, err = decompress([]byte{0xff, 0xff, 0xff}, 100)
+	assert.ErrorIs(t, err, ErrorInvalidPayload)
+}